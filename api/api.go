@@ -66,6 +66,12 @@ func (a *APIServer) Stop() error {
 	return nil
 }
 
+// Handle serves a path outside the API with handler, for endpoints such as
+// DNS over HTTPS that other packages provide. It must be called before Start.
+func (a *APIServer) Handle(path string, handler http.Handler) {
+	a.router.Handle(path, handler)
+}
+
 // setupRoutes sets up the API routes
 func (a *APIServer) setupRoutes() {
 	// API version prefix
@@ -78,7 +84,21 @@ func (a *APIServer) setupRoutes() {
 	v1.HandleFunc("/zones", a.listZonesHandler).Methods("GET")
 	v1.HandleFunc("/zones", a.createZoneHandler).Methods("POST")
 	v1.HandleFunc("/zones/{name}", a.getZoneHandler).Methods("GET")
+	v1.HandleFunc("/zones/{name}", a.updateZoneHandler).Methods("PUT")
 	v1.HandleFunc("/zones/{name}", a.deleteZoneHandler).Methods("DELETE")
+	v1.HandleFunc("/zones/{name}/notify", a.getNotifyStatusHandler).Methods("GET")
+	v1.HandleFunc("/zones/{name}/notify", a.sendNotifyHandler).Methods("POST")
+	v1.HandleFunc("/zones/{name}/dnssec", a.getDNSSECHandler).Methods("GET")
+	v1.HandleFunc("/zones/{name}/dnssec", a.enableDNSSECHandler).Methods("POST")
+	v1.HandleFunc("/zones/{name}/dnssec", a.disableDNSSECHandler).Methods("DELETE")
+	v1.HandleFunc("/zones/{name}/dnssec/ds", a.getDSHandler).Methods("GET")
+	v1.HandleFunc("/zones/{name}/dnssec/ds", a.confirmDSHandler).Methods("POST")
+
+	// TSIG keys
+	v1.HandleFunc("/tsig-keys", a.listTSIGKeysHandler).Methods("GET")
+	v1.HandleFunc("/tsig-keys", a.createTSIGKeyHandler).Methods("POST")
+	v1.HandleFunc("/tsig-keys/{name}", a.getTSIGKeyHandler).Methods("GET")
+	v1.HandleFunc("/tsig-keys/{name}", a.deleteTSIGKeyHandler).Methods("DELETE")
 
 	// Records
 	v1.HandleFunc("/zones/{zone}/records", a.listRecordsHandler).Methods("GET")
@@ -2,15 +2,25 @@ package api
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/PooriaJ/RediDNS/db"
 	"github.com/PooriaJ/RediDNS/models"
+	"github.com/PooriaJ/RediDNS/util"
 	"github.com/gorilla/mux"
+	"github.com/miekg/dns"
 )
 
 // Response represents a standard API response
@@ -61,7 +71,18 @@ func (a *APIServer) listZonesHandler(w http.ResponseWriter, r *http.Request) {
 // createZoneHandler creates a new DNS zone
 func (a *APIServer) createZoneHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Name string `json:"name"`
+		Name            string             `json:"name"`
+		Kind            models.ZoneKind    `json:"kind"`
+		Primaries       []string           `json:"primaries"`
+		AllowTransfer   []string           `json:"allow_transfer"`
+		AllowUpdate     []string           `json:"allow_update"`
+		AlsoNotify      []string           `json:"also_notify"`
+		TSIGPolicy      []models.TSIGGrant `json:"tsig_policy"`
+		TransferKey     string             `json:"transfer_key"`
+		Denial          models.DenialMode  `json:"denial"`
+		NSEC3Salt       string             `json:"nsec3_salt"`
+		NSEC3Iterations uint16             `json:"nsec3_iterations"`
+		NSEC3OptOut     bool               `json:"nsec3_opt_out"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -74,45 +95,863 @@ func (a *APIServer) createZoneHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.Kind == "" {
+		req.Kind = models.ZonePrimary
+	}
+	if err := validateZoneKind(req.Kind, req.Primaries); err != nil {
+		responseError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := util.ValidateACL(req.AllowTransfer); err != nil {
+		responseError(w, http.StatusBadRequest, fmt.Sprintf("Invalid allow_transfer: %v", err))
+		return
+	}
+
+	if err := util.ValidateACL(req.AllowUpdate); err != nil {
+		responseError(w, http.StatusBadRequest, fmt.Sprintf("Invalid allow_update: %v", err))
+		return
+	}
+
+	if err := util.ValidateTargets(req.AlsoNotify); err != nil {
+		responseError(w, http.StatusBadRequest, fmt.Sprintf("Invalid also_notify: %v", err))
+		return
+	}
+
+	if err := a.validateTSIGPolicy(req.TSIGPolicy); err != nil {
+		responseError(w, http.StatusBadRequest, fmt.Sprintf("Invalid tsig_policy: %v", err))
+		return
+	}
+
+	if err := a.validateTransferKey(&req.TransferKey); err != nil {
+		responseError(w, http.StatusBadRequest, fmt.Sprintf("Invalid transfer_key: %v", err))
+		return
+	}
+
 	// Check if zone already exists
 	existingZone, err := a.mariadbClient.GetZone(req.Name)
 	if err != nil {
-		a.logger.Errorf("Error checking for existing zone: %v", err)
-		responseError(w, http.StatusInternalServerError, "Failed to check for existing zone")
+		a.logger.Errorf("Error checking for existing zone: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to check for existing zone")
+		return
+	}
+
+	if existingZone != nil {
+		responseError(w, http.StatusConflict, "Zone already exists")
+		return
+	}
+
+	// Create the zone
+	zone := &models.Zone{
+		Name:            req.Name,
+		Kind:            req.Kind,
+		Primaries:       req.Primaries,
+		AllowTransfer:   req.AllowTransfer,
+		AllowUpdate:     req.AllowUpdate,
+		AlsoNotify:      req.AlsoNotify,
+		TSIGPolicy:      req.TSIGPolicy,
+		TransferKey:     req.TransferKey,
+		Denial:          req.Denial,
+		NSEC3Salt:       req.NSEC3Salt,
+		NSEC3Iterations: req.NSEC3Iterations,
+		NSEC3OptOut:     req.NSEC3OptOut,
+	}
+	if err := validateDenial(zone); err != nil {
+		responseError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := a.mariadbClient.CreateZone(zone); err != nil {
+		a.logger.Errorf("Error creating zone: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to create zone")
+		return
+	}
+
+	// Create default SOA record for the zone. Secondary zones get theirs
+	// from the primary with the first transfer.
+	if zone.Kind == models.ZonePrimary {
+		err = a.createDefaultSOARecord(zone.Name)
+		if err != nil {
+			a.logger.Errorf("Error creating default SOA record: %v", err)
+			// Continue even if SOA creation fails, as the zone was created successfully
+		}
+	}
+
+	responseJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Data:    zone,
+	})
+}
+
+// getZoneHandler gets a specific DNS zone
+func (a *APIServer) getZoneHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	zone, err := a.mariadbClient.GetZone(name)
+	if err != nil {
+		a.logger.Errorf("Error getting zone: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to get zone")
+		return
+	}
+
+	if zone == nil {
+		responseError(w, http.StatusNotFound, "Zone not found")
+		return
+	}
+
+	responseJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    zone,
+	})
+}
+
+// updateZoneHandler updates the settings of a DNS zone
+func (a *APIServer) updateZoneHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	// Only the fields present in the request are changed
+	var req struct {
+		Kind            *models.ZoneKind    `json:"kind"`
+		Primaries       *[]string           `json:"primaries"`
+		AllowTransfer   *[]string           `json:"allow_transfer"`
+		AllowUpdate     *[]string           `json:"allow_update"`
+		AlsoNotify      *[]string           `json:"also_notify"`
+		TSIGPolicy      *[]models.TSIGGrant `json:"tsig_policy"`
+		TransferKey     *string             `json:"transfer_key"`
+		Denial          *models.DenialMode  `json:"denial"`
+		NSEC3Salt       *string             `json:"nsec3_salt"`
+		NSEC3Iterations *uint16             `json:"nsec3_iterations"`
+		NSEC3OptOut     *bool               `json:"nsec3_opt_out"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		responseError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	zone, err := a.mariadbClient.GetZone(name)
+	if err != nil {
+		a.logger.Errorf("Error getting zone: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to get zone")
+		return
+	}
+
+	if zone == nil {
+		responseError(w, http.StatusNotFound, "Zone not found")
+		return
+	}
+
+	if req.Kind != nil {
+		zone.Kind = *req.Kind
+	}
+	if req.Primaries != nil {
+		zone.Primaries = *req.Primaries
+	}
+	if err := validateZoneKind(zone.Kind, zone.Primaries); err != nil {
+		responseError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if req.AllowTransfer != nil {
+		if err := util.ValidateACL(*req.AllowTransfer); err != nil {
+			responseError(w, http.StatusBadRequest, fmt.Sprintf("Invalid allow_transfer: %v", err))
+			return
+		}
+		zone.AllowTransfer = *req.AllowTransfer
+	}
+
+	if req.AllowUpdate != nil {
+		if err := util.ValidateACL(*req.AllowUpdate); err != nil {
+			responseError(w, http.StatusBadRequest, fmt.Sprintf("Invalid allow_update: %v", err))
+			return
+		}
+		zone.AllowUpdate = *req.AllowUpdate
+	}
+
+	if req.AlsoNotify != nil {
+		if err := util.ValidateTargets(*req.AlsoNotify); err != nil {
+			responseError(w, http.StatusBadRequest, fmt.Sprintf("Invalid also_notify: %v", err))
+			return
+		}
+		zone.AlsoNotify = *req.AlsoNotify
+	}
+
+	if req.TSIGPolicy != nil {
+		if err := a.validateTSIGPolicy(*req.TSIGPolicy); err != nil {
+			responseError(w, http.StatusBadRequest, fmt.Sprintf("Invalid tsig_policy: %v", err))
+			return
+		}
+		zone.TSIGPolicy = *req.TSIGPolicy
+	}
+
+	if req.TransferKey != nil {
+		if err := a.validateTransferKey(req.TransferKey); err != nil {
+			responseError(w, http.StatusBadRequest, fmt.Sprintf("Invalid transfer_key: %v", err))
+			return
+		}
+		zone.TransferKey = *req.TransferKey
+	}
+
+	if req.Denial != nil {
+		zone.Denial = *req.Denial
+	}
+	if req.NSEC3Salt != nil {
+		zone.NSEC3Salt = *req.NSEC3Salt
+	}
+	if req.NSEC3Iterations != nil {
+		zone.NSEC3Iterations = *req.NSEC3Iterations
+	}
+	if req.NSEC3OptOut != nil {
+		zone.NSEC3OptOut = *req.NSEC3OptOut
+	}
+	if err := validateDenial(zone); err != nil {
+		responseError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := a.mariadbClient.UpdateZone(zone); err != nil {
+		a.logger.Errorf("Error updating zone: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to update zone")
+		return
+	}
+
+	responseJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    zone,
+	})
+}
+
+// validateZoneKind checks the kind of a zone and that secondary zones have
+// primaries to transfer from
+func validateZoneKind(kind models.ZoneKind, primaries []string) error {
+	switch kind {
+	case models.ZonePrimary:
+	case models.ZoneSecondary:
+		if len(primaries) == 0 {
+			return fmt.Errorf("Secondary zones require at least one primary")
+		}
+	default:
+		return fmt.Errorf("Invalid kind %q, must be primary or secondary", kind)
+	}
+
+	if err := util.ValidateTargets(primaries); err != nil {
+		return fmt.Errorf("Invalid primaries: %v", err)
+	}
+	return nil
+}
+
+// tsigSecretSizes are the sizes of generated secrets by algorithm, those of
+// the algorithm's hash (RFC 8945 section 6.2)
+var tsigSecretSizes = map[string]int{
+	models.TSIGHmacSHA256: sha256.Size,
+	models.TSIGHmacSHA512: sha512.Size,
+}
+
+// validateTSIGPolicy checks that a TSIG policy grants known operations to
+// existing keys, normalizing the key names
+func (a *APIServer) validateTSIGPolicy(policy []models.TSIGGrant) error {
+	for i := range policy {
+		grant := &policy[i]
+		grant.Key = strings.ToLower(strings.TrimSuffix(grant.Key, "."))
+
+		key, err := a.mariadbClient.GetTSIGKey(grant.Key)
+		if err != nil {
+			return fmt.Errorf("Failed to check TSIG key %s: %v", grant.Key, err)
+		}
+		if key == nil {
+			return fmt.Errorf("Unknown TSIG key %q", grant.Key)
+		}
+
+		if len(grant.Operations) == 0 {
+			return fmt.Errorf("TSIG key %s is granted no operations", grant.Key)
+		}
+		for _, op := range grant.Operations {
+			switch op {
+			case models.TSIGAXFR, models.TSIGIXFR, models.TSIGUpdate, models.TSIGNotify:
+			default:
+				return fmt.Errorf("Invalid operation %q for TSIG key %s, must be axfr, ixfr, update or notify", op, grant.Key)
+			}
+		}
+	}
+	return nil
+}
+
+// validateTransferKey checks that the key a zone signs its outgoing SOA
+// queries, transfers and NOTIFYs with exists, normalizing its name. An empty
+// name turns signing off.
+func (a *APIServer) validateTransferKey(name *string) error {
+	*name = strings.ToLower(strings.TrimSuffix(*name, "."))
+	if *name == "" {
+		return nil
+	}
+
+	key, err := a.mariadbClient.GetTSIGKey(*name)
+	if err != nil {
+		return fmt.Errorf("Failed to check TSIG key %s: %v", *name, err)
+	}
+	if key == nil {
+		return fmt.Errorf("Unknown TSIG key %q", *name)
+	}
+	return nil
+}
+
+// validateContent checks the content of a record. Structured types store
+// their fields as a JSON object, which must decode into their model.
+func validateContent(record *models.Record) error {
+	switch record.Type {
+	case models.TypeALIAS:
+		if _, ok := dns.IsDomainName(record.Content); !ok {
+			return fmt.Errorf("ALIAS content must be a hostname")
+		}
+
+	case models.TypeTXT:
+		if _, err := util.TXTStrings(record.Content); err != nil {
+			return fmt.Errorf("Invalid TXT content: %v", err)
+		}
+
+	case models.TypeDS:
+		var ds models.DSRecord
+		if err := decodeContent(record, &ds); err != nil {
+			return err
+		}
+		if err := validateHex("DS digest", ds.Digest); err != nil {
+			return err
+		}
+
+	case models.TypeSVCB, models.TypeHTTPS:
+		var svcb models.SVCBRecord
+		if err := decodeContent(record, &svcb); err != nil {
+			return err
+		}
+		if _, ok := dns.IsDomainName(dns.Fqdn(svcb.Target)); !ok {
+			return fmt.Errorf("%s target must be a hostname or \".\"", record.Type)
+		}
+		// Alias mode only points to the target (RFC 9460 section 2.4.2)
+		if svcb.Priority == 0 && len(svcb.Params) > 0 {
+			return fmt.Errorf("%s records with priority 0 cannot have parameters", record.Type)
+		}
+		if _, err := util.SVCBParams(svcb.Params); err != nil {
+			return fmt.Errorf("Invalid %s parameters: %v", record.Type, err)
+		}
+
+	case models.TypeTLSA:
+		var tlsa models.TLSARecord
+		if err := decodeContent(record, &tlsa); err != nil {
+			return err
+		}
+		if tlsa.Usage > 3 || tlsa.Selector > 1 || tlsa.MatchingType > 2 {
+			return fmt.Errorf("TLSA usage must be 0-3, selector 0-1 and matching type 0-2")
+		}
+		if err := validateHex("TLSA certificate", tlsa.Certificate); err != nil {
+			return err
+		}
+
+	case models.TypeSSHFP:
+		var sshfp models.SSHFPRecord
+		if err := decodeContent(record, &sshfp); err != nil {
+			return err
+		}
+		if sshfp.Algorithm == 0 {
+			return fmt.Errorf("SSHFP algorithm is required")
+		}
+		if sshfp.Type != 1 && sshfp.Type != 2 {
+			return fmt.Errorf("SSHFP type must be 1 (SHA-1) or 2 (SHA-256)")
+		}
+		if err := validateHex("SSHFP fingerprint", sshfp.Fingerprint); err != nil {
+			return err
+		}
+
+	case models.TypeNAPTR:
+		var naptr models.NAPTRRecord
+		if err := decodeContent(record, &naptr); err != nil {
+			return err
+		}
+		if _, ok := dns.IsDomainName(dns.Fqdn(naptr.Replacement)); !ok {
+			return fmt.Errorf("NAPTR replacement must be a hostname or \".\"")
+		}
+		// Either the expression or the replacement is used (RFC 3403 section 4.1)
+		if naptr.Regexp != "" && dns.Fqdn(naptr.Replacement) != "." {
+			return fmt.Errorf("NAPTR records cannot have both a regexp and a replacement")
+		}
+
+	case models.TypeLOC:
+		var loc models.LOCRecord
+		if err := decodeContent(record, &loc); err != nil {
+			return err
+		}
+		if loc.Latitude < -90 || loc.Latitude > 90 || loc.Longitude < -180 || loc.Longitude > 180 {
+			return fmt.Errorf("LOC latitude must be between -90 and 90 and longitude between -180 and 180 degrees")
+		}
+		if loc.Altitude < -100000 || loc.Altitude > 42849672.95 {
+			return fmt.Errorf("LOC altitude must be between -100000 and 42849672.95 meters")
+		}
+		for _, meters := range []*float64{loc.Size, loc.HorizPre, loc.VertPre} {
+			if meters != nil && (*meters < 0 || *meters > 90000000) {
+				return fmt.Errorf("LOC size and precisions must be between 0 and 90000000 meters")
+			}
+		}
+
+	case models.TypeURI:
+		var uri models.URIRecord
+		if err := decodeContent(record, &uri); err != nil {
+			return err
+		}
+		if u, err := url.Parse(uri.Target); err != nil || u.Scheme == "" {
+			return fmt.Errorf("URI target must be an absolute URI")
+		}
+
+	default:
+		// Any other type the parser knows, or TYPEnnn, is given as RDATA
+		// in presentation format or as \# <length> <hex> (RFC 3597)
+		if record.Type.IsGeneric() {
+			if _, err := util.ParseRData(record.Name, uint32(record.TTL), string(record.Type), record.Content); err != nil {
+				return fmt.Errorf("Invalid %s record: %v", record.Type, err)
+			}
+		}
+	}
+	return nil
+}
+
+// decodeContent decodes the JSON content of a record into v
+func decodeContent(record *models.Record, v interface{}) error {
+	if err := json.Unmarshal([]byte(record.Content), v); err != nil {
+		return fmt.Errorf("%s content must be a JSON object: %v", record.Type, err)
+	}
+	return nil
+}
+
+// validateHex checks that a field holds hex encoded data
+func validateHex(field, value string) error {
+	if value == "" {
+		return fmt.Errorf("%s is required", field)
+	}
+	if _, err := hex.DecodeString(value); err != nil {
+		return fmt.Errorf("%s must be hex encoded", field)
+	}
+	return nil
+}
+
+// validateCoexistence checks that a record of the given type can be added
+// to a name owning records of existingTypes: a CNAME must be the only record
+// at its name (RFC 1034 section 3.6.2), and an ALIAS stands in for the A and
+// AAAA records of its name
+func validateCoexistence(recordType models.RecordType, existingTypes []models.RecordType) error {
+	for _, existing := range existingTypes {
+		if existing == models.TypeCNAME {
+			return fmt.Errorf("Name already has a CNAME record, which cannot coexist with other records")
+		}
+	}
+	if recordType == models.TypeCNAME && len(existingTypes) > 0 {
+		return fmt.Errorf("A CNAME record cannot coexist with other records at the same name")
+	}
+
+	for _, existing := range existingTypes {
+		switch {
+		case existing == models.TypeDNAME && recordType == models.TypeDNAME:
+			return fmt.Errorf("Name already has a DNAME record")
+		case existing == models.TypeALIAS && (recordType == models.TypeA || recordType == models.TypeAAAA || recordType == models.TypeALIAS):
+			return fmt.Errorf("Name already has an ALIAS record, which cannot coexist with A, AAAA or other ALIAS records")
+		case recordType == models.TypeALIAS && (existing == models.TypeA || existing == models.TypeAAAA):
+			return fmt.Errorf("An ALIAS record cannot coexist with A or AAAA records at the same name")
+		}
+	}
+	return nil
+}
+
+// dnameConflict returns why a record can't be added next to the DNAME
+// records of a zone, or "" if it can. Names below a DNAME are redirected, so
+// no data may exist there (RFC 6672 section 2.4).
+func (a *APIServer) dnameConflict(zone string, record *models.Record) (string, error) {
+	if record.Type == models.TypeDNAME {
+		below, err := a.mariadbClient.HasRecordsBelow(zone, record.Name)
+		if err != nil {
+			return "", err
+		}
+		if below {
+			return "A DNAME record cannot be added above names that own records", nil
+		}
+	}
+
+	for name := record.Name; name != zone; {
+		i := strings.Index(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+
+		dnames, err := a.mariadbClient.GetRecordsByNameAndType(zone, name, models.TypeDNAME)
+		if err != nil {
+			return "", err
+		}
+		if len(dnames) > 0 {
+			return fmt.Sprintf("Names below the DNAME record of %s cannot own records", name), nil
+		}
+	}
+	return "", nil
+}
+
+// maxNSEC3Iterations is the highest NSEC3 iteration count accepted. Validators
+// treat zones with more iterations as insecure (RFC 9276 section 3.2).
+const maxNSEC3Iterations = 100
+
+// validateDenial checks the denial of existence settings of a zone
+func validateDenial(zone *models.Zone) error {
+	switch zone.Denial {
+	case "", models.DenialNSEC, models.DenialNSEC3:
+	default:
+		return fmt.Errorf("Invalid denial %q, must be nsec or nsec3", zone.Denial)
+	}
+
+	if len(zone.NSEC3Salt) > 64 {
+		return fmt.Errorf("nsec3_salt must be at most 32 bytes")
+	}
+	if _, err := hex.DecodeString(zone.NSEC3Salt); err != nil {
+		return fmt.Errorf("nsec3_salt must be a hex string")
+	}
+	if zone.NSEC3Iterations > maxNSEC3Iterations {
+		return fmt.Errorf("nsec3_iterations must be at most %d", maxNSEC3Iterations)
+	}
+	return nil
+}
+
+// deleteZoneHandler deletes a DNS zone
+func (a *APIServer) deleteZoneHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	// Check if zone exists
+	zone, err := a.mariadbClient.GetZone(name)
+	if err != nil {
+		a.logger.Errorf("Error checking for zone: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to check for zone")
+		return
+	}
+
+	if zone == nil {
+		responseError(w, http.StatusNotFound, "Zone not found")
+		return
+	}
+
+	// Delete the zone
+	if err := a.mariadbClient.DeleteZone(name); err != nil {
+		a.logger.Errorf("Error deleting zone: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to delete zone")
+		return
+	}
+
+	// Invalidate cache for this zone
+	ctx := context.Background()
+	pattern := fmt.Sprintf("dns:record:%s:*", name)
+	keys, _ := a.redisClient.Keys(ctx, pattern)
+	if len(keys) > 0 {
+		a.redisClient.Del(ctx, keys...)
+	}
+
+	responseJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    map[string]string{"message": "Zone deleted successfully"},
+	})
+}
+
+// listRecordsHandler lists all records for a zone
+func (a *APIServer) listRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	zoneName := vars["zone"]
+
+	// Check if zone exists
+	zone, err := a.mariadbClient.GetZone(zoneName)
+	if err != nil {
+		a.logger.Errorf("Error checking for zone: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to check for zone")
+		return
+	}
+
+	if zone == nil {
+		responseError(w, http.StatusNotFound, "Zone not found")
+		return
+	}
+
+	// Get records for the zone
+	records, err := a.mariadbClient.GetRecordsByZone(zoneName)
+	if err != nil {
+		a.logger.Errorf("Error getting records: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to get records")
+		return
+	}
+
+	responseJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    records,
+	})
+}
+
+// errRecordNotFound is returned by record changes whose record was deleted
+// in the meantime
+var errRecordNotFound = errors.New("record not found")
+
+// errSOAExists is returned when creating a SOA record for a zone that has
+// one already
+var errSOAExists = errors.New("zone already has a SOA record")
+
+// changeZoneRecords writes a change to the records of a zone, the increment
+// of its SOA serial and the journal entry IXFR is served from in one
+// transaction, so secondaries never miss a change. change is called with
+// the records of the zone as in db.UpdateZoneRecords. A zone without a SOA
+// record gets a default one first.
+func (a *APIServer) changeZoneRecords(zoneName string, change func(records []models.Record) (removed, added []models.Record, err error)) error {
+	keep := a.config.DNS.Transfer.JournalSize
+	soaRecord, err := a.mariadbClient.UpdateZoneRecords(zoneName, keep, change)
+	if errors.Is(err, db.ErrNoSOA) {
+		if err := a.createDefaultSOARecord(zoneName); err != nil {
+			return err
+		}
+		soaRecord, err = a.mariadbClient.UpdateZoneRecords(zoneName, keep, change)
+	}
+	if err != nil {
+		return err
+	}
+	if soaRecord == nil {
+		return nil // Nothing changed
+	}
+
+	// Invalidate cache for this record
+	ctx := context.Background()
+
+	// Invalidate single record cache
+	singleCacheKey := fmt.Sprintf("dns:record:%s:%s:%s", soaRecord.Zone, soaRecord.Name, soaRecord.Type)
+	a.redisClient.Del(ctx, singleCacheKey)
+
+	// Invalidate multiple records cache
+	multiCacheKey := fmt.Sprintf("dns:records:%s:%s:%s", soaRecord.Zone, soaRecord.Name, soaRecord.Type)
+	a.redisClient.Del(ctx, multiCacheKey)
+
+	// Announce the new serial so secondaries get notified. The change is
+	// committed already, so failing to announce it is not an error.
+	if err := a.publishZoneUpdate(soaRecord); err != nil {
+		a.logger.Warnf("Failed to announce new serial of zone %s: %v", zoneName, err)
+	}
+	return nil
+}
+
+// createSOARecord creates the SOA record of a zone that has none and
+// announces its serial. There is no earlier serial to journal the change
+// from, so secondaries pick the zone up with a full transfer.
+func (a *APIServer) createSOARecord(record *models.Record) error {
+	existing, err := a.mariadbClient.GetRecordsByNameAndType(record.Zone, record.Zone, models.TypeSOA)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return errSOAExists
+	}
+
+	if err := a.mariadbClient.CreateRecord(record); err != nil {
+		return err
+	}
+	if err := a.publishZoneUpdate(record); err != nil {
+		a.logger.Warnf("Failed to announce new serial of zone %s: %v", record.Zone, err)
+	}
+	return nil
+}
+
+// publishZoneUpdate publishes the serial of a zone's SOA record
+func (a *APIServer) publishZoneUpdate(soaRecord *models.Record) error {
+	var soaData models.SOARecord
+	if err := json.Unmarshal([]byte(soaRecord.Content), &soaData); err != nil {
+		return fmt.Errorf("failed to parse SOA record: %w", err)
+	}
+
+	update := &models.ZoneUpdate{Zone: soaRecord.Zone, Serial: soaData.Serial}
+	if err := a.redisClient.PublishZoneUpdate(context.Background(), update); err != nil {
+		return fmt.Errorf("failed to publish zone update: %w", err)
+	}
+
+	return nil
+}
+
+// getNotifyStatusHandler returns the result of the latest NOTIFY sent to
+// each secondary of a zone
+func (a *APIServer) getNotifyStatusHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	zone, err := a.mariadbClient.GetZone(name)
+	if err != nil {
+		a.logger.Errorf("Error getting zone: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to get zone")
+		return
+	}
+
+	if zone == nil {
+		responseError(w, http.StatusNotFound, "Zone not found")
+		return
+	}
+
+	statuses, err := a.mariadbClient.GetNotifyStatuses(name)
+	if err != nil {
+		a.logger.Errorf("Error getting NOTIFY status: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to get NOTIFY status")
+		return
+	}
+
+	responseJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    statuses,
+	})
+}
+
+// sendNotifyHandler notifies the secondaries of a zone of its current serial
+func (a *APIServer) sendNotifyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	zone, err := a.mariadbClient.GetZone(name)
+	if err != nil {
+		a.logger.Errorf("Error getting zone: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to get zone")
+		return
+	}
+
+	if zone == nil {
+		responseError(w, http.StatusNotFound, "Zone not found")
+		return
+	}
+
+	soaRecords, err := a.mariadbClient.GetRecordsByNameAndType(name, name, models.TypeSOA)
+	if err != nil {
+		a.logger.Errorf("Error getting SOA record: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to get SOA record")
+		return
+	}
+
+	if len(soaRecords) == 0 {
+		responseError(w, http.StatusConflict, "Zone has no SOA record")
+		return
+	}
+
+	if err := a.publishZoneUpdate(&soaRecords[0]); err != nil {
+		a.logger.Errorf("Error sending NOTIFY: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to send NOTIFY")
+		return
+	}
+
+	responseJSON(w, http.StatusAccepted, Response{
+		Success: true,
+		Data:    map[string]string{"message": "NOTIFY scheduled"},
+	})
+}
+
+// getDNSSECHandler returns the signing keys of a zone along with their
+// rollover timeline
+func (a *APIServer) getDNSSECHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	zone, err := a.mariadbClient.GetZone(name)
+	if err != nil {
+		a.logger.Errorf("Error getting zone: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to get zone")
+		return
+	}
+
+	if zone == nil {
+		responseError(w, http.StatusNotFound, "Zone not found")
+		return
+	}
+
+	keys, err := a.mariadbClient.GetDNSSECKeys(name)
+	if err != nil {
+		a.logger.Errorf("Error getting DNSSEC keys: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to get DNSSEC keys")
+		return
+	}
+
+	responseJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    keys,
+	})
+}
+
+// errDNSSECEnabled aborts enabling DNSSEC for a zone that has keys already
+var errDNSSECEnabled = errors.New("DNSSEC is already enabled")
+
+// enableDNSSECHandler signs a zone by generating a KSK and a ZSK for it
+func (a *APIServer) enableDNSSECHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	zone, err := a.mariadbClient.GetZone(name)
+	if err != nil {
+		a.logger.Errorf("Error getting zone: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to get zone")
 		return
 	}
 
-	if existingZone != nil {
-		responseError(w, http.StatusConflict, "Zone already exists")
+	if zone == nil {
+		responseError(w, http.StatusNotFound, "Zone not found")
 		return
 	}
 
-	// Create the zone
-	zone, err := a.mariadbClient.CreateZone(req.Name)
-	if err != nil {
-		a.logger.Errorf("Error creating zone: %v", err)
-		responseError(w, http.StatusInternalServerError, "Failed to create zone")
+	// Both keys are created in one transaction, which also keeps concurrent
+	// requests from enabling DNSSEC twice
+	now := time.Now()
+	var keys []models.DNSSECKey
+	err = a.mariadbClient.UpdateDNSSECKeys(zone.Name, func(existing []models.DNSSECKey) ([]models.DNSSECKey, error) {
+		for _, key := range existing {
+			if key.State != models.KeyRemoved {
+				return nil, errDNSSECEnabled
+			}
+		}
+
+		for _, role := range []models.KeyRole{models.KeyRoleKSK, models.KeyRoleZSK} {
+			key, err := util.GenerateDNSSECKey(zone.Name, role)
+			if err != nil {
+				return nil, err
+			}
+
+			// The first keys sign right away, there is nothing to roll over from
+			key.State = models.KeyActive
+			key.PublishedAt = &now
+			key.ActiveAt = &now
+			keys = append(keys, *key)
+		}
+		return keys, nil
+	})
+	if errors.Is(err, errDNSSECEnabled) {
+		responseError(w, http.StatusConflict, "DNSSEC is already enabled for this zone")
 		return
 	}
-
-	// Create default SOA record for the zone
-	err = a.createDefaultSOARecord(zone.Name)
 	if err != nil {
-		a.logger.Errorf("Error creating default SOA record: %v", err)
-		// Continue even if SOA creation fails, as the zone was created successfully
+		a.logger.Errorf("Error creating DNSSEC keys: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to create DNSSEC keys")
+		return
 	}
+	a.publishDNSSECKeysUpdate(zone.Name)
 
 	responseJSON(w, http.StatusCreated, Response{
 		Success: true,
-		Data:    zone,
+		Data:    keys,
 	})
 }
 
-// getZoneHandler gets a specific DNS zone
-func (a *APIServer) getZoneHandler(w http.ResponseWriter, r *http.Request) {
+// disableDNSSECHandler removes the signing keys of a zone, leaving it
+// unsigned. Validators fail the zone while its parent still publishes a DS
+// record, so unless the configured resolvers see none the removal has to be
+// forced.
+func (a *APIServer) disableDNSSECHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
 
+	force := false
+	if value := r.URL.Query().Get("force"); value != "" {
+		var err error
+		if force, err = strconv.ParseBool(value); err != nil {
+			responseError(w, http.StatusBadRequest, "Invalid force parameter")
+			return
+		}
+	}
+
 	zone, err := a.mariadbClient.GetZone(name)
 	if err != nil {
 		a.logger.Errorf("Error getting zone: %v", err)
@@ -125,22 +964,62 @@ func (a *APIServer) getZoneHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !force {
+		if err := a.checkNoParentDS(name); err != nil {
+			responseError(w, http.StatusConflict, fmt.Sprintf("%v; remove the DS record at the parent first, or repeat with force=true", err))
+			return
+		}
+	}
+
+	if err := a.mariadbClient.DeleteDNSSECKeys(name); err != nil {
+		a.logger.Errorf("Error deleting DNSSEC keys: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to delete DNSSEC keys")
+		return
+	}
+	a.publishDNSSECKeysUpdate(zone.Name)
+
 	responseJSON(w, http.StatusOK, Response{
 		Success: true,
-		Data:    zone,
+		Data:    map[string]string{"message": "DNSSEC disabled successfully"},
 	})
 }
 
-// deleteZoneHandler deletes a DNS zone
-func (a *APIServer) deleteZoneHandler(w http.ResponseWriter, r *http.Request) {
+// checkNoParentDS returns an error unless the configured resolvers find that
+// the parent of a zone publishes no DS record for it
+func (a *APIServer) checkNoParentDS(zone string) error {
+	if len(a.config.DNS.DNSSEC.Resolvers) == 0 {
+		return fmt.Errorf("The parent's DS record cannot be checked without dns.dnssec.resolvers")
+	}
+
+	records, err := util.LookupDS(a.config.DNS.DNSSEC.Resolvers, zone)
+	if err != nil {
+		return fmt.Errorf("Failed to look up the parent's DS record: %v", err)
+	}
+	if len(records) > 0 {
+		return fmt.Errorf("The parent publishes a DS record for this zone")
+	}
+	return nil
+}
+
+// publishDNSSECKeysUpdate announces that the DNSSEC keys of a zone changed,
+// so the DNS servers stop signing with the keys they hold in memory. The
+// change is committed already, so failing to announce it is only logged.
+func (a *APIServer) publishDNSSECKeysUpdate(zone string) {
+	if err := a.redisClient.PublishDNSSECKeysUpdate(context.Background(), zone); err != nil {
+		a.logger.Warnf("Failed to announce DNSSEC key change of zone %s: %v", zone, err)
+	}
+}
+
+// getDSHandler returns the DS records to publish in the parent zone. During
+// a KSK rollover both the old and the new KSK are listed.
+func (a *APIServer) getDSHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
 
-	// Check if zone exists
 	zone, err := a.mariadbClient.GetZone(name)
 	if err != nil {
-		a.logger.Errorf("Error checking for zone: %v", err)
-		responseError(w, http.StatusInternalServerError, "Failed to check for zone")
+		a.logger.Errorf("Error getting zone: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to get zone")
 		return
 	}
 
@@ -149,37 +1028,41 @@ func (a *APIServer) deleteZoneHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete the zone
-	if err := a.mariadbClient.DeleteZone(name); err != nil {
-		a.logger.Errorf("Error deleting zone: %v", err)
-		responseError(w, http.StatusInternalServerError, "Failed to delete zone")
+	keys, err := a.mariadbClient.GetDNSSECKeys(name)
+	if err != nil {
+		a.logger.Errorf("Error getting DNSSEC keys: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to get DNSSEC keys")
 		return
 	}
 
-	// Invalidate cache for this zone
-	ctx := context.Background()
-	pattern := fmt.Sprintf("dns:record:%s:*", name)
-	keys, _ := a.redisClient.Keys(ctx, pattern)
-	if len(keys) > 0 {
-		a.redisClient.Del(ctx, keys...)
+	var records []models.DSRecord
+	for i := range keys {
+		if keys[i].Role == models.KeyRoleKSK && keys[i].State != models.KeyRemoved {
+			records = append(records, *util.DSRecord(&keys[i]))
+		}
+	}
+
+	if len(records) == 0 {
+		responseError(w, http.StatusNotFound, "DNSSEC is not enabled for this zone")
+		return
 	}
 
 	responseJSON(w, http.StatusOK, Response{
 		Success: true,
-		Data:    map[string]string{"message": "Zone deleted successfully"},
+		Data:    records,
 	})
 }
 
-// listRecordsHandler lists all records for a zone
-func (a *APIServer) listRecordsHandler(w http.ResponseWriter, r *http.Request) {
+// confirmDSHandler records that the parent zone publishes the DS record of
+// the current KSK, letting a KSK rollover waiting for it continue
+func (a *APIServer) confirmDSHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	zoneName := vars["zone"]
+	name := vars["name"]
 
-	// Check if zone exists
-	zone, err := a.mariadbClient.GetZone(zoneName)
+	zone, err := a.mariadbClient.GetZone(name)
 	if err != nil {
-		a.logger.Errorf("Error checking for zone: %v", err)
-		responseError(w, http.StatusInternalServerError, "Failed to check for zone")
+		a.logger.Errorf("Error getting zone: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to get zone")
 		return
 	}
 
@@ -188,74 +1071,203 @@ func (a *APIServer) listRecordsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get records for the zone
-	records, err := a.mariadbClient.GetRecordsByZone(zoneName)
+	propagation := time.Duration(a.config.DNS.DNSSEC.PropagationDelay) * time.Second
+	var confirmed bool
+	err = a.mariadbClient.UpdateDNSSECKeys(name, func(keys []models.DNSSECKey) ([]models.DNSSECKey, error) {
+		changed := util.ConfirmDS(keys, time.Now(), propagation)
+		confirmed = changed != nil
+		return changed, nil
+	})
 	if err != nil {
-		a.logger.Errorf("Error getting records: %v", err)
-		responseError(w, http.StatusInternalServerError, "Failed to get records")
+		a.logger.Errorf("Error updating DNSSEC keys: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to update DNSSEC keys")
+		return
+	}
+
+	if !confirmed {
+		responseError(w, http.StatusNotFound, "DNSSEC is not enabled for this zone")
+		return
+	}
+	a.publishDNSSECKeysUpdate(zone.Name)
+
+	keys, err := a.mariadbClient.GetDNSSECKeys(name)
+	if err != nil {
+		a.logger.Errorf("Error getting DNSSEC keys: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to get DNSSEC keys")
 		return
 	}
 
 	responseJSON(w, http.StatusOK, Response{
 		Success: true,
-		Data:    records,
+		Data:    keys,
 	})
 }
 
-// updateZoneSOASerial updates the SOA record's serial number for a zone
-func (a *APIServer) updateZoneSOASerial(zoneName string) error {
-	// Get the SOA record for the zone
-	soaRecords, err := a.mariadbClient.GetRecordsByNameAndType(zoneName, zoneName, models.TypeSOA)
+// listTSIGKeysHandler lists all TSIG keys
+func (a *APIServer) listTSIGKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := a.mariadbClient.GetTSIGKeys()
 	if err != nil {
-		return fmt.Errorf("failed to get SOA record: %w", err)
+		a.logger.Errorf("Error getting TSIG keys: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to get TSIG keys")
+		return
 	}
 
-	// If no SOA record exists, create one
-	if len(soaRecords) == 0 {
-		return a.createDefaultSOARecord(zoneName)
+	responseJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    keys,
+	})
+}
+
+// createTSIGKeyHandler creates a TSIG key, generating its secret unless
+// one is given
+func (a *APIServer) createTSIGKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name      string `json:"name"`
+		Algorithm string `json:"algorithm"`
+		Secret    string `json:"secret"`
 	}
 
-	// Get the first SOA record
-	soaRecord := soaRecords[0]
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		responseError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
 
-	// Parse the SOA record content
-	var soaData models.SOARecord
-	if err := json.Unmarshal([]byte(soaRecord.Content), &soaData); err != nil {
-		return fmt.Errorf("failed to parse SOA record: %w", err)
+	req.Name = strings.ToLower(strings.TrimSuffix(req.Name, "."))
+	if _, ok := dns.IsDomainName(req.Name); !ok || req.Name == "" {
+		responseError(w, http.StatusBadRequest, "Key name must be a domain name")
+		return
 	}
 
-	// Generate new serial number based on current timestamp
-	newSerial := uint32(time.Now().Unix())
+	if req.Algorithm == "" {
+		req.Algorithm = models.TSIGHmacSHA256
+	}
+	size, ok := tsigSecretSizes[req.Algorithm]
+	if !ok {
+		responseError(w, http.StatusBadRequest, fmt.Sprintf("Invalid algorithm %q, must be %s or %s", req.Algorithm, models.TSIGHmacSHA256, models.TSIGHmacSHA512))
+		return
+	}
 
-	// Update the serial number
-	soaData.Serial = newSerial
+	if req.Secret == "" {
+		secret := make([]byte, size)
+		if _, err := rand.Read(secret); err != nil {
+			a.logger.Errorf("Error generating TSIG secret: %v", err)
+			responseError(w, http.StatusInternalServerError, "Failed to generate TSIG secret")
+			return
+		}
+		req.Secret = base64.StdEncoding.EncodeToString(secret)
+	} else if secret, err := base64.StdEncoding.DecodeString(req.Secret); err != nil || len(secret) == 0 {
+		responseError(w, http.StatusBadRequest, "Secret must be base64 encoded")
+		return
+	}
 
-	// Marshal the updated SOA record data
-	soaContent, err := json.Marshal(soaData)
+	existingKey, err := a.mariadbClient.GetTSIGKey(req.Name)
 	if err != nil {
-		return fmt.Errorf("failed to marshal SOA record: %w", err)
+		a.logger.Errorf("Error checking for existing TSIG key: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to check for existing TSIG key")
+		return
 	}
 
-	// Update the record content
-	soaRecord.Content = string(soaContent)
+	if existingKey != nil {
+		responseError(w, http.StatusConflict, "TSIG key already exists")
+		return
+	}
 
-	// Update the record in the database
-	if err := a.mariadbClient.UpdateRecord(&soaRecord); err != nil {
-		return fmt.Errorf("failed to update SOA record: %w", err)
+	key := &models.TSIGKey{
+		Name:      req.Name,
+		Algorithm: req.Algorithm,
+		Secret:    req.Secret,
+		CreatedAt: time.Now(),
+	}
+	if err := a.mariadbClient.CreateTSIGKey(key); err != nil {
+		a.logger.Errorf("Error creating TSIG key: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to create TSIG key")
+		return
 	}
 
-	// Invalidate cache for this record
-	ctx := context.Background()
+	// Let the DNS servers load the new key
+	if err := a.redisClient.PublishTSIGKeysUpdate(context.Background()); err != nil {
+		a.logger.Warnf("Failed to publish TSIG key update: %v", err)
+	}
 
-	// Invalidate single record cache
-	singleCacheKey := fmt.Sprintf("dns:record:%s:%s:%s", soaRecord.Zone, soaRecord.Name, soaRecord.Type)
-	a.redisClient.Del(ctx, singleCacheKey)
+	responseJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Data:    models.CreatedTSIGKey{TSIGKey: *key, Secret: key.Secret},
+	})
+}
 
-	// Invalidate multiple records cache
-	multiCacheKey := fmt.Sprintf("dns:records:%s:%s:%s", soaRecord.Zone, soaRecord.Name, soaRecord.Type)
-	a.redisClient.Del(ctx, multiCacheKey)
+// getTSIGKeyHandler gets a TSIG key by name
+func (a *APIServer) getTSIGKeyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
 
-	return nil
+	key, err := a.mariadbClient.GetTSIGKey(name)
+	if err != nil {
+		a.logger.Errorf("Error getting TSIG key: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to get TSIG key")
+		return
+	}
+
+	if key == nil {
+		responseError(w, http.StatusNotFound, "TSIG key not found")
+		return
+	}
+
+	responseJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    key,
+	})
+}
+
+// deleteTSIGKeyHandler deletes a TSIG key that no zone's policy refers to
+func (a *APIServer) deleteTSIGKeyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	key, err := a.mariadbClient.GetTSIGKey(name)
+	if err != nil {
+		a.logger.Errorf("Error getting TSIG key: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to get TSIG key")
+		return
+	}
+
+	if key == nil {
+		responseError(w, http.StatusNotFound, "TSIG key not found")
+		return
+	}
+
+	zones, err := a.mariadbClient.GetAllZones()
+	if err != nil {
+		a.logger.Errorf("Error getting zones: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to get zones")
+		return
+	}
+	for _, zone := range zones {
+		if zone.TransferKey == key.Name {
+			responseError(w, http.StatusConflict, fmt.Sprintf("TSIG key is used by zone %s", zone.Name))
+			return
+		}
+		for _, grant := range zone.TSIGPolicy {
+			if grant.Key == key.Name {
+				responseError(w, http.StatusConflict, fmt.Sprintf("TSIG key is used by zone %s", zone.Name))
+				return
+			}
+		}
+	}
+
+	if err := a.mariadbClient.DeleteTSIGKey(key.Name); err != nil {
+		a.logger.Errorf("Error deleting TSIG key: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to delete TSIG key")
+		return
+	}
+
+	if err := a.redisClient.PublishTSIGKeysUpdate(context.Background()); err != nil {
+		a.logger.Warnf("Failed to publish TSIG key update: %v", err)
+	}
+
+	responseJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    map[string]string{"message": "TSIG key deleted successfully"},
+	})
 }
 
 // createRecordHandler creates a new DNS record
@@ -276,6 +1288,11 @@ func (a *APIServer) createRecordHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if zone.Kind == models.ZoneSecondary {
+		responseError(w, http.StatusConflict, "Records of secondary zones are managed by their primaries")
+		return
+	}
+
 	// Parse request body
 	var record models.Record
 	if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
@@ -292,12 +1309,12 @@ func (a *APIServer) createRecordHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Handle @ symbol for root domain
-	if record.Name == "@" {
-		record.Name = zoneName
-	} else if !strings.Contains(record.Name, ".") {
-		// If name doesn't contain a dot, it's a subdomain - append the zone name
-		record.Name = record.Name + "." + zoneName
+	// Names are relative to the zone unless fully qualified, '@' being the
+	// zone itself and '*' labels making wildcards
+	record.Name = util.FormatRecordName(record.Name, zoneName)
+	if err := util.ValidateRecordName(record.Name, zoneName); err != nil {
+		responseError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
 	if record.Type == "" {
@@ -305,11 +1322,44 @@ func (a *APIServer) createRecordHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Types given as TYPEnnn (RFC 3597) are stored by their mnemonic
+	if rrtype, ok := util.RecordTypeCode(string(record.Type)); ok {
+		record.Type = models.RecordType(dns.Type(rrtype).String())
+	}
+
 	if record.Content == "" {
 		responseError(w, http.StatusBadRequest, "Record content is required")
 		return
 	}
 
+	if err := validateContent(&record); err != nil {
+		responseError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// CNAME and ALIAS records limit what else their name may own
+	types, err := a.mariadbClient.GetRecordTypesByName(zoneName, record.Name)
+	if err != nil {
+		a.logger.Errorf("Error checking for existing records: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to check for existing records")
+		return
+	}
+	if err := validateCoexistence(record.Type, types); err != nil {
+		responseError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	conflict, err := a.dnameConflict(zoneName, &record)
+	if err != nil {
+		a.logger.Errorf("Error checking for DNAME records: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to check for DNAME records")
+		return
+	}
+	if conflict != "" {
+		responseError(w, http.StatusConflict, conflict)
+		return
+	}
+
 	// Set default TTL if not provided
 	if record.TTL <= 0 {
 		record.TTL = 120 // 2 MIN default
@@ -329,18 +1379,30 @@ func (a *APIServer) createRecordHandler(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	// Create the record
-	if err := a.mariadbClient.CreateRecord(&record); err != nil {
-		a.logger.Errorf("Error creating record: %v", err)
-		responseError(w, http.StatusInternalServerError, "Failed to create record")
+	if record.Type == models.TypeSOA && record.Name != zoneName {
+		responseError(w, http.StatusBadRequest, "SOA record must be at the zone apex")
 		return
 	}
 
-	// Update the zone's SOA serial number
-	if record.Type != models.TypeSOA { // Don't update SOA when creating an SOA record
-		if err := a.updateZoneSOASerial(zoneName); err != nil {
-			a.logger.Warnf("Failed to update SOA serial: %v", err)
-		}
+	// Create the record, together with the new SOA serial unless it is the
+	// SOA record itself
+	if record.Type == models.TypeSOA {
+		err = a.createSOARecord(&record)
+	} else {
+		added := []models.Record{record}
+		err = a.changeZoneRecords(zoneName, func([]models.Record) ([]models.Record, []models.Record, error) {
+			return nil, added, nil
+		})
+		record = added[0]
+	}
+	if errors.Is(err, errSOAExists) {
+		responseError(w, http.StatusConflict, "Zone already has a SOA record, update it instead")
+		return
+	}
+	if err != nil {
+		a.logger.Errorf("Error creating record: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to create record")
+		return
 	}
 
 	// Publish record update event
@@ -404,6 +1466,11 @@ func (a *APIServer) updateRecordHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if zone.Kind == models.ZoneSecondary {
+		responseError(w, http.StatusConflict, "Records of secondary zones are managed by their primaries")
+		return
+	}
+
 	// Parse request body
 	var updateData struct {
 		Name     string `json:"name"`
@@ -439,6 +1506,10 @@ func (a *APIServer) updateRecordHandler(w http.ResponseWriter, r *http.Request)
 	// Update record fields
 	if updateData.Content != "" {
 		record.Content = updateData.Content
+		if err := validateContent(record); err != nil {
+			responseError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 	}
 	if updateData.TTL > 0 {
 		// Validate TTL is one of the allowed values
@@ -458,20 +1529,31 @@ func (a *APIServer) updateRecordHandler(w http.ResponseWriter, r *http.Request)
 	}
 	record.Priority = updateData.Priority
 
-	// Update the record in the database
-	if err := a.mariadbClient.UpdateRecord(record); err != nil {
+	// Update the record in the database, together with the new SOA serial.
+	// An edit of the SOA record keeps its serial if it was increased.
+	added := []models.Record{*record}
+	err = a.changeZoneRecords(zoneName, func(records []models.Record) ([]models.Record, []models.Record, error) {
+		old, ok := findRecord(records, record.ID)
+		if !ok {
+			return nil, nil, errRecordNotFound
+		}
+		return []models.Record{old}, added, nil
+	})
+	*record = added[0]
+	if errors.Is(err, errRecordNotFound) {
+		responseError(w, http.StatusNotFound, "Record not found")
+		return
+	}
+	if errors.Is(err, db.ErrSerialNotIncreased) {
+		responseError(w, http.StatusBadRequest, "SOA serial cannot be decreased")
+		return
+	}
+	if err != nil {
 		a.logger.Errorf("Error updating record: %v", err)
 		responseError(w, http.StatusInternalServerError, "Failed to update record")
 		return
 	}
 
-	// Update the zone's SOA serial number
-	if record.Type != models.TypeSOA { // Don't update SOA when updating an SOA record
-		if err := a.updateZoneSOASerial(zoneName); err != nil {
-			a.logger.Warnf("Failed to update SOA serial: %v", err)
-		}
-	}
-
 	// Invalidate cache for this record
 	ctx := context.Background()
 
@@ -519,6 +1601,11 @@ func (a *APIServer) deleteRecordHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if zone.Kind == models.ZoneSecondary {
+		responseError(w, http.StatusConflict, "Records of secondary zones are managed by their primaries")
+		return
+	}
+
 	// Get the record before deleting it (to know its name and type for cache invalidation)
 	record, err := a.mariadbClient.GetRecordByID(recordID)
 	if err != nil {
@@ -532,18 +1619,28 @@ func (a *APIServer) deleteRecordHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Delete the record
-	if err := a.mariadbClient.DeleteRecord(recordID); err != nil {
-		a.logger.Errorf("Error deleting record: %v", err)
-		responseError(w, http.StatusInternalServerError, "Failed to delete record")
+	// The serial of the SOA record is what secondaries follow the zone by
+	if record.Type == models.TypeSOA {
+		responseError(w, http.StatusConflict, "The SOA record of a zone cannot be deleted")
 		return
 	}
 
-	// Update the zone's SOA serial number
-	if record.Type != models.TypeSOA { // Don't update SOA when deleting an SOA record
-		if err := a.updateZoneSOASerial(zoneName); err != nil {
-			a.logger.Warnf("Failed to update SOA serial: %v", err)
+	// Delete the record, together with the new SOA serial
+	err = a.changeZoneRecords(zoneName, func(records []models.Record) ([]models.Record, []models.Record, error) {
+		old, ok := findRecord(records, recordID)
+		if !ok {
+			return nil, nil, errRecordNotFound
 		}
+		return []models.Record{old}, nil, nil
+	})
+	if errors.Is(err, errRecordNotFound) {
+		responseError(w, http.StatusNotFound, "Record not found")
+		return
+	}
+	if err != nil {
+		a.logger.Errorf("Error deleting record: %v", err)
+		responseError(w, http.StatusInternalServerError, "Failed to delete record")
+		return
 	}
 
 	// Invalidate cache for this record
@@ -570,6 +1667,16 @@ func (a *APIServer) deleteRecordHandler(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+// findRecord returns the record with the given ID
+func findRecord(records []models.Record, id int64) (models.Record, bool) {
+	for _, record := range records {
+		if record.ID == id {
+			return record, true
+		}
+	}
+	return models.Record{}, false
+}
+
 // Helper functions for API responses
 
 // responseJSON sends a JSON response
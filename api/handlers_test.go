@@ -0,0 +1,80 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/PooriaJ/RediDNS/models"
+)
+
+func TestValidateContent(t *testing.T) {
+	tests := []struct {
+		name       string
+		recordType models.RecordType
+		content    string
+		wantErr    bool
+	}{
+		// TXT records take a plain value, a JSON array of strings or
+		// quoted strings in zone file format
+		{"TXT plain value", models.TypeTXT, "v=spf1 -all", false},
+		{"TXT longer than 255 bytes", models.TypeTXT, strings.Repeat("a", 1000), false},
+		{"TXT JSON array", models.TypeTXT, `["v=DKIM1; k=rsa; ", "p=MIGfMA0"]`, false},
+		{"TXT quoted strings", models.TypeTXT, `"v=DKIM1; k=rsa; " "p=MIGfMA0"`, false},
+		{"TXT empty JSON array", models.TypeTXT, `[]`, true},
+		{"TXT JSON array of numbers", models.TypeTXT, `[1, 2]`, true},
+		{"TXT malformed JSON array", models.TypeTXT, `["one", `, true},
+
+		// SVCB and HTTPS records
+		{"HTTPS service mode", models.TypeHTTPS, `{"priority": 1, "target": ".", "params": {"alpn": "h2,h3", "port": "443"}}`, false},
+		{"SVCB alias mode", models.TypeSVCB, `{"priority": 0, "target": "svc.example.net"}`, false},
+		{"HTTPS alias mode with parameters", models.TypeHTTPS, `{"priority": 0, "target": "svc.example.net", "params": {"alpn": "h2"}}`, true},
+		{"SVCB invalid target", models.TypeSVCB, `{"priority": 1, "target": "bad..name"}`, true},
+		{"SVCB unknown parameter", models.TypeSVCB, `{"priority": 1, "target": ".", "params": {"bogus": "x"}}`, true},
+		{"HTTPS invalid port", models.TypeHTTPS, `{"priority": 1, "target": ".", "params": {"port": "https"}}`, true},
+		{"HTTPS invalid ipv4hint", models.TypeHTTPS, `{"priority": 1, "target": ".", "params": {"ipv4hint": "2001:db8::1"}}`, true},
+		{"SVCB priority out of range", models.TypeSVCB, `{"priority": 70000, "target": "."}`, true},
+		{"SVCB not JSON", models.TypeSVCB, `1 . alpn=h2`, true},
+
+		// TLSA records
+		{"TLSA", models.TypeTLSA, `{"usage": 3, "selector": 1, "matching_type": 1, "certificate": "0c72ac70b745ac19998811b131d662c9ac69dbdbe7cb23e5b514b56664c5d3d6"}`, false},
+		{"TLSA usage out of range", models.TypeTLSA, `{"usage": 4, "selector": 1, "matching_type": 1, "certificate": "0c72"}`, true},
+		{"TLSA selector out of range", models.TypeTLSA, `{"usage": 3, "selector": 2, "matching_type": 1, "certificate": "0c72"}`, true},
+		{"TLSA matching type out of range", models.TypeTLSA, `{"usage": 3, "selector": 1, "matching_type": 3, "certificate": "0c72"}`, true},
+		{"TLSA certificate not hex", models.TypeTLSA, `{"usage": 3, "selector": 1, "matching_type": 1, "certificate": "not hex"}`, true},
+		{"TLSA without certificate", models.TypeTLSA, `{"usage": 3, "selector": 1, "matching_type": 1}`, true},
+		{"TLSA negative usage", models.TypeTLSA, `{"usage": -1, "selector": 1, "matching_type": 1, "certificate": "0c72"}`, true},
+
+		// LOC records
+		{"LOC", models.TypeLOC, `{"latitude": 52.37, "longitude": 4.89, "altitude": -2, "size": 1, "horiz_pre": 10000, "vert_pre": 10}`, false},
+		{"LOC without precisions", models.TypeLOC, `{"latitude": 52.37, "longitude": 4.89, "altitude": -2}`, false},
+		{"LOC latitude out of range", models.TypeLOC, `{"latitude": 90.5, "longitude": 4.89}`, true},
+		{"LOC longitude out of range", models.TypeLOC, `{"latitude": 52.37, "longitude": -180.5}`, true},
+		{"LOC altitude too low", models.TypeLOC, `{"latitude": 52.37, "longitude": 4.89, "altitude": -100001}`, true},
+		{"LOC altitude too high", models.TypeLOC, `{"latitude": 52.37, "longitude": 4.89, "altitude": 42849673}`, true},
+		{"LOC negative size", models.TypeLOC, `{"latitude": 52.37, "longitude": 4.89, "size": -1}`, true},
+		{"LOC precision too large", models.TypeLOC, `{"latitude": 52.37, "longitude": 4.89, "horiz_pre": 90000001}`, true},
+		{"LOC not JSON", models.TypeLOC, `52 22 12.000 N 4 53 24.000 E -2.00m`, true},
+
+		// Other types take RDATA in presentation format or as \# <length> <hex>
+		{"TYPEnnn generic RDATA", models.RecordType("TYPE65280"), `\# 4 0a000001`, false},
+		{"TYPEnnn without data", models.RecordType("TYPE65280"), `\# 0`, false},
+		{"known type as generic RDATA", models.RecordType("HINFO"), `\# 9 02504305 4c696e7578`, false},
+		{"known type in presentation format", models.RecordType("HINFO"), `"PC" "Linux"`, false},
+		{"TYPEnnn length mismatch", models.RecordType("TYPE65280"), `\# 4 0a00`, true},
+		{"TYPEnnn not hex", models.RecordType("TYPE65280"), `\# 2 zzzz`, true},
+		{"TYPEnnn in presentation format", models.RecordType("TYPE65280"), "hello", true},
+		{"type generated by the server", models.RecordType("RRSIG"), `\# 0`, true},
+		{"invalid presentation format", models.RecordType("AFSDB"), "not-a-number afs.example.com.", true},
+	}
+
+	for _, tt := range tests {
+		record := &models.Record{Zone: "example.com", Name: "www.example.com", Type: tt.recordType, Content: tt.content, TTL: 300}
+		err := validateContent(record)
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: validateContent accepted %q", tt.name, tt.content)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: validateContent: %v", tt.name, err)
+		}
+	}
+}
@@ -53,15 +53,17 @@ func main() {
 		logger.Fatalf("Failed to initialize DNS server: %v", err)
 	}
 
-	// Start DNS server in a goroutine
-	go func() {
-		if err := dnsServer.Start(); err != nil {
-			logger.Fatalf("Failed to start DNS server: %v", err)
-		}
-	}()
+	// Start DNS listeners
+	if err := dnsServer.Start(); err != nil {
+		logger.Fatalf("Failed to start DNS server: %v", err)
+	}
 
 	// Initialize and start API server
 	apiServer := api.NewAPIServer(cfg, redisClient, mariadbClient, logger)
+	if cfg.DNS.DoH.Enabled && cfg.DNS.DoH.Port == 0 {
+		// Answer DNS over HTTPS queries on the API server
+		apiServer.Handle(server.DoHPath, dnsServer.DoHHandler())
+	}
 	go func() {
 		if err := apiServer.Start(); err != nil {
 			logger.Fatalf("Failed to start API server: %v", err)
@@ -71,7 +73,11 @@ func main() {
 	// Wait for interrupt signal to gracefully shutdown the server
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	select {
+	case <-sigChan:
+	case err := <-dnsServer.Errors():
+		logger.Errorf("DNS server stopped: %v", err)
+	}
 
 	// Shutdown servers gracefully
 	logger.Info("Shutting down servers...")
@@ -7,13 +7,79 @@ import (
 	"github.com/spf13/viper"
 )
 
+// ListenerConfig describes a single DNS listener
+type ListenerConfig struct {
+	Address  string `mapstructure:"address"`
+	Port     int    `mapstructure:"port"`
+	Protocol string `mapstructure:"protocol"` // udp, tcp or tcp-tls (DNS over TLS)
+	// Unhosted sets the answer for names outside our zones: refuse (default)
+	// or nxdomain, which answers NXDOMAIN without the AA bit
+	Unhosted string `mapstructure:"unhosted"`
+}
+
 // Config holds all configuration for the application
 type Config struct {
 	// DNS Server configuration
 	DNS struct {
-		Port     int    `mapstructure:"port"`
-		Address  string `mapstructure:"address"`
-		Protocol string `mapstructure:"protocol"`
+		// Port and Address are used when no listeners are configured,
+		// in which case the server listens on both UDP and TCP
+		Port      int              `mapstructure:"port"`
+		Address   string           `mapstructure:"address"`
+		Listeners []ListenerConfig `mapstructure:"listeners"`
+		// DNS over TLS configuration, used by tcp-tls listeners
+		TLS struct {
+			CertFile       string `mapstructure:"cert_file"`       // PEM certificate chain
+			KeyFile        string `mapstructure:"key_file"`        // PEM private key
+			ReloadInterval int    `mapstructure:"reload_interval"` // Seconds between checks for a renewed certificate
+		} `mapstructure:"tls"`
+		// DNS over HTTPS configuration (RFC 8484). Queries are answered at
+		// /dns-query on the API server, or on an HTTPS listener of their own
+		// presenting the dns.tls certificate when Port is set
+		DoH struct {
+			Enabled bool   `mapstructure:"enabled"`
+			Address string `mapstructure:"address"`
+			Port    int    `mapstructure:"port"` // 0 serves DoH on the API server
+		} `mapstructure:"doh"`
+		// EDNS0 configuration
+		EDNS struct {
+			UDPSize int `mapstructure:"udp_size"` // UDP payload size advertised to clients
+		} `mapstructure:"edns"`
+		// MinimalResponses leaves the additional section empty instead of
+		// adding the addresses of MX, SRV and NS targets in our zones
+		MinimalResponses bool `mapstructure:"minimal_responses"`
+		// ANY sets the answer to ANY queries (RFC 8482): hinfo (default)
+		// answers with a single synthesized HINFO record, tcp answers with
+		// all RRsets of the name over TCP and asks UDP clients to retry over
+		// TCP, refuse answers REFUSED
+		ANY string `mapstructure:"any"`
+		// Zone transfer configuration
+		Transfer struct {
+			JournalSize int `mapstructure:"journal_size"` // Changes kept per zone for IXFR
+		} `mapstructure:"transfer"`
+		// NOTIFY configuration
+		Notify struct {
+			Retries  int `mapstructure:"retries"`  // Attempts per target before giving up
+			Interval int `mapstructure:"interval"` // Seconds before the first retry, doubled after each attempt
+			Timeout  int `mapstructure:"timeout"`  // Seconds to wait for an acknowledgement
+		} `mapstructure:"notify"`
+		// DNSSEC configuration
+		DNSSEC struct {
+			SignatureValidity int `mapstructure:"signature_validity"` // Seconds an RRSIG stays valid
+			DNSKEYTTL         int `mapstructure:"dnskey_ttl"`         // TTL of the DNSKEY RRset
+			ZSKLifetime       int `mapstructure:"zsk_lifetime"`       // Seconds before a ZSK is rolled, 0 disables
+			KSKLifetime       int `mapstructure:"ksk_lifetime"`       // Seconds before a KSK is rolled, 0 disables
+			PropagationDelay  int `mapstructure:"propagation_delay"`  // Seconds for key changes to reach caches
+			DSDelay           int `mapstructure:"ds_delay"`           // Seconds allowed for the parent to publish a new DS
+			// Resolvers asked whether the parent publishes the DS of a new
+			// KSK. Without them the DS has to be confirmed through the API.
+			Resolvers []string `mapstructure:"resolvers"`
+		} `mapstructure:"dnssec"`
+		// ALIAS record configuration
+		Alias struct {
+			Resolvers []string `mapstructure:"resolvers"` // Upstream resolvers for targets outside our zones
+			MaxTTL    int      `mapstructure:"max_ttl"`   // Upper bound of the TTL of synthesized records
+			Timeout   int      `mapstructure:"timeout"`   // Seconds to wait for an upstream resolver
+		} `mapstructure:"alias"`
 		// SOA configuration
 		SOA struct {
 			PrimaryNameserver string `mapstructure:"primary_nameserver"`
@@ -89,6 +155,57 @@ func LoadConfig() (*Config, error) {
 		return nil, fmt.Errorf("unable to decode config into struct: %w", err)
 	}
 
+	// Fall back to UDP and TCP on the legacy address and port
+	if len(config.DNS.Listeners) == 0 {
+		for _, protocol := range []string{"udp", "tcp"} {
+			config.DNS.Listeners = append(config.DNS.Listeners, ListenerConfig{
+				Address:  config.DNS.Address,
+				Port:     config.DNS.Port,
+				Protocol: protocol,
+			})
+		}
+	}
+
+	// Validate listeners
+	for i := range config.DNS.Listeners {
+		listener := &config.DNS.Listeners[i]
+		switch listener.Protocol {
+		case "udp", "tcp":
+		case "tcp-tls":
+			if config.DNS.TLS.CertFile == "" || config.DNS.TLS.KeyFile == "" {
+				return nil, fmt.Errorf("dns listener %d: tcp-tls requires dns.tls.cert_file and dns.tls.key_file", i)
+			}
+			if listener.Port == 0 {
+				listener.Port = 853 // RFC 7858 section 3.1
+			}
+		default:
+			return nil, fmt.Errorf("dns listener %d: unsupported protocol %q", i, listener.Protocol)
+		}
+		switch listener.Unhosted {
+		case "", "refuse", "nxdomain":
+		default:
+			return nil, fmt.Errorf("dns listener %d: unsupported unhosted policy %q", i, listener.Unhosted)
+		}
+		if listener.Port <= 0 || listener.Port > 65535 {
+			return nil, fmt.Errorf("dns listener %d: invalid port %d", i, listener.Port)
+		}
+	}
+
+	if config.DNS.DoH.Enabled && config.DNS.DoH.Port != 0 {
+		if config.DNS.TLS.CertFile == "" || config.DNS.TLS.KeyFile == "" {
+			return nil, fmt.Errorf("dns.doh: an HTTPS listener requires dns.tls.cert_file and dns.tls.key_file")
+		}
+		if config.DNS.DoH.Port < 0 || config.DNS.DoH.Port > 65535 {
+			return nil, fmt.Errorf("dns.doh: invalid port %d", config.DNS.DoH.Port)
+		}
+	}
+
+	switch config.DNS.ANY {
+	case "", "hinfo", "tcp", "refuse":
+	default:
+		return nil, fmt.Errorf("dns: unsupported any policy %q", config.DNS.ANY)
+	}
+
 	return &config, nil
 }
 
@@ -97,7 +214,27 @@ func setDefaults() {
 	// DNS Server defaults
 	viper.SetDefault("dns.port", 53)
 	viper.SetDefault("dns.address", "0.0.0.0")
-	viper.SetDefault("dns.protocol", "udp")
+	viper.SetDefault("dns.tls.reload_interval", 60)
+	viper.SetDefault("dns.doh.enabled", false)
+	viper.SetDefault("dns.doh.address", "0.0.0.0")
+	viper.SetDefault("dns.doh.port", 0)
+	viper.SetDefault("dns.edns.udp_size", 1232)
+	viper.SetDefault("dns.minimal_responses", false)
+	viper.SetDefault("dns.any", "hinfo")
+	viper.SetDefault("dns.transfer.journal_size", 1000)
+	viper.SetDefault("dns.notify.retries", 5)
+	viper.SetDefault("dns.notify.interval", 5)
+	viper.SetDefault("dns.notify.timeout", 3)
+	viper.SetDefault("dns.dnssec.signature_validity", 1209600)
+	viper.SetDefault("dns.dnssec.dnskey_ttl", 3600)
+	viper.SetDefault("dns.dnssec.zsk_lifetime", 2592000)
+	viper.SetDefault("dns.dnssec.ksk_lifetime", 31536000)
+	viper.SetDefault("dns.dnssec.propagation_delay", 86400)
+	viper.SetDefault("dns.dnssec.ds_delay", 604800)
+	viper.SetDefault("dns.dnssec.resolvers", []string{})
+	viper.SetDefault("dns.alias.resolvers", []string{})
+	viper.SetDefault("dns.alias.max_ttl", 300)
+	viper.SetDefault("dns.alias.timeout", 5)
 
 	// SOA defaults
 	viper.SetDefault("dns.soa.primary_nameserver", "ns1.example.com")
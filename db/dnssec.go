@@ -0,0 +1,171 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/PooriaJ/RediDNS/models"
+)
+
+// dnssecKeyColumns are the columns selected by scanDNSSECKey
+const dnssecKeyColumns = "id, zone, role, state, algorithm, flags, key_tag, public_key, private_key, " +
+	"published_at, active_at, retire_at, remove_at, ds_seen_at, created_at"
+
+// scanDNSSECKey scans a row selected with dnssecKeyColumns
+func scanDNSSECKey(row rowScanner) (*models.DNSSECKey, error) {
+	var key models.DNSSECKey
+	var publishedAt, activeAt, retireAt, removeAt, dsSeenAt sql.NullTime
+	err := row.Scan(
+		&key.ID, &key.Zone, &key.Role, &key.State, &key.Algorithm, &key.Flags, &key.KeyTag,
+		&key.PublicKey, &key.PrivateKey, &publishedAt, &activeAt, &retireAt, &removeAt, &dsSeenAt,
+		&key.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	key.PublishedAt = nullTime(publishedAt)
+	key.ActiveAt = nullTime(activeAt)
+	key.RetireAt = nullTime(retireAt)
+	key.RemoveAt = nullTime(removeAt)
+	key.DSSeenAt = nullTime(dsSeenAt)
+	return &key, nil
+}
+
+// nullTime converts a nullable timestamp column to a time pointer
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// execer is implemented by *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// saveDNSSECKey creates a key without an ID and updates the timeline of
+// an existing one
+func saveDNSSECKey(db execer, key *models.DNSSECKey) error {
+	if key.ID != 0 {
+		_, err := db.Exec(
+			"UPDATE dnssec_keys SET state = ?, published_at = ?, active_at = ?, retire_at = ?, remove_at = ?, ds_seen_at = ? WHERE id = ?",
+			key.State, key.PublishedAt, key.ActiveAt, key.RetireAt, key.RemoveAt, key.DSSeenAt, key.ID,
+		)
+		return err
+	}
+
+	result, err := db.Exec(
+		`INSERT INTO dnssec_keys (zone, role, state, algorithm, flags, key_tag, public_key, private_key,
+			published_at, active_at, retire_at, remove_at, ds_seen_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		key.Zone, key.Role, key.State, key.Algorithm, key.Flags, key.KeyTag, key.PublicKey, key.PrivateKey,
+		key.PublishedAt, key.ActiveAt, key.RetireAt, key.RemoveAt, key.DSSeenAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	key.ID = id
+	return nil
+}
+
+// GetDNSSECKeys retrieves the signing keys of a zone, including removed ones
+func (m *MariaDBClient) GetDNSSECKeys(zone string) ([]models.DNSSECKey, error) {
+	rows, err := m.db.Query("SELECT "+dnssecKeyColumns+" FROM dnssec_keys WHERE zone = ? ORDER BY id", zone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []models.DNSSECKey
+	for rows.Next() {
+		key, err := scanDNSSECKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// GetSignedZones returns the names of zones that have keys which are not removed
+func (m *MariaDBClient) GetSignedZones() ([]string, error) {
+	rows, err := m.db.Query("SELECT DISTINCT zone FROM dnssec_keys WHERE state <> ?", models.KeyRemoved)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var zones []string
+	for rows.Next() {
+		var zone string
+		if err := rows.Scan(&zone); err != nil {
+			return nil, err
+		}
+		zones = append(zones, zone)
+	}
+
+	return zones, rows.Err()
+}
+
+// UpdateDNSSECKeys passes the keys of a zone to update while holding a lock
+// on them, so that concurrent schedulers don't roll the same key twice. The
+// keys update returns are stored: keys without an ID are created, the
+// others have their state and timeline updated.
+func (m *MariaDBClient) UpdateDNSSECKeys(zone string, update func([]models.DNSSECKey) ([]models.DNSSECKey, error)) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT "+dnssecKeyColumns+" FROM dnssec_keys WHERE zone = ? ORDER BY id FOR UPDATE", zone)
+	if err != nil {
+		return err
+	}
+
+	var keys []models.DNSSECKey
+	for rows.Next() {
+		key, err := scanDNSSECKey(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, *key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	changed, err := update(keys)
+	if err != nil {
+		return err
+	}
+
+	for i := range changed {
+		if err := saveDNSSECKey(tx, &changed[i]); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeleteDNSSECKeys removes all signing keys of a zone
+func (m *MariaDBClient) DeleteDNSSECKeys(zone string) error {
+	_, err := m.db.Exec("DELETE FROM dnssec_keys WHERE zone = ?", zone)
+	return err
+}
@@ -0,0 +1,214 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/PooriaJ/RediDNS/models"
+)
+
+// BumpZoneSerial increments the serial of a zone's SOA record and journals
+// the records removed and added by the change, keeping at most keep journal
+// entries for the zone. A keep of 0 disables the journal. The SOA update and
+// the journal entry are written in one transaction. It returns the updated
+// SOA record, or nil if the zone has no SOA record.
+func (m *MariaDBClient) BumpZoneSerial(zone string, removed, added []models.Record, keep int) (*models.Record, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	soa, err := lockSOA(tx, zone)
+	if err != nil || soa == nil {
+		return nil, err
+	}
+
+	oldSerial, newSerial, err := incrementSerial(tx, soa)
+	if err != nil {
+		return nil, err
+	}
+
+	if keep > 0 {
+		if err := insertJournalEntry(tx, zone, oldSerial, newSerial, removed, added, keep); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return soa, nil
+}
+
+// lockSOA selects the SOA record of a zone within a transaction, locking it
+// until the transaction ends so changes to the zone are serialized. It
+// returns nil if the zone has no SOA record.
+func lockSOA(tx *sql.Tx, zone string) (*models.Record, error) {
+	var soa models.Record
+	err := tx.QueryRow(
+		"SELECT id, zone, name, type, content, ttl, priority, created_at, updated_at FROM records WHERE zone = ? AND name = ? AND type = ? ORDER BY id LIMIT 1 FOR UPDATE",
+		zone, zone, models.TypeSOA,
+	).Scan(
+		&soa.ID, &soa.Zone, &soa.Name, &soa.Type, &soa.Content,
+		&soa.TTL, &soa.Priority, &soa.CreatedAt, &soa.UpdatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No SOA record
+		}
+		return nil, err
+	}
+	return &soa, nil
+}
+
+// incrementSerial increments the serial of a SOA record locked by lockSOA,
+// updating soa, and returns the old and new serials
+func incrementSerial(tx *sql.Tx, soa *models.Record) (uint32, uint32, error) {
+	var soaData models.SOARecord
+	if err := json.Unmarshal([]byte(soa.Content), &soaData); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse SOA record: %w", err)
+	}
+
+	oldSerial := soaData.Serial
+	soaData.Serial = nextSerial(oldSerial)
+
+	content, err := json.Marshal(soaData)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to marshal SOA record: %w", err)
+	}
+	soa.Content = string(content)
+
+	if _, err := tx.Exec("UPDATE records SET content = ? WHERE id = ?", soa.Content, soa.ID); err != nil {
+		return 0, 0, err
+	}
+	return oldSerial, soaData.Serial, nil
+}
+
+// nextSerial returns the serial following serial. Serials are based on the
+// current timestamp but must always increase, even for several changes
+// within the same second.
+func nextSerial(serial uint32) uint32 {
+	next := uint32(time.Now().Unix())
+	if int32(next-serial) <= 0 {
+		next = serial + 1
+	}
+	return next
+}
+
+// replaceSOA replaces a SOA record locked by lockSOA with an edited version
+// of it, updating both, and returns the old and new serials. The edited
+// serial is kept if it is newer than the old one in serial number arithmetic
+// (RFC 1982), an unchanged serial is incremented as for any other change and
+// an older one is rejected with ErrSerialNotIncreased.
+func replaceSOA(tx *sql.Tx, soa, edited *models.Record) (uint32, uint32, error) {
+	var oldData, soaData models.SOARecord
+	if err := json.Unmarshal([]byte(soa.Content), &oldData); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse SOA record: %w", err)
+	}
+	if err := json.Unmarshal([]byte(edited.Content), &soaData); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse SOA record: %w", err)
+	}
+
+	switch d := int32(soaData.Serial - oldData.Serial); {
+	case d == 0:
+		soaData.Serial = nextSerial(oldData.Serial)
+	case d < 0:
+		return 0, 0, fmt.Errorf("serial %d is not newer than %d: %w", soaData.Serial, oldData.Serial, ErrSerialNotIncreased)
+	}
+
+	content, err := json.Marshal(soaData)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to marshal SOA record: %w", err)
+	}
+	edited.Content = string(content)
+
+	if err := replaceRecord(tx, edited); err != nil {
+		return 0, 0, err
+	}
+	*soa = *edited
+	return oldData.Serial, soaData.Serial, nil
+}
+
+// insertJournalEntry writes a journal entry within a transaction and prunes
+// the zone's journal to keep entries
+func insertJournalEntry(tx *sql.Tx, zone string, serialFrom, serialTo uint32, removed, added []models.Record, keep int) error {
+	if removed == nil {
+		removed = []models.Record{}
+	}
+	if added == nil {
+		added = []models.Record{}
+	}
+
+	removedData, err := json.Marshal(removed)
+	if err != nil {
+		return err
+	}
+	addedData, err := json.Marshal(added)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO zone_journal (zone, serial_from, serial_to, removed, added) VALUES (?, ?, ?, ?, ?)",
+		zone, serialFrom, serialTo, removedData, addedData,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to write zone journal: %w", err)
+	}
+
+	// Prune entries beyond the configured journal size
+	_, err = tx.Exec(`
+		DELETE FROM zone_journal WHERE zone = ? AND id <= (
+			SELECT id FROM (
+				SELECT id FROM zone_journal WHERE zone = ? ORDER BY id DESC LIMIT 1 OFFSET ?
+			) AS pruned
+		)`,
+		zone, zone, keep,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to prune zone journal: %w", err)
+	}
+
+	return nil
+}
+
+// GetZoneJournal retrieves the journal of a zone, oldest entry first
+func (m *MariaDBClient) GetZoneJournal(zone string) ([]models.JournalEntry, error) {
+	rows, err := m.db.Query(
+		"SELECT id, zone, serial_from, serial_to, removed, added, created_at FROM zone_journal WHERE zone = ? ORDER BY id",
+		zone,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []models.JournalEntry
+	for rows.Next() {
+		var entry models.JournalEntry
+		var removed, added []byte
+		err := rows.Scan(
+			&entry.ID, &entry.Zone, &entry.SerialFrom, &entry.SerialTo, &removed, &added, &entry.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(removed, &entry.Removed); err != nil {
+			return nil, fmt.Errorf("failed to parse journal entry %d: %w", entry.ID, err)
+		}
+		if err := json.Unmarshal(added, &entry.Added); err != nil {
+			return nil, fmt.Errorf("failed to parse journal entry %d: %w", entry.ID, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
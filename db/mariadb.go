@@ -2,7 +2,9 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/PooriaJ/RediDNS/config"
@@ -58,6 +60,18 @@ func (m *MariaDBClient) InitSchema() error {
 		CREATE TABLE IF NOT EXISTS zones (
 			id INT AUTO_INCREMENT PRIMARY KEY,
 			name VARCHAR(255) NOT NULL UNIQUE,
+			kind VARCHAR(16) NOT NULL DEFAULT 'primary',
+			primaries TEXT,
+			allow_transfer TEXT,
+			allow_update TEXT,
+			also_notify TEXT,
+			tsig_policy TEXT,
+			transfer_key VARCHAR(255) NOT NULL DEFAULT '',
+			denial VARCHAR(8) NOT NULL DEFAULT 'nsec',
+			nsec3_salt VARCHAR(64) NOT NULL DEFAULT '',
+			nsec3_iterations SMALLINT UNSIGNED NOT NULL DEFAULT 0,
+			nsec3_opt_out BOOLEAN NOT NULL DEFAULT FALSE,
+			refreshed_at TIMESTAMP NULL,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
 			INDEX (name)
@@ -87,15 +101,220 @@ func (m *MariaDBClient) InitSchema() error {
 		return fmt.Errorf("failed to create records table: %w", err)
 	}
 
+	// Create zone journal table
+	_, err = m.db.Exec(`
+		CREATE TABLE IF NOT EXISTS zone_journal (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			zone VARCHAR(255) NOT NULL,
+			serial_from INT UNSIGNED NOT NULL,
+			serial_to INT UNSIGNED NOT NULL,
+			removed MEDIUMTEXT NOT NULL,
+			added MEDIUMTEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			INDEX (zone, id),
+			FOREIGN KEY (zone) REFERENCES zones(name) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create zone_journal table: %w", err)
+	}
+
+	// Create NOTIFY status table
+	_, err = m.db.Exec(`
+		CREATE TABLE IF NOT EXISTS notify_status (
+			zone VARCHAR(255) NOT NULL,
+			target VARCHAR(255) NOT NULL,
+			serial INT UNSIGNED NOT NULL,
+			state VARCHAR(16) NOT NULL,
+			attempts INT NOT NULL DEFAULT 0,
+			last_error TEXT,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			PRIMARY KEY (zone, target),
+			FOREIGN KEY (zone) REFERENCES zones(name) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create notify_status table: %w", err)
+	}
+
+	// Create DNSSEC keys table
+	_, err = m.db.Exec(`
+		CREATE TABLE IF NOT EXISTS dnssec_keys (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			zone VARCHAR(255) NOT NULL,
+			role VARCHAR(8) NOT NULL,
+			state VARCHAR(16) NOT NULL DEFAULT 'active',
+			algorithm TINYINT UNSIGNED NOT NULL,
+			flags SMALLINT UNSIGNED NOT NULL,
+			key_tag SMALLINT UNSIGNED NOT NULL,
+			public_key TEXT NOT NULL,
+			private_key TEXT NOT NULL,
+			published_at TIMESTAMP NULL,
+			active_at TIMESTAMP NULL,
+			retire_at TIMESTAMP NULL,
+			remove_at TIMESTAMP NULL,
+			ds_seen_at TIMESTAMP NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			INDEX (zone),
+			FOREIGN KEY (zone) REFERENCES zones(name) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create dnssec_keys table: %w", err)
+	}
+
+	// Create TSIG keys table
+	_, err = m.db.Exec(`
+		CREATE TABLE IF NOT EXISTS tsig_keys (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL UNIQUE,
+			algorithm VARCHAR(32) NOT NULL,
+			secret TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create tsig_keys table: %w", err)
+	}
+
+	// Add columns introduced after the tables were first created
+	migrations := []string{
+		"ALTER TABLE zones ADD COLUMN IF NOT EXISTS kind VARCHAR(16) NOT NULL DEFAULT 'primary' AFTER name",
+		"ALTER TABLE zones ADD COLUMN IF NOT EXISTS primaries TEXT AFTER kind",
+		"ALTER TABLE zones ADD COLUMN IF NOT EXISTS allow_transfer TEXT AFTER primaries",
+		"ALTER TABLE zones ADD COLUMN IF NOT EXISTS also_notify TEXT AFTER allow_transfer",
+		"ALTER TABLE zones ADD COLUMN IF NOT EXISTS denial VARCHAR(8) NOT NULL DEFAULT 'nsec' AFTER also_notify",
+		"ALTER TABLE zones ADD COLUMN IF NOT EXISTS nsec3_salt VARCHAR(64) NOT NULL DEFAULT '' AFTER denial",
+		"ALTER TABLE zones ADD COLUMN IF NOT EXISTS nsec3_iterations SMALLINT UNSIGNED NOT NULL DEFAULT 0 AFTER nsec3_salt",
+		"ALTER TABLE zones ADD COLUMN IF NOT EXISTS nsec3_opt_out BOOLEAN NOT NULL DEFAULT FALSE AFTER nsec3_iterations",
+		"ALTER TABLE zones ADD COLUMN IF NOT EXISTS allow_update TEXT AFTER allow_transfer",
+		"ALTER TABLE zones ADD COLUMN IF NOT EXISTS tsig_policy TEXT AFTER also_notify",
+		"ALTER TABLE zones ADD COLUMN IF NOT EXISTS transfer_key VARCHAR(255) NOT NULL DEFAULT '' AFTER tsig_policy",
+		"ALTER TABLE zones ADD COLUMN IF NOT EXISTS refreshed_at TIMESTAMP NULL AFTER nsec3_opt_out",
+		"ALTER TABLE dnssec_keys ADD COLUMN IF NOT EXISTS state VARCHAR(16) NOT NULL DEFAULT 'active' AFTER role",
+		"ALTER TABLE dnssec_keys ADD COLUMN IF NOT EXISTS published_at TIMESTAMP NULL AFTER private_key",
+		"ALTER TABLE dnssec_keys ADD COLUMN IF NOT EXISTS active_at TIMESTAMP NULL AFTER published_at",
+		"ALTER TABLE dnssec_keys ADD COLUMN IF NOT EXISTS retire_at TIMESTAMP NULL AFTER active_at",
+		"ALTER TABLE dnssec_keys ADD COLUMN IF NOT EXISTS remove_at TIMESTAMP NULL AFTER retire_at",
+		"ALTER TABLE dnssec_keys ADD COLUMN IF NOT EXISTS ds_seen_at TIMESTAMP NULL AFTER remove_at",
+	}
+	for _, migration := range migrations {
+		if _, err := m.db.Exec(migration); err != nil {
+			return fmt.Errorf("failed to migrate schema: %w", err)
+		}
+	}
+
 	return nil
 }
 
-// GetZone retrieves a zone by name
-func (m *MariaDBClient) GetZone(name string) (*models.Zone, error) {
+// zoneColumns are the columns selected by scanZone
+const zoneColumns = "id, name, kind, primaries, allow_transfer, allow_update, also_notify, tsig_policy, transfer_key, " +
+	"denial, nsec3_salt, nsec3_iterations, nsec3_opt_out, refreshed_at, created_at, updated_at"
+
+// zoneSettingsSet is the SET clause written by zoneSettings
+const zoneSettingsSet = "kind = ?, primaries = ?, allow_transfer = ?, allow_update = ?, also_notify = ?, tsig_policy = ?, transfer_key = ?, " +
+	"denial = ?, nsec3_salt = ?, nsec3_iterations = ?, nsec3_opt_out = ?"
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanZone scans a row selected with zoneColumns
+func scanZone(row rowScanner) (*models.Zone, error) {
 	var zone models.Zone
-	err := m.db.QueryRow("SELECT id, name, created_at, updated_at FROM zones WHERE name = ?", name).Scan(
-		&zone.ID, &zone.Name, &zone.CreatedAt, &zone.UpdatedAt,
+	var primaries, allowTransfer, allowUpdate, alsoNotify, tsigPolicy sql.NullString
+	var refreshedAt sql.NullTime
+	err := row.Scan(
+		&zone.ID, &zone.Name, &zone.Kind, &primaries, &allowTransfer, &allowUpdate, &alsoNotify, &tsigPolicy, &zone.TransferKey,
+		&zone.Denial, &zone.NSEC3Salt, &zone.NSEC3Iterations, &zone.NSEC3OptOut, &refreshedAt,
+		&zone.CreatedAt, &zone.UpdatedAt,
 	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unmarshalList(primaries, &zone.Primaries); err != nil {
+		return nil, fmt.Errorf("failed to parse primaries of zone %s: %w", zone.Name, err)
+	}
+	if err := unmarshalList(allowTransfer, &zone.AllowTransfer); err != nil {
+		return nil, fmt.Errorf("failed to parse allow_transfer of zone %s: %w", zone.Name, err)
+	}
+	if err := unmarshalList(allowUpdate, &zone.AllowUpdate); err != nil {
+		return nil, fmt.Errorf("failed to parse allow_update of zone %s: %w", zone.Name, err)
+	}
+	if err := unmarshalList(alsoNotify, &zone.AlsoNotify); err != nil {
+		return nil, fmt.Errorf("failed to parse also_notify of zone %s: %w", zone.Name, err)
+	}
+	zone.TSIGPolicy = []models.TSIGGrant{}
+	if tsigPolicy.Valid && tsigPolicy.String != "" {
+		if err := json.Unmarshal([]byte(tsigPolicy.String), &zone.TSIGPolicy); err != nil {
+			return nil, fmt.Errorf("failed to parse tsig_policy of zone %s: %w", zone.Name, err)
+		}
+	}
+	zone.RefreshedAt = nullTime(refreshedAt)
+
+	return &zone, nil
+}
+
+// zoneSettings returns the values for zoneSettingsSet
+func zoneSettings(zone *models.Zone) ([]interface{}, error) {
+	if zone.Kind == "" {
+		zone.Kind = models.ZonePrimary
+	}
+	if zone.Denial == "" {
+		zone.Denial = models.DenialNSEC
+	}
+	primaries, err := marshalList(zone.Primaries)
+	if err != nil {
+		return nil, err
+	}
+	allowTransfer, err := marshalList(zone.AllowTransfer)
+	if err != nil {
+		return nil, err
+	}
+	allowUpdate, err := marshalList(zone.AllowUpdate)
+	if err != nil {
+		return nil, err
+	}
+	alsoNotify, err := marshalList(zone.AlsoNotify)
+	if err != nil {
+		return nil, err
+	}
+	if zone.TSIGPolicy == nil {
+		zone.TSIGPolicy = []models.TSIGGrant{}
+	}
+	tsigPolicy, err := json.Marshal(zone.TSIGPolicy)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{
+		zone.Kind, primaries, allowTransfer, allowUpdate, alsoNotify, string(tsigPolicy), zone.TransferKey,
+		zone.Denial, zone.NSEC3Salt, zone.NSEC3Iterations, zone.NSEC3OptOut,
+	}, nil
+}
+
+// marshalList encodes a list setting for storage in a TEXT column
+func marshalList(list []string) (string, error) {
+	if list == nil {
+		list = []string{}
+	}
+	data, err := json.Marshal(list)
+	return string(data), err
+}
+
+// unmarshalList decodes a list setting stored by marshalList
+func unmarshalList(data sql.NullString, list *[]string) error {
+	if !data.Valid || data.String == "" {
+		*list = []string{}
+		return nil
+	}
+	return json.Unmarshal([]byte(data.String), list)
+}
+
+// GetZone retrieves a zone by name
+func (m *MariaDBClient) GetZone(name string) (*models.Zone, error) {
+	zone, err := scanZone(m.db.QueryRow("SELECT "+zoneColumns+" FROM zones WHERE name = ?", name))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil // Zone not found
@@ -103,27 +322,42 @@ func (m *MariaDBClient) GetZone(name string) (*models.Zone, error) {
 		return nil, err
 	}
 
-	return &zone, nil
+	return zone, nil
 }
 
 // CreateZone creates a new zone
-func (m *MariaDBClient) CreateZone(name string) (*models.Zone, error) {
-	result, err := m.db.Exec("INSERT INTO zones (name) VALUES (?)", name)
+func (m *MariaDBClient) CreateZone(zone *models.Zone) error {
+	settings, err := zoneSettings(zone)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	args := append([]interface{}{zone.Name}, settings...)
+	result, err := m.db.Exec("INSERT INTO zones SET name = ?, "+zoneSettingsSet, args...)
+	if err != nil {
+		return err
 	}
 
 	id, err := result.LastInsertId()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &models.Zone{
-		ID:        id,
-		Name:      name,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-	}, nil
+	zone.ID = id
+	zone.CreatedAt = time.Now()
+	zone.UpdatedAt = time.Now()
+	return nil
+}
+
+// UpdateZone updates the settings of an existing zone
+func (m *MariaDBClient) UpdateZone(zone *models.Zone) error {
+	settings, err := zoneSettings(zone)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.db.Exec("UPDATE zones SET "+zoneSettingsSet+" WHERE id = ?", append(settings, zone.ID)...)
+	return err
 }
 
 // DeleteZone deletes a zone and all its records
@@ -183,6 +417,60 @@ func (m *MariaDBClient) GetRecordsByNameAndType(zone, name string, recordType mo
 	return records, nil
 }
 
+// NameExists reports whether a name exists in a zone, either because it owns
+// records of any type or because names below it do (an empty non-terminal)
+func (m *MariaDBClient) NameExists(zone, name string) (bool, error) {
+	var exists bool
+	err := m.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM records WHERE zone = ? AND (name = ? OR name LIKE ?))",
+		zone, name, "%."+escapeLike(name),
+	).Scan(&exists)
+	return exists, err
+}
+
+// HasRecordsBelow reports whether any name below name owns records in a zone
+func (m *MariaDBClient) HasRecordsBelow(zone, name string) (bool, error) {
+	var exists bool
+	err := m.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM records WHERE zone = ? AND name LIKE ?)",
+		zone, "%."+escapeLike(name),
+	).Scan(&exists)
+	return exists, err
+}
+
+// MaxRecordTTL returns the longest TTL of the records in a zone, or 0 if it
+// has none
+func (m *MariaDBClient) MaxRecordTTL(zone string) (int, error) {
+	var ttl int
+	err := m.db.QueryRow("SELECT COALESCE(MAX(ttl), 0) FROM records WHERE zone = ?", zone).Scan(&ttl)
+	return ttl, err
+}
+
+// GetRecordTypesByName returns the types of the records a name owns in a zone
+func (m *MariaDBClient) GetRecordTypesByName(zone, name string) ([]models.RecordType, error) {
+	rows, err := m.db.Query("SELECT DISTINCT type FROM records WHERE zone = ? AND name = ?", zone, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var types []models.RecordType
+	for rows.Next() {
+		var recordType models.RecordType
+		if err := rows.Scan(&recordType); err != nil {
+			return nil, err
+		}
+		types = append(types, recordType)
+	}
+
+	return types, rows.Err()
+}
+
+// escapeLike escapes the LIKE wildcards in s, underscores being common in DNS names
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
 // GetRecordsByZone retrieves all records for a specific zone
 func (m *MariaDBClient) GetRecordsByZone(zone string) ([]models.Record, error) {
 	rows, err := m.db.Query(
@@ -270,7 +558,7 @@ func (m *MariaDBClient) DeleteRecord(id int64) error {
 
 // GetAllZones retrieves all zones from the database
 func (m *MariaDBClient) GetAllZones() ([]models.Zone, error) {
-	rows, err := m.db.Query("SELECT id, name, created_at, updated_at FROM zones")
+	rows, err := m.db.Query("SELECT " + zoneColumns + " FROM zones")
 	if err != nil {
 		return nil, err
 	}
@@ -278,14 +566,11 @@ func (m *MariaDBClient) GetAllZones() ([]models.Zone, error) {
 
 	var zones []models.Zone
 	for rows.Next() {
-		var zone models.Zone
-		err := rows.Scan(
-			&zone.ID, &zone.Name, &zone.CreatedAt, &zone.UpdatedAt,
-		)
+		zone, err := scanZone(rows)
 		if err != nil {
 			return nil, err
 		}
-		zones = append(zones, zone)
+		zones = append(zones, *zone)
 	}
 
 	if err = rows.Err(); err != nil {
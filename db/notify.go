@@ -0,0 +1,52 @@
+package db
+
+import (
+	"database/sql"
+
+	"github.com/PooriaJ/RediDNS/models"
+)
+
+// SetNotifyStatus stores the result of the latest NOTIFY sent to a target
+func (m *MariaDBClient) SetNotifyStatus(status *models.NotifyStatus) error {
+	_, err := m.db.Exec(`
+		INSERT INTO notify_status (zone, target, serial, state, attempts, last_error)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE serial = VALUES(serial), state = VALUES(state),
+			attempts = VALUES(attempts), last_error = VALUES(last_error)`,
+		status.Zone, status.Target, status.Serial, status.State, status.Attempts, status.LastError,
+	)
+	return err
+}
+
+// GetNotifyStatuses retrieves the NOTIFY results of all targets of a zone
+func (m *MariaDBClient) GetNotifyStatuses(zone string) ([]models.NotifyStatus, error) {
+	rows, err := m.db.Query(
+		"SELECT zone, target, serial, state, attempts, last_error, updated_at FROM notify_status WHERE zone = ? ORDER BY target",
+		zone,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var statuses []models.NotifyStatus
+	for rows.Next() {
+		var status models.NotifyStatus
+		var lastError sql.NullString
+		err := rows.Scan(
+			&status.Zone, &status.Target, &status.Serial, &status.State,
+			&status.Attempts, &lastError, &status.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		status.LastError = lastError.String
+		statuses = append(statuses, status)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return statuses, nil
+}
@@ -129,6 +129,116 @@ func (r *RedisClient) DeleteRecord(ctx context.Context, zone, name string, recor
 	return r.client.Del(ctx, key).Err()
 }
 
+// GetSignatures retrieves the cached RRSIGs of an RRset
+func (r *RedisClient) GetSignatures(ctx context.Context, zone, name string, recordType models.RecordType) (*models.SignatureSet, error) {
+	key := fmt.Sprintf("dns:rrsig:%s:%s:%s", zone, name, recordType)
+	data, err := r.client.Get(ctx, key).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil // Signatures not found in cache
+		}
+		return nil, err
+	}
+
+	var sigs models.SignatureSet
+	err = json.Unmarshal(data, &sigs)
+	return &sigs, err
+}
+
+// SetSignatures stores the RRSIGs of an RRset in Redis cache. Signatures
+// expire, so they are always cached with the given TTL.
+func (r *RedisClient) SetSignatures(ctx context.Context, sigs *models.SignatureSet, ttl time.Duration) error {
+	key := fmt.Sprintf("dns:rrsig:%s:%s:%s", sigs.Zone, sigs.Name, sigs.Type)
+	data, err := json.Marshal(sigs)
+	if err != nil {
+		return err
+	}
+
+	return r.client.Set(ctx, key, data, ttl).Err()
+}
+
+// GetWildcardRecords retrieves the wildcard records cached as the answer
+// for a name that has no records of its own
+func (r *RedisClient) GetWildcardRecords(ctx context.Context, zone, name string, recordType models.RecordType) ([]models.Record, error) {
+	key := fmt.Sprintf("dns:wildcard:%s:%s:%s", zone, name, recordType)
+	data, err := r.client.Get(ctx, key).Bytes()
+	if err != nil {
+		return nil, nil // Answer not found in cache or error
+	}
+
+	var records []models.Record
+	err = json.Unmarshal(data, &records)
+	return records, err
+}
+
+// SetWildcardRecords caches the wildcard records answering a name
+func (r *RedisClient) SetWildcardRecords(ctx context.Context, zone, name string, records []models.Record, ttl time.Duration) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	key := fmt.Sprintf("dns:wildcard:%s:%s:%s", zone, name, records[0].Type)
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	return r.client.Set(ctx, key, data, ttl).Err()
+}
+
+// GetAliasAnswer retrieves the cached addresses of an ALIAS target
+func (r *RedisClient) GetAliasAnswer(ctx context.Context, target string, recordType models.RecordType) (*models.AliasAnswer, error) {
+	key := fmt.Sprintf("dns:alias:%s:%s", target, recordType)
+	data, err := r.client.Get(ctx, key).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil // Target not resolved recently
+		}
+		return nil, err
+	}
+
+	var answer models.AliasAnswer
+	err = json.Unmarshal(data, &answer)
+	return &answer, err
+}
+
+// SetAliasAnswer caches the addresses of an ALIAS target for as long as
+// they may be served
+func (r *RedisClient) SetAliasAnswer(ctx context.Context, answer *models.AliasAnswer, ttl time.Duration) error {
+	key := fmt.Sprintf("dns:alias:%s:%s", answer.Target, answer.Type)
+	data, err := json.Marshal(answer)
+	if err != nil {
+		return err
+	}
+
+	return r.client.Set(ctx, key, data, ttl).Err()
+}
+
+// InvalidateWildcards removes the cached wildcard answers of a zone. Any
+// record change can affect them, as new names stop wildcards from matching.
+func (r *RedisClient) InvalidateWildcards(ctx context.Context, zone string) error {
+	return r.deleteMatching(ctx, fmt.Sprintf("dns:wildcard:%s:*", zone))
+}
+
+// InvalidateZone removes all cached records and signatures of a zone
+func (r *RedisClient) InvalidateZone(ctx context.Context, zone string) error {
+	for _, pattern := range []string{"dns:record:%s:*", "dns:records:%s:*", "dns:wildcard:%s:*", "dns:rrsig:%s:*"} {
+		if err := r.deleteMatching(ctx, fmt.Sprintf(pattern, zone)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteMatching removes all keys matching a pattern
+func (r *RedisClient) deleteMatching(ctx context.Context, pattern string) error {
+	keys, err := r.client.Keys(ctx, pattern).Result()
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	return r.client.Del(ctx, keys...).Err()
+}
+
 // GetRecordsByZone retrieves all records for a specific zone
 func (r *RedisClient) GetRecordsByZone(ctx context.Context, zone string) ([]models.Record, error) {
 	pattern := fmt.Sprintf("dns:record:%s:*", zone)
@@ -170,6 +280,41 @@ func (r *RedisClient) SubscribeToRecordUpdates(ctx context.Context) *redis.PubSu
 	return r.client.Subscribe(ctx, "dns:record:update")
 }
 
+// PublishZoneUpdate publishes a zone serial change event
+func (r *RedisClient) PublishZoneUpdate(ctx context.Context, update *models.ZoneUpdate) error {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+
+	return r.client.Publish(ctx, "dns:zone:update", data).Err()
+}
+
+// SubscribeToZoneUpdates subscribes to zone serial change events
+func (r *RedisClient) SubscribeToZoneUpdates(ctx context.Context) *redis.PubSub {
+	return r.client.Subscribe(ctx, "dns:zone:update")
+}
+
+// PublishTSIGKeysUpdate announces a change of the TSIG keys
+func (r *RedisClient) PublishTSIGKeysUpdate(ctx context.Context) error {
+	return r.client.Publish(ctx, "dns:tsig:update", "").Err()
+}
+
+// SubscribeToTSIGKeysUpdates subscribes to TSIG key change events
+func (r *RedisClient) SubscribeToTSIGKeysUpdates(ctx context.Context) *redis.PubSub {
+	return r.client.Subscribe(ctx, "dns:tsig:update")
+}
+
+// PublishDNSSECKeysUpdate announces a change of the DNSSEC keys of a zone
+func (r *RedisClient) PublishDNSSECKeysUpdate(ctx context.Context, zone string) error {
+	return r.client.Publish(ctx, "dns:dnssec:update", zone).Err()
+}
+
+// SubscribeToDNSSECKeysUpdates subscribes to DNSSEC key change events
+func (r *RedisClient) SubscribeToDNSSECKeysUpdates(ctx context.Context) *redis.PubSub {
+	return r.client.Subscribe(ctx, "dns:dnssec:update")
+}
+
 // Keys returns keys matching the pattern
 func (r *RedisClient) Keys(ctx context.Context, pattern string) ([]string, error) {
 	return r.client.Keys(ctx, pattern).Result()
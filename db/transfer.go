@@ -0,0 +1,114 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/PooriaJ/RediDNS/models"
+)
+
+// ReplaceZoneRecords replaces all records of a zone in one transaction, as
+// done after a full zone transfer. The zone's journal is cleared since it no
+// longer leads up to the new contents.
+func (m *MariaDBClient) ReplaceZoneRecords(zone string, records []models.Record) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM records WHERE zone = ?", zone); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM zone_journal WHERE zone = ?", zone); err != nil {
+		return err
+	}
+
+	for i := range records {
+		if err := insertRecord(tx, &records[i]); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ApplyZoneChanges applies the changes of an incremental zone transfer in
+// order and replaces the zone's SOA with soa, journaling each change. All of
+// it is written in one transaction, so the zone is never left between two
+// serials. Removed records are matched on name, type, content and priority.
+func (m *MariaDBClient) ApplyZoneChanges(zone string, soa *models.Record, changes []models.JournalEntry, keep int) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i := range changes {
+		if err := applyZoneChange(tx, zone, &changes[i], keep); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(
+		"UPDATE records SET content = ?, ttl = ? WHERE zone = ? AND name = ? AND type = ?",
+		soa.Content, soa.TTL, zone, soa.Name, models.TypeSOA,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// applyZoneChange removes and adds the records of a single change within a
+// transaction and journals it
+func applyZoneChange(tx *sql.Tx, zone string, change *models.JournalEntry, keep int) error {
+	for _, record := range change.Removed {
+		_, err := tx.Exec(
+			"DELETE FROM records WHERE zone = ? AND name = ? AND type = ? AND content = ? AND priority = ? LIMIT 1",
+			zone, record.Name, record.Type, record.Content, record.Priority,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range change.Added {
+		if err := insertRecord(tx, &change.Added[i]); err != nil {
+			return err
+		}
+	}
+
+	if keep > 0 {
+		return insertJournalEntry(tx, zone, change.SerialFrom, change.SerialTo, change.Removed, change.Added, keep)
+	}
+	return nil
+}
+
+// SetZoneRefreshed records the time of the last successful refresh of a
+// secondary zone, which its expiry is counted from across restarts
+func (m *MariaDBClient) SetZoneRefreshed(zone string, at time.Time) error {
+	// Leave updated_at alone, it tracks changes to the zone's settings
+	_, err := m.db.Exec("UPDATE zones SET refreshed_at = ?, updated_at = updated_at WHERE name = ?", at, zone)
+	return err
+}
+
+// insertRecord inserts a record within a transaction
+func insertRecord(tx *sql.Tx, record *models.Record) error {
+	result, err := tx.Exec(
+		"INSERT INTO records (zone, name, type, content, ttl, priority) VALUES (?, ?, ?, ?, ?, ?)",
+		record.Zone, record.Name, record.Type, record.Content, record.TTL, record.Priority,
+	)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	record.ID = id
+	return nil
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"database/sql"
+
+	"github.com/PooriaJ/RediDNS/models"
+)
+
+// GetTSIGKeys retrieves all TSIG keys
+func (m *MariaDBClient) GetTSIGKeys() ([]models.TSIGKey, error) {
+	rows, err := m.db.Query("SELECT id, name, algorithm, secret, created_at FROM tsig_keys ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []models.TSIGKey
+	for rows.Next() {
+		var key models.TSIGKey
+		if err := rows.Scan(&key.ID, &key.Name, &key.Algorithm, &key.Secret, &key.CreatedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// GetTSIGKey retrieves a TSIG key by name
+func (m *MariaDBClient) GetTSIGKey(name string) (*models.TSIGKey, error) {
+	var key models.TSIGKey
+	err := m.db.QueryRow(
+		"SELECT id, name, algorithm, secret, created_at FROM tsig_keys WHERE name = ?",
+		name,
+	).Scan(&key.ID, &key.Name, &key.Algorithm, &key.Secret, &key.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Key not found
+		}
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// CreateTSIGKey stores a new TSIG key
+func (m *MariaDBClient) CreateTSIGKey(key *models.TSIGKey) error {
+	result, err := m.db.Exec(
+		"INSERT INTO tsig_keys (name, algorithm, secret) VALUES (?, ?, ?)",
+		key.Name, key.Algorithm, key.Secret,
+	)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	key.ID = id
+	return nil
+}
+
+// DeleteTSIGKey deletes a TSIG key by name
+func (m *MariaDBClient) DeleteTSIGKey(name string) error {
+	_, err := m.db.Exec("DELETE FROM tsig_keys WHERE name = ?", name)
+	return err
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/PooriaJ/RediDNS/models"
+)
+
+// ErrNoSOA is returned for changes to a zone without a SOA record, whose
+// serial can't be incremented
+var ErrNoSOA = errors.New("zone has no SOA record")
+
+// ErrSerialNotIncreased is returned for edits of a SOA record that move its
+// serial backwards, which secondaries would never pick up
+var ErrSerialNotIncreased = errors.New("SOA serial must increase")
+
+// UpdateZoneRecords changes the records of a zone in one transaction.
+// update is given the records of the zone while its SOA record is locked and
+// returns the records to remove, which must be taken from those given, and
+// the records to add. An added record with the ID of a removed one replaces
+// it in place, keeping its ID. If it changes anything the zone's serial is
+// incremented and the change journaled, keeping at most keep journal
+// entries. Replacing the SOA record itself sets the serial as in replaceSOA
+// instead, and the SOA record can't be removed. An error returned by update
+// aborts the transaction and is returned as is. It returns the updated SOA
+// record, or nil if nothing changed.
+func (m *MariaDBClient) UpdateZoneRecords(zone string, keep int, update func(records []models.Record) (removed, added []models.Record, err error)) (*models.Record, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	soa, err := lockSOA(tx, zone)
+	if err != nil {
+		return nil, err
+	}
+	if soa == nil {
+		return nil, fmt.Errorf("zone %s: %w", zone, ErrNoSOA)
+	}
+
+	rows, err := tx.Query(
+		"SELECT id, zone, name, type, content, ttl, priority, created_at, updated_at FROM records WHERE zone = ?",
+		zone,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var records []models.Record
+	for rows.Next() {
+		var record models.Record
+		err := rows.Scan(
+			&record.ID, &record.Zone, &record.Name, &record.Type, &record.Content,
+			&record.TTL, &record.Priority, &record.CreatedAt, &record.UpdatedAt,
+		)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	removed, added, err := update(records)
+	if err != nil {
+		return nil, err
+	}
+	if len(removed) == 0 && len(added) == 0 {
+		return nil, nil
+	}
+
+	deleted := make(map[int64]bool, len(removed))
+	for _, record := range removed {
+		deleted[record.ID] = true
+	}
+
+	// The SOA record frames the journaled changes rather than being one
+	var edited *models.Record
+	for i := range added {
+		if added[i].ID == soa.ID && deleted[soa.ID] {
+			edited = &added[i]
+		}
+	}
+	if deleted[soa.ID] && edited == nil {
+		return nil, fmt.Errorf("zone %s: the SOA record can't be removed", zone)
+	}
+	delete(deleted, soa.ID)
+	removed = withoutRecord(removed, soa.ID)
+
+	var inserted []*models.Record
+	for i := range added {
+		if &added[i] == edited {
+			continue
+		}
+		if added[i].ID != 0 && deleted[added[i].ID] {
+			if err := replaceRecord(tx, &added[i]); err != nil {
+				return nil, err
+			}
+			delete(deleted, added[i].ID)
+			continue
+		}
+		inserted = append(inserted, &added[i])
+	}
+	for id := range deleted {
+		if _, err := tx.Exec("DELETE FROM records WHERE id = ?", id); err != nil {
+			return nil, err
+		}
+	}
+	for _, record := range inserted {
+		if err := insertRecord(tx, record); err != nil {
+			return nil, err
+		}
+	}
+
+	var oldSerial, newSerial uint32
+	if edited != nil {
+		oldSerial, newSerial, err = replaceSOA(tx, soa, edited)
+		added = withoutRecord(added, soa.ID)
+	} else {
+		oldSerial, newSerial, err = incrementSerial(tx, soa)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if keep > 0 {
+		if err := insertJournalEntry(tx, zone, oldSerial, newSerial, removed, added, keep); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return soa, nil
+}
+
+// replaceRecord overwrites the record with the ID of record within a
+// transaction
+func replaceRecord(tx *sql.Tx, record *models.Record) error {
+	_, err := tx.Exec(
+		"UPDATE records SET name = ?, type = ?, content = ?, ttl = ?, priority = ? WHERE id = ?",
+		record.Name, record.Type, record.Content, record.TTL, record.Priority, record.ID,
+	)
+	return err
+}
+
+// withoutRecord returns the records other than the one with the given ID
+func withoutRecord(records []models.Record, id int64) []models.Record {
+	var result []models.Record
+	for _, record := range records {
+		if record.ID != id {
+			result = append(result, record)
+		}
+	}
+	return result
+}
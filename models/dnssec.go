@@ -0,0 +1,66 @@
+package models
+
+import (
+	"time"
+)
+
+// KeyRole is the role of a DNSSEC key in its zone
+type KeyRole string
+
+// DNSSEC key roles
+const (
+	KeyRoleKSK KeyRole = "ksk" // Key signing key, signs the DNSKEY RRset and is referenced by the DS
+	KeyRoleZSK KeyRole = "zsk" // Zone signing key, signs all other RRsets
+)
+
+// KeyState is the state of a DNSSEC key in its rollover timeline
+type KeyState string
+
+// DNSSEC key states
+const (
+	KeyPublished KeyState = "published" // In the DNSKEY RRset, not signing yet
+	KeyActive    KeyState = "active"    // In the DNSKEY RRset and signing
+	KeyRetired   KeyState = "retired"   // In the DNSKEY RRset until cached signatures expire, no longer signing
+	KeyRemoved   KeyState = "removed"   // Gone from the zone, kept for the record
+)
+
+// DNSSECKey is a signing key of a zone. The timestamps form the key's
+// timeline: when it was published, when it becomes active and when it is
+// retired and removed again, if scheduled.
+type DNSSECKey struct {
+	ID          int64      `json:"id" db:"id"`
+	Zone        string     `json:"zone" db:"zone"`
+	Role        KeyRole    `json:"role" db:"role"`
+	State       KeyState   `json:"state" db:"state"`
+	Algorithm   uint8      `json:"algorithm" db:"algorithm"`
+	Flags       uint16     `json:"flags" db:"flags"`
+	KeyTag      uint16     `json:"key_tag" db:"key_tag"`
+	PublicKey   string     `json:"public_key" db:"public_key"` // Base64 public key as in the DNSKEY record
+	PrivateKey  string     `json:"-" db:"private_key"`         // Private key in BIND private-key format
+	PublishedAt *time.Time `json:"published_at,omitempty" db:"published_at"`
+	ActiveAt    *time.Time `json:"active_at,omitempty" db:"active_at"`
+	RetireAt    *time.Time `json:"retire_at,omitempty" db:"retire_at"`
+	RemoveAt    *time.Time `json:"remove_at,omitempty" db:"remove_at"`
+	DSSeenAt    *time.Time `json:"ds_seen_at,omitempty" db:"ds_seen_at"` // When the parent was seen publishing the DS of a KSK
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
+// DSRecord is the delegation signer record of a key signing key, to be
+// published in the parent zone
+type DSRecord struct {
+	KeyTag     uint16 `json:"key_tag"`
+	Algorithm  uint8  `json:"algorithm"`
+	DigestType uint8  `json:"digest_type"`
+	Digest     string `json:"digest"`
+	Record     string `json:"record"` // The DS record in zone file format
+}
+
+// SignatureSet holds the cached RRSIGs of an RRset. Digest identifies the
+// RRset contents and signing keys the signatures were made for.
+type SignatureSet struct {
+	Zone   string     `json:"zone"`
+	Name   string     `json:"name"`
+	Type   RecordType `json:"type"`
+	Digest string     `json:"digest"`
+	RRSIGs []string   `json:"rrsigs"` // RRSIG records in zone file format
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+)
+
+// JournalEntry records the records removed from and added to a zone when its
+// SOA serial changed from SerialFrom to SerialTo. The journal is what IXFR
+// responses are built from.
+type JournalEntry struct {
+	ID         int64     `json:"id" db:"id"`
+	Zone       string    `json:"zone" db:"zone"`
+	SerialFrom uint32    `json:"serial_from" db:"serial_from"`
+	SerialTo   uint32    `json:"serial_to" db:"serial_to"`
+	Removed    []Record  `json:"removed" db:"removed"`
+	Added      []Record  `json:"added" db:"added"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+)
+
+// ZoneUpdate announces a new SOA serial of a zone
+type ZoneUpdate struct {
+	Zone   string `json:"zone"`
+	Serial uint32 `json:"serial"`
+}
+
+// NotifyState is the delivery state of a NOTIFY message
+type NotifyState string
+
+// NOTIFY delivery states
+const (
+	NotifyPending    NotifyState = "pending"    // Being sent or waiting for a retry
+	NotifySucceeded  NotifyState = "succeeded"  // Acknowledged by the target
+	NotifyFailed     NotifyState = "failed"     // Retries exhausted, or abandoned at shutdown
+	NotifySuperseded NotifyState = "superseded" // Abandoned for a NOTIFY of a newer serial
+)
+
+// NotifyStatus is the result of the latest NOTIFY sent to a target for a zone
+type NotifyStatus struct {
+	Zone      string      `json:"zone" db:"zone"`
+	Target    string      `json:"target" db:"target"`
+	Serial    uint32      `json:"serial" db:"serial"`
+	State     NotifyState `json:"state" db:"state"`
+	Attempts  int         `json:"attempts" db:"attempts"`
+	LastError string      `json:"last_error,omitempty" db:"last_error"`
+	UpdatedAt time.Time   `json:"updated_at" db:"updated_at"`
+}
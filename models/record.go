@@ -19,8 +19,32 @@ const (
 	TypeSRV   RecordType = "SRV"   // Service
 	TypeTXT   RecordType = "TXT"   // Text
 	TypeCAA   RecordType = "CAA"   // Certification Authority Authorization
+	TypeALIAS RecordType = "ALIAS" // Answers A and AAAA queries with the addresses of its target
+	TypeDNAME RecordType = "DNAME" // Redirects the names below it to another subtree
+	TypeDS    RecordType = "DS"    // Delegation signer of a child zone
+	TypeSVCB  RecordType = "SVCB"  // Service binding
+	TypeHTTPS RecordType = "HTTPS" // Service binding for HTTPS origins
+	TypeTLSA  RecordType = "TLSA"  // TLS certificate association (DANE)
+	TypeSSHFP RecordType = "SSHFP" // SSH host key fingerprint
+	TypeNAPTR RecordType = "NAPTR" // Naming authority pointer
+	TypeLOC   RecordType = "LOC"   // Geographical location
+	TypeURI   RecordType = "URI"   // Uniform resource identifier
 )
 
+// builtinTypes have a content format of their own
+var builtinTypes = map[RecordType]bool{
+	TypeA: true, TypeAAAA: true, TypeCNAME: true, TypeMX: true, TypeNS: true, TypePTR: true,
+	TypeSOA: true, TypeSRV: true, TypeTXT: true, TypeCAA: true, TypeALIAS: true, TypeDNAME: true,
+	TypeDS: true, TypeSVCB: true, TypeHTTPS: true, TypeTLSA: true, TypeSSHFP: true, TypeNAPTR: true,
+	TypeLOC: true, TypeURI: true,
+}
+
+// IsGeneric reports whether records of the type store their RDATA in
+// presentation format (RFC 3597) rather than in a format of their own
+func (t RecordType) IsGeneric() bool {
+	return !builtinTypes[t]
+}
+
 // Record represents a DNS record
 type Record struct {
 	ID        int64      `json:"id" db:"id"`
@@ -69,15 +93,103 @@ type CAARecord struct {
 	Value string `json:"value"` // Value
 }
 
+// SVCBRecord represents a Service Binding record, also used for HTTPS records
+type SVCBRecord struct {
+	Priority uint16            `json:"priority"` // 0 makes the record an alias for the target
+	Target   string            `json:"target"`   // Target hostname, "." for the owner name itself
+	Params   map[string]string `json:"params"`   // Service parameters such as alpn, port and ech by key
+}
+
+// TLSARecord represents a TLS certificate association record
+type TLSARecord struct {
+	Usage        uint8  `json:"usage"`         // Certificate usage
+	Selector     uint8  `json:"selector"`      // Whole certificate or public key
+	MatchingType uint8  `json:"matching_type"` // Exact match, SHA-256 or SHA-512
+	Certificate  string `json:"certificate"`   // Certificate association data in hex
+}
+
+// SSHFPRecord represents an SSH host key fingerprint record
+type SSHFPRecord struct {
+	Algorithm   uint8  `json:"algorithm"`   // Host key algorithm
+	Type        uint8  `json:"type"`        // Fingerprint type, 1 for SHA-1 and 2 for SHA-256
+	Fingerprint string `json:"fingerprint"` // Fingerprint in hex
+}
+
+// NAPTRRecord represents a Naming Authority Pointer record
+type NAPTRRecord struct {
+	Order       uint16 `json:"order"`       // Order value
+	Preference  uint16 `json:"preference"`  // Preference value
+	Flags       string `json:"flags"`       // Flags
+	Service     string `json:"service"`     // Service parameters
+	Regexp      string `json:"regexp"`      // Substitution expression
+	Replacement string `json:"replacement"` // Replacement hostname, "." when regexp is used
+}
+
+// LOCRecord represents a Location record. The size and precisions default
+// to 1, 10000 and 10 meters when omitted (RFC 1876 section 3).
+type LOCRecord struct {
+	Latitude  float64  `json:"latitude"`            // Degrees, negative south of the equator
+	Longitude float64  `json:"longitude"`           // Degrees, negative west of the prime meridian
+	Altitude  float64  `json:"altitude"`            // Meters above the WGS 84 reference spheroid
+	Size      *float64 `json:"size,omitempty"`      // Diameter of the located sphere in meters
+	HorizPre  *float64 `json:"horiz_pre,omitempty"` // Horizontal precision in meters
+	VertPre   *float64 `json:"vert_pre,omitempty"`  // Vertical precision in meters
+}
+
+// URIRecord represents a Uniform Resource Identifier record
+type URIRecord struct {
+	Priority uint16 `json:"priority"` // Priority value
+	Weight   uint16 `json:"weight"`   // Weight value
+	Target   string `json:"target"`   // Target URI
+}
+
+// AliasAnswer is the resolved addresses of an ALIAS target for one type
+type AliasAnswer struct {
+	Target    string     `json:"target"`
+	Type      RecordType `json:"type"` // A or AAAA
+	Addresses []string   `json:"addresses"`
+	TTL       uint32     `json:"ttl"` // Bounded by the configured maximum
+}
+
 // RecordSet represents a collection of DNS records
 type RecordSet struct {
 	Records []Record `json:"records"`
 }
 
+// ZoneKind is the role of the server for a zone
+type ZoneKind string
+
+// Zone kinds
+const (
+	ZonePrimary   ZoneKind = "primary"   // Records are managed through the API
+	ZoneSecondary ZoneKind = "secondary" // Records are transferred from the primaries
+)
+
+// DenialMode is how a signed zone proves that names and types do not exist
+type DenialMode string
+
+// Denial of existence modes
+const (
+	DenialNSEC  DenialMode = "nsec"  // NSEC records (RFC 4034)
+	DenialNSEC3 DenialMode = "nsec3" // Hashed NSEC3 records (RFC 5155)
+)
+
 // Zone represents a DNS zone
 type Zone struct {
-	ID        int64     `json:"id" db:"id"`
-	Name      string    `json:"name" db:"name"`
-	CreatedAt time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	ID              int64       `json:"id" db:"id"`
+	Name            string      `json:"name" db:"name"`
+	Kind            ZoneKind    `json:"kind" db:"kind"`
+	Primaries       []string    `json:"primaries" db:"primaries"`           // Servers a secondary zone is transferred from
+	AllowTransfer   []string    `json:"allow_transfer" db:"allow_transfer"` // IPs and CIDRs allowed to AXFR the zone
+	AllowUpdate     []string    `json:"allow_update" db:"allow_update"`     // IPs and CIDRs allowed to send dynamic updates
+	AlsoNotify      []string    `json:"also_notify" db:"also_notify"`       // Secondaries sent a NOTIFY when the zone changes
+	TSIGPolicy      []TSIGGrant `json:"tsig_policy" db:"tsig_policy"`       // Keys requests must be signed with, by operation
+	TransferKey     string      `json:"transfer_key" db:"transfer_key"`     // Key our SOA queries, transfers and NOTIFYs are signed with
+	Denial          DenialMode  `json:"denial" db:"denial"`                 // Denial of existence used once the zone is signed
+	NSEC3Salt       string      `json:"nsec3_salt" db:"nsec3_salt"`         // Hex salt, empty for none
+	NSEC3Iterations uint16      `json:"nsec3_iterations" db:"nsec3_iterations"`
+	NSEC3OptOut     bool        `json:"nsec3_opt_out" db:"nsec3_opt_out"`         // Leave insecure delegations out of the NSEC3 chain
+	RefreshedAt     *time.Time  `json:"refreshed_at,omitempty" db:"refreshed_at"` // Last successful refresh of a secondary zone
+	CreatedAt       time.Time   `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at" db:"updated_at"`
 }
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"time"
+)
+
+// TSIG algorithms, named as in the TSIG record without the trailing dot
+const (
+	TSIGHmacSHA256 = "hmac-sha256"
+	TSIGHmacSHA512 = "hmac-sha512"
+)
+
+// TSIGKey is a shared secret clients sign their requests with (RFC 8945)
+type TSIGKey struct {
+	ID        int64     `json:"id" db:"id"`
+	Name      string    `json:"name" db:"name"` // Key name without the trailing dot
+	Algorithm string    `json:"algorithm" db:"algorithm"`
+	Secret    string    `json:"-" db:"secret"` // Base64 secret, only returned when the key is created
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// CreatedTSIGKey is a newly created TSIG key as returned by the API, the
+// only time its secret is shown
+type CreatedTSIGKey struct {
+	TSIGKey
+	Secret string `json:"secret"`
+}
+
+// TSIGOperation is a request a TSIG key can be allowed to make for a zone
+type TSIGOperation string
+
+// TSIG operations
+const (
+	TSIGAXFR   TSIGOperation = "axfr"   // Full zone transfers
+	TSIGIXFR   TSIGOperation = "ixfr"   // Incremental zone transfers
+	TSIGUpdate TSIGOperation = "update" // Dynamic updates
+	TSIGNotify TSIGOperation = "notify" // NOTIFY messages to a secondary zone
+)
+
+// TSIGGrant allows requests signed with a key to make operations for a zone
+type TSIGGrant struct {
+	Key        string          `json:"key"`
+	Operations []TSIGOperation `json:"operations"`
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"github.com/PooriaJ/RediDNS/models"
+	"github.com/miekg/dns"
+)
+
+// addAdditional adds the addresses of the MX, SRV and NS targets in the
+// answer to the additional section when they are in zones we host, saving
+// clients a lookup (RFC 1035 section 3.3.9, RFC 2782). An address RRset is
+// only added while the response stays within size bytes: leaving it out
+// costs the client a lookup, truncating the response a retry over TCP.
+func (h *DNSHandler) addAdditional(m *dns.Msg, size int, dnssecOK bool) {
+	if h.cfg.DNS.MinimalResponses {
+		return
+	}
+
+	// RRsets already in the response are not repeated
+	seen := make(map[string]bool)
+	for _, section := range [][]dns.RR{m.Answer, m.Extra} {
+		for _, rr := range section {
+			seen[rrsetKey(rr.Header().Name, rr.Header().Rrtype)] = true
+		}
+	}
+
+	for _, target := range additionalTargets(m.Answer) {
+		name := normalizeName(target)
+		zone, err := h.findZone(name)
+		if err != nil {
+			h.logger.Warnf("Failed to find zone of additional target %s: %v", name, err)
+			continue
+		}
+		if zone == "" || h.secondaries.isExpired(zone) {
+			continue
+		}
+
+		// Below a zone cut the addresses belong to the child
+		cut, _, err := h.lookupCut(zone, name)
+		if err != nil || cut != "" {
+			continue
+		}
+
+		var keys []signingKey
+		if dnssecOK {
+			if keys, err = h.zoneKeys(zone); err != nil {
+				h.logger.Warnf("Failed to get DNSSEC keys of zone %s: %v", zone, err)
+				continue
+			}
+		}
+
+		for _, recordType := range []models.RecordType{models.TypeA, models.TypeAAAA} {
+			key := rrsetKey(target, dns.StringToType[string(recordType)])
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			rrset, err := h.additionalRRset(zone, name, recordType, keys)
+			if err != nil {
+				h.logger.Warnf("Failed to add additional %s records of %s: %v", recordType, name, err)
+				continue
+			}
+			if len(rrset) == 0 {
+				continue
+			}
+
+			extra := m.Extra
+			m.Extra = append(m.Extra, rrset...)
+			if m.Len() > size {
+				m.Extra = extra
+			}
+		}
+	}
+}
+
+// additionalRRset returns the records of a type at a name in zone as an
+// RRset, with its signatures if keys are given
+func (h *DNSHandler) additionalRRset(zone, name string, recordType models.RecordType, keys []signingKey) ([]dns.RR, error) {
+	records, err := h.lookupRecords(zone, name, recordType)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+
+	var rrset []dns.RR
+	for _, record := range records {
+		rr, err := recordToRR(&record, dns.Fqdn(name))
+		if err != nil {
+			return nil, err
+		}
+		rrset = append(rrset, rr)
+	}
+
+	if len(keys) == 0 {
+		return rrset, nil
+	}
+	return h.signSection(rrset, zone, keys, nil)
+}
+
+// additionalTargets returns the host names the MX, SRV and NS records of a
+// section point to, in order and without duplicates
+func additionalTargets(section []dns.RR) []string {
+	var targets []string
+	seen := make(map[string]bool)
+	for _, rr := range section {
+		var target string
+		switch rr := rr.(type) {
+		case *dns.MX:
+			target = rr.Mx
+		case *dns.SRV:
+			target = rr.Target
+		case *dns.NS:
+			target = rr.Ns
+		default:
+			continue
+		}
+
+		// A target of "." means the service is not available
+		name := normalizeName(target)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// rrsetKey identifies an RRset by its owner and type
+func rrsetKey(name string, rrtype uint16) string {
+	return dns.CanonicalName(name) + " " + dns.Type(rrtype).String()
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/PooriaJ/RediDNS/models"
+	"github.com/PooriaJ/RediDNS/util"
+	"github.com/miekg/dns"
+)
+
+// aliasRecords returns A or AAAA records synthesized from the ALIAS record
+// of a name, owned by the name. They are served with the lowest of the TTLs
+// of the ALIAS record, the target's records and the configured maximum.
+func (h *DNSHandler) aliasRecords(zone, name string, recordType models.RecordType) ([]models.Record, error) {
+	aliases, err := h.lookupRecords(zone, name, models.TypeALIAS)
+	if err != nil || len(aliases) == 0 {
+		return nil, err
+	}
+	alias := aliases[0]
+
+	answer, err := h.resolveAlias(alias.Content, recordType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve ALIAS target %s of %s: %w", alias.Content, name, err)
+	}
+
+	ttl := int(answer.TTL)
+	if alias.TTL < ttl {
+		ttl = alias.TTL
+	}
+
+	var records []models.Record
+	for _, address := range answer.Addresses {
+		records = append(records, models.Record{
+			Zone:    alias.Zone,
+			Name:    alias.Name,
+			Type:    recordType,
+			Content: address,
+			TTL:     ttl,
+		})
+	}
+	return records, nil
+}
+
+// aliasMaxTTL returns the upper bound of the TTL of synthesized records
+func (h *DNSHandler) aliasMaxTTL() uint32 {
+	if h.cfg.DNS.Alias.MaxTTL <= 0 {
+		return 300
+	}
+	return uint32(h.cfg.DNS.Alias.MaxTTL)
+}
+
+// resolveAlias returns the addresses of an ALIAS target, from the cache if
+// they were resolved recently. Targets in our zones are resolved from our
+// own data, following CNAMEs and ALIAS records up to maxCNAMEChain deep;
+// everything else is asked of the upstream resolvers.
+func (h *DNSHandler) resolveAlias(target string, recordType models.RecordType) (*models.AliasAnswer, error) {
+	ctx := context.Background()
+	name := normalizeName(target)
+
+	cached, err := h.redisClient.GetAliasAnswer(ctx, name, recordType)
+	if err == nil && cached != nil {
+		atomic.AddInt64(&h.stats.CacheHits, 1)
+		return cached, nil
+	}
+
+	answer := &models.AliasAnswer{Target: name, Type: recordType, TTL: h.aliasMaxTTL()}
+	for hops := 0; hops <= maxCNAMEChain; hops++ {
+		zone, err := h.findZone(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if zone == "" {
+			upstream, err := h.resolveUpstream(name, recordType)
+			if err != nil {
+				return nil, err
+			}
+			answer.Addresses = upstream.Addresses
+			if upstream.TTL < answer.TTL {
+				answer.TTL = upstream.TTL
+			}
+			break
+		}
+
+		records, next, err := h.localAddresses(zone, name, recordType)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			if uint32(record.TTL) < answer.TTL {
+				answer.TTL = uint32(record.TTL)
+			}
+		}
+		if next == "" {
+			for _, record := range records {
+				answer.Addresses = append(answer.Addresses, record.Content)
+			}
+			break
+		}
+		name = next
+	}
+
+	if answer.TTL > 0 {
+		if err := h.redisClient.SetAliasAnswer(ctx, answer, time.Duration(answer.TTL)*time.Second); err != nil {
+			h.logger.Warnf("Failed to cache ALIAS answer: %v", err)
+		}
+	}
+	return answer, nil
+}
+
+// localAddresses looks up the records of a type at a name in one of our
+// zones. If the name is a CNAME or an ALIAS instead, it returns that record
+// and its target.
+func (h *DNSHandler) localAddresses(zone, name string, recordType models.RecordType) ([]models.Record, string, error) {
+	for _, t := range []models.RecordType{recordType, models.TypeCNAME, models.TypeALIAS} {
+		records, err := h.lookupRecords(zone, name, t)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(records) == 0 {
+			continue
+		}
+		if t == recordType {
+			return records, "", nil
+		}
+		return records[:1], normalizeName(records[0].Content), nil
+	}
+
+	_, records, err := h.lookupWildcard(zone, name, recordType)
+	return records, "", err
+}
+
+// resolveUpstream asks the configured upstream resolvers for the addresses
+// of a name, trying each in turn until one answers
+func (h *DNSHandler) resolveUpstream(name string, recordType models.RecordType) (*models.AliasAnswer, error) {
+	if len(h.cfg.DNS.Alias.Resolvers) == 0 {
+		return nil, fmt.Errorf("%s is not in our zones and no upstream resolvers are configured", name)
+	}
+
+	qtype := dns.StringToType[string(recordType)]
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+
+	timeout := time.Duration(h.cfg.DNS.Alias.Timeout) * time.Second
+	var lastErr error
+	for _, resolver := range h.cfg.DNS.Alias.Resolvers {
+		addr := util.HostPort(resolver, 53)
+		resp, _, err := (&dns.Client{Net: "udp", Timeout: timeout}).Exchange(req, addr)
+		if err == nil && resp.Truncated {
+			resp, _, err = (&dns.Client{Net: "tcp", Timeout: timeout}).Exchange(req, addr)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("%s answered %s", resolver, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+
+		answer := &models.AliasAnswer{Target: name, Type: recordType, TTL: h.aliasMaxTTL()}
+		for _, rr := range resp.Answer {
+			if rr.Header().Ttl < answer.TTL {
+				answer.TTL = rr.Header().Ttl
+			}
+			switch rr := rr.(type) {
+			case *dns.A:
+				if qtype == dns.TypeA {
+					answer.Addresses = append(answer.Addresses, rr.A.String())
+				}
+			case *dns.AAAA:
+				if qtype == dns.TypeAAAA {
+					answer.Addresses = append(answer.Addresses, rr.AAAA.String())
+				}
+			}
+		}
+
+		// Negative answers are cached for as long as the target's zone allows
+		if len(answer.Addresses) == 0 {
+			for _, rr := range resp.Ns {
+				if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < answer.TTL {
+					answer.TTL = soa.Minttl
+				}
+			}
+		}
+		return answer, nil
+	}
+
+	return nil, lastErr
+}
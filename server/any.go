@@ -0,0 +1,111 @@
+package server
+
+import (
+	"github.com/PooriaJ/RediDNS/models"
+	"github.com/miekg/dns"
+)
+
+// anyHINFOTTL is the TTL of the HINFO record synthesized for ANY queries.
+// It never changes, so it may be cached for long.
+const anyHINFOTTL = 3600
+
+// restrictANY applies the ANY policy before a query is looked up: it refuses
+// ANY queries, or asks UDP clients to retry over TCP, where responses can't
+// be sent to a spoofed address. It reports whether m is the final response.
+func (h *DNSHandler) restrictANY(m *dns.Msg, udp bool) bool {
+	switch h.cfg.DNS.ANY {
+	case "refuse":
+		m.Authoritative = false
+		m.Rcode = dns.RcodeRefused
+		return true
+	case "tcp":
+		if udp {
+			m.Truncated = true
+			return true
+		}
+	}
+	return false
+}
+
+// answerANY answers an ANY query for a name in zone (RFC 8482). Names that
+// own records, directly or through a wildcard, are answered with a single
+// HINFO record, or with all their RRsets when the tcp policy only lets ANY
+// queries through over TCP. It returns the source of synthesis when the
+// answer comes from a wildcard.
+func (h *DNSHandler) answerANY(m *dns.Msg, zone string, q *dns.Question) (string, error) {
+	name := normalizeName(q.Name)
+
+	owner := name
+	types, err := h.mariadbClient.GetRecordTypesByName(zone, name)
+	if err != nil {
+		return "", err
+	}
+
+	var wildcard string
+	if len(types) == 0 {
+		if wildcard, _, err = h.lookupWildcard(zone, name, models.RecordType(dns.Type(q.Qtype).String())); err != nil {
+			return "", err
+		}
+		if wildcard == "" {
+			return "", nil
+		}
+		owner = wildcard
+		if types, err = h.mariadbClient.GetRecordTypesByName(zone, wildcard); err != nil {
+			return "", err
+		}
+		if len(types) == 0 {
+			return "", nil
+		}
+	}
+
+	if h.cfg.DNS.ANY != "tcp" {
+		m.Answer = append(m.Answer, &dns.HINFO{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypeHINFO,
+				Class:  dns.ClassINET,
+				Ttl:    anyHINFOTTL,
+			},
+			Cpu: "RFC8482",
+		})
+		return wildcard, nil
+	}
+
+	if name == zone {
+		// The apex also serves the DNSKEY, CDS, CDNSKEY and NSEC3PARAM RRsets
+		keys, err := h.zoneKeys(zone)
+		if err != nil {
+			return "", err
+		}
+		m.Answer = append(m.Answer, h.dnskeyRRs(keys, q.Name)...)
+		m.Answer = append(m.Answer, h.cdsRRs(keys, q.Name, dns.TypeCDS)...)
+		m.Answer = append(m.Answer, h.cdsRRs(keys, q.Name, dns.TypeCDNSKEY)...)
+
+		rr, err := h.nsec3Param(zone, q.Name)
+		if err != nil {
+			return "", err
+		}
+		if rr != nil {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+
+	for _, recordType := range types {
+		// ALIAS records would have to be resolved first, and an ANY
+		// answer need not be complete
+		if recordType == models.TypeALIAS {
+			continue
+		}
+
+		records, err := h.lookupRecords(zone, owner, recordType)
+		if err != nil {
+			return "", err
+		}
+		for _, record := range records {
+			if err := h.addAnswerFromRecord(m, &record, q); err != nil {
+				h.logger.Warnf("Failed to add answer from record: %v", err)
+			}
+		}
+	}
+	return wildcard, nil
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/PooriaJ/RediDNS/models"
+	"github.com/miekg/dns"
+)
+
+// zoneCuts holds the delegations of a zone to child zones, the NS records
+// of each cut by its lower case name. It is rebuilt whenever the zone's
+// serial changes.
+type zoneCuts struct {
+	serial uint32
+	ns     map[string][]models.Record
+}
+
+// delegations returns the NS records of the zone cuts below the apex of zone
+func (h *DNSHandler) delegations(zone string) (map[string][]models.Record, error) {
+	soa, err := h.zoneSOA(zone)
+	if err != nil || soa == nil {
+		return nil, err
+	}
+
+	if cached, ok := h.cuts.Load(zone); ok {
+		cuts := cached.(*zoneCuts)
+		if cuts.serial == soa.Serial {
+			return cuts.ns, nil
+		}
+	}
+
+	records, err := h.mariadbClient.GetRecordsByZone(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	cuts := &zoneCuts{serial: soa.Serial, ns: make(map[string][]models.Record)}
+	for _, record := range records {
+		name := strings.ToLower(record.Name)
+		if record.Type == models.TypeNS && name != zone {
+			cuts.ns[name] = append(cuts.ns[name], record)
+		}
+	}
+	h.cuts.Store(zone, cuts)
+	return cuts.ns, nil
+}
+
+// lookupCut returns the zone cut at or above name within zone and its NS
+// records, or "" if name is authoritative data of the zone. The topmost cut
+// wins, as everything below it belongs to the child.
+func (h *DNSHandler) lookupCut(zone, name string) (string, []models.Record, error) {
+	cuts, err := h.delegations(zone)
+	if err != nil || len(cuts) == 0 {
+		return "", nil, err
+	}
+
+	var cut string
+	for n := name; n != zone; {
+		if _, ok := cuts[n]; ok {
+			cut = n
+		}
+		i := strings.Index(n, ".")
+		if i < 0 {
+			break
+		}
+		n = n[i+1:]
+	}
+	return cut, cuts[cut], nil
+}
+
+// answerReferral refers a question for a name at or below a zone cut to the
+// child zone's name servers (RFC 1034 section 4.3.2). The response is not
+// authoritative: it carries the cut's NS records in the authority section
+// and the addresses of name servers within the zone as glue. Signed zones
+// add the DS records of the cut or prove that there are none.
+func (h *DNSHandler) answerReferral(m *dns.Msg, zone, cut string, ns []models.Record, dnssecOK bool) error {
+	m.Authoritative = false
+
+	owner := dns.Fqdn(cut)
+	for _, record := range ns {
+		rr, err := recordToRR(&record, owner)
+		if err != nil {
+			h.logger.Warnf("Failed to add delegation from record: %v", err)
+			continue
+		}
+		m.Ns = append(m.Ns, rr)
+	}
+
+	// Name servers outside the zone are resolved from their own zones
+	for _, record := range ns {
+		target := normalizeName(record.Content)
+		if target != zone && !strings.HasSuffix(target, "."+zone) {
+			continue
+		}
+		for _, recordType := range []models.RecordType{models.TypeA, models.TypeAAAA} {
+			glue, err := h.lookupRecords(zone, target, recordType)
+			if err != nil {
+				return err
+			}
+			for _, record := range glue {
+				rr, err := recordToRR(&record, dns.Fqdn(target))
+				if err != nil {
+					h.logger.Warnf("Failed to add glue from record: %v", err)
+					continue
+				}
+				m.Extra = append(m.Extra, rr)
+			}
+		}
+	}
+
+	if !dnssecOK {
+		return nil
+	}
+
+	keys, err := h.zoneKeys(zone)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	ds, err := h.lookupRecords(zone, cut, models.TypeDS)
+	if err != nil {
+		return err
+	}
+	for _, record := range ds {
+		rr, err := recordToRR(&record, owner)
+		if err != nil {
+			h.logger.Warnf("Failed to add DS from record: %v", err)
+			continue
+		}
+		m.Ns = append(m.Ns, rr)
+	}
+	if len(ds) == 0 {
+		// An insecure delegation, proven by the denial record of the cut
+		if err := h.addDenial(m, zone, owner, dns.TypeDS, ""); err != nil {
+			return err
+		}
+	}
+
+	// The NS records and glue are not signed, they belong to the child
+	return h.signMsg(m, zone, keys, nil)
+}
@@ -0,0 +1,452 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/PooriaJ/RediDNS/models"
+	"github.com/PooriaJ/RediDNS/util"
+	"github.com/miekg/dns"
+)
+
+// denialChain is the precomputed chain of owner names of a signed zone, in
+// the order its NSEC or NSEC3 records link them. It is rebuilt whenever the
+// zone's serial or denial settings change.
+type denialChain struct {
+	serial   uint32
+	settings string // Denial settings the chain was built for
+	nodes    []denialNode
+	names    map[string]bool // Every name in the zone, including empty non-terminals
+}
+
+// denialNode is a single link of a denial chain
+type denialNode struct {
+	name  string // Owner name, fully qualified and lower case
+	hash  string // NSEC3 hash of name in base32hex (NSEC3 chains only)
+	types []uint16
+}
+
+// denialSettings identifies the denial of existence settings of a zone
+func denialSettings(zone *models.Zone) string {
+	return fmt.Sprintf("%s/%s/%d/%t", zone.Denial, zone.NSEC3Salt, zone.NSEC3Iterations, zone.NSEC3OptOut)
+}
+
+// zoneChain returns the denial chain of a zone at the given serial
+func (h *DNSHandler) zoneChain(zone *models.Zone, serial uint32) (*denialChain, error) {
+	settings := denialSettings(zone)
+	if cached, ok := h.chains.Load(zone.Name); ok {
+		chain := cached.(*denialChain)
+		if chain.serial == serial && chain.settings == settings {
+			return chain, nil
+		}
+	}
+
+	records, err := h.mariadbClient.GetRecordsByZone(zone.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := buildDenialChain(zone, records)
+	chain.serial = serial
+	chain.settings = settings
+	h.chains.Store(zone.Name, chain)
+	return chain, nil
+}
+
+// buildDenialChain builds the denial chain of a zone from its records
+func buildDenialChain(zone *models.Zone, records []models.Record) *denialChain {
+	apex := dns.Fqdn(zone.Name)
+	nsec3 := zone.Denial == models.DenialNSEC3
+
+	owners := make(map[string]map[uint16]bool)
+	for _, record := range records {
+		name := dns.Fqdn(strings.ToLower(record.Name))
+		rrtypes := servedTypes(record.Type)
+		if len(rrtypes) == 0 || !dns.IsSubDomain(apex, name) {
+			continue
+		}
+		if owners[name] == nil {
+			owners[name] = make(map[uint16]bool)
+		}
+		for _, rrtype := range rrtypes {
+			owners[name][rrtype] = true
+		}
+	}
+
+	// Names below a delegation are not authoritative and names below a
+	// DNAME are occluded by it, both are left out
+	var cuts []string
+	for name, types := range owners {
+		if (name != apex && types[dns.TypeNS]) || types[dns.TypeDNAME] {
+			cuts = append(cuts, name)
+		}
+	}
+	for name := range owners {
+		for _, cut := range cuts {
+			if name != cut && dns.IsSubDomain(cut, name) {
+				delete(owners, name)
+				break
+			}
+		}
+	}
+
+	if owners[apex] == nil {
+		owners[apex] = make(map[uint16]bool)
+	}
+	owners[apex][dns.TypeDNSKEY] = true
+	owners[apex][dns.TypeCDS] = true
+	owners[apex][dns.TypeCDNSKEY] = true
+	if nsec3 {
+		owners[apex][dns.TypeNSEC3PARAM] = true
+	}
+
+	// Every ancestor of an owner name up to the apex exists, possibly as an
+	// empty non-terminal
+	names := make(map[string]bool)
+	for name := range owners {
+		for n := name; ; n = parentName(n) {
+			names[n] = true
+			if n == apex || n == "." {
+				break
+			}
+		}
+	}
+
+	chain := &denialChain{names: names}
+	if nsec3 {
+		for name := range names {
+			types := owners[name]
+			delegation := name != apex && types[dns.TypeNS]
+			secure := types[dns.TypeDS]
+			if delegation && !secure && zone.NSEC3OptOut {
+				continue
+			}
+
+			var bitmap []uint16
+			for rrtype := range types {
+				if !delegation || rrtype == dns.TypeNS || rrtype == dns.TypeDS {
+					bitmap = append(bitmap, rrtype)
+				}
+			}
+			if len(types) > 0 && (!delegation || secure) {
+				bitmap = append(bitmap, dns.TypeRRSIG)
+			}
+
+			chain.nodes = append(chain.nodes, denialNode{
+				name:  name,
+				hash:  dns.HashName(name, dns.SHA1, zone.NSEC3Iterations, zone.NSEC3Salt),
+				types: sortTypes(bitmap),
+			})
+		}
+		sort.Slice(chain.nodes, func(i, j int) bool {
+			return chain.nodes[i].hash < chain.nodes[j].hash
+		})
+		return chain
+	}
+
+	// NSEC chains link the names owning records; empty non-terminals are
+	// proven by the NSEC covering them
+	for name, types := range owners {
+		delegation := name != apex && types[dns.TypeNS]
+		bitmap := []uint16{dns.TypeNSEC, dns.TypeRRSIG}
+		for rrtype := range types {
+			if !delegation || rrtype == dns.TypeNS || rrtype == dns.TypeDS {
+				bitmap = append(bitmap, rrtype)
+			}
+		}
+		chain.nodes = append(chain.nodes, denialNode{name: name, types: sortTypes(bitmap)})
+	}
+	sort.Slice(chain.nodes, func(i, j int) bool {
+		return canonicalLess(chain.nodes[i].name, chain.nodes[j].name)
+	})
+	return chain
+}
+
+// servedTypes returns the types of the RRsets a record is served as. ALIAS
+// records are served as the A and AAAA records they resolve to.
+func servedTypes(recordType models.RecordType) []uint16 {
+	if recordType == models.TypeALIAS {
+		return []uint16{dns.TypeA, dns.TypeAAAA}
+	}
+	if rrtype, ok := util.RecordTypeCode(string(recordType)); ok {
+		return []uint16{rrtype}
+	}
+	return nil
+}
+
+// addDenial adds the NSEC or NSEC3 records proving a negative answer for
+// qname and qtype to the authority section (RFC 4035 section 3.1.3, RFC 5155
+// section 7.2). For answers synthesized from wildcard, they prove that qname
+// itself does not exist and, if the answer is empty, that neither does the
+// type at the wildcard.
+func (h *DNSHandler) addDenial(m *dns.Msg, zoneName, qname string, qtype uint16, wildcard string) error {
+	soa, err := h.zoneSOA(zoneName)
+	if err != nil || soa == nil {
+		return err
+	}
+
+	zone, err := h.mariadbClient.GetZone(zoneName)
+	if err != nil || zone == nil {
+		return err
+	}
+
+	chain, err := h.zoneChain(zone, soa.Serial)
+	if err != nil {
+		return err
+	}
+	if len(chain.nodes) == 0 {
+		return nil
+	}
+
+	name := dns.Fqdn(strings.ToLower(qname))
+	nxdomain := m.Rcode == dns.RcodeNameError
+	nodata := len(m.Answer) == 0 && !nxdomain
+
+	// The denial records share the TTL of the negative SOA (RFC 9077)
+	ttl := soa.Hdr.Ttl
+	if ttl > soa.Minttl {
+		ttl = soa.Minttl
+	}
+
+	var rrs []dns.RR
+	if zone.Denial == models.DenialNSEC3 {
+		switch {
+		case wildcard != "":
+			// The wildcard's parent is the closest encloser, only the next
+			// closer name needs covering unless the wildcard lacks the type
+			wildcard = dns.Fqdn(strings.ToLower(wildcard))
+			ce := parentName(wildcard)
+			if nodata {
+				if i, ok := chain.nsec3Match(ce, zone); ok {
+					rrs = append(rrs, chain.nsec3(i, zone, ttl))
+				}
+			}
+			rrs = append(rrs, chain.nsec3(chain.nsec3Cover(nextCloser(name, ce), zone), zone, ttl))
+			if nodata {
+				if i, ok := chain.nsec3Match(wildcard, zone); ok {
+					rrs = append(rrs, withoutType(chain.nsec3(i, zone, ttl), qtype))
+				}
+			}
+		case nodata:
+			if i, ok := chain.nsec3Match(name, zone); ok {
+				m.Ns = append(m.Ns, withoutType(chain.nsec3(i, zone, ttl), qtype))
+				return nil
+			}
+			fallthrough
+		default:
+			// Closest encloser proof: the closest encloser exists and the
+			// next closer name does not. Names without NSEC3 of their own,
+			// opted out delegations, are proven from the closest ancestor
+			// that has one.
+			ce := chain.closestEncloser(name)
+			if !nxdomain {
+				for ce = parentName(name); ce != "."; ce = parentName(ce) {
+					if _, ok := chain.nsec3Match(ce, zone); ok {
+						break
+					}
+				}
+			}
+			if i, ok := chain.nsec3Match(ce, zone); ok {
+				rrs = append(rrs, chain.nsec3(i, zone, ttl))
+			}
+			if next := nextCloser(name, ce); next != "" {
+				rrs = append(rrs, chain.nsec3(chain.nsec3Cover(next, zone), zone, ttl))
+			}
+			if nxdomain {
+				rrs = append(rrs, chain.nsec3(chain.nsec3Cover("*."+ce, zone), zone, ttl))
+			}
+		}
+	} else {
+		i := chain.nsecCover(name)
+		if nodata && chain.nodes[i].name == name {
+			rrs = append(rrs, withoutType(chain.nsec(i, ttl), qtype))
+		} else {
+			rrs = append(rrs, chain.nsec(i, ttl))
+		}
+		switch {
+		case wildcard != "" && nodata:
+			// The NSEC of the wildcard shows it has no records of the type
+			i := chain.nsecCover(dns.Fqdn(strings.ToLower(wildcard)))
+			rrs = append(rrs, withoutType(chain.nsec(i, ttl), qtype))
+		case nxdomain:
+			// No wildcard at the closest encloser could have matched either
+			ce := chain.closestEncloser(name)
+			rrs = append(rrs, chain.nsec(chain.nsecCover("*."+ce), ttl))
+		}
+	}
+
+	// Several proofs are often made by the same record
+	seen := make(map[string]bool)
+	for _, rr := range rrs {
+		if !seen[rr.Header().Name] {
+			seen[rr.Header().Name] = true
+			m.Ns = append(m.Ns, rr)
+		}
+	}
+	return nil
+}
+
+// withoutType removes rrtype from the bitmap of an NSEC or NSEC3 record
+// matching the name of a NODATA answer. The bitmap of an ALIAS owner lists A
+// and AAAA, but a target without addresses of one of them leaves the answer
+// for it empty, and the proof must not claim the type exists.
+func withoutType(rr dns.RR, rrtype uint16) dns.RR {
+	var bitmap *[]uint16
+	switch rr := rr.(type) {
+	case *dns.NSEC:
+		bitmap = &rr.TypeBitMap
+	case *dns.NSEC3:
+		bitmap = &rr.TypeBitMap
+	default:
+		return rr
+	}
+
+	// The bitmap is shared with the cached chain, so a copy is filtered
+	types := make([]uint16, 0, len(*bitmap))
+	for _, t := range *bitmap {
+		if t != rrtype {
+			types = append(types, t)
+		}
+	}
+	*bitmap = types
+	return rr
+}
+
+// nsecCover returns the index of the node whose NSEC matches or covers name
+func (c *denialChain) nsecCover(name string) int {
+	i := sort.Search(len(c.nodes), func(i int) bool {
+		return canonicalLess(name, c.nodes[i].name)
+	})
+	if i == 0 {
+		// Before the apex can't happen within the zone, wrap around
+		return len(c.nodes) - 1
+	}
+	return i - 1
+}
+
+// nsec returns the NSEC record of node i
+func (c *denialChain) nsec(i int, ttl uint32) dns.RR {
+	node := c.nodes[i]
+	next := c.nodes[(i+1)%len(c.nodes)]
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: node.name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: next.name,
+		TypeBitMap: node.types,
+	}
+}
+
+// nsec3Match returns the index of the node whose NSEC3 matches name
+func (c *denialChain) nsec3Match(name string, zone *models.Zone) (int, bool) {
+	hash := dns.HashName(name, dns.SHA1, zone.NSEC3Iterations, zone.NSEC3Salt)
+	i := sort.Search(len(c.nodes), func(i int) bool {
+		return c.nodes[i].hash >= hash
+	})
+	return i, i < len(c.nodes) && c.nodes[i].hash == hash
+}
+
+// nsec3Cover returns the index of the node whose NSEC3 covers name
+func (c *denialChain) nsec3Cover(name string, zone *models.Zone) int {
+	hash := dns.HashName(name, dns.SHA1, zone.NSEC3Iterations, zone.NSEC3Salt)
+	i := sort.Search(len(c.nodes), func(i int) bool {
+		return c.nodes[i].hash > hash
+	})
+	if i == 0 {
+		// Before the first hash, covered by the last record of the chain
+		return len(c.nodes) - 1
+	}
+	return i - 1
+}
+
+// nsec3 returns the NSEC3 record of node i
+func (c *denialChain) nsec3(i int, zone *models.Zone, ttl uint32) dns.RR {
+	node := c.nodes[i]
+	next := c.nodes[(i+1)%len(c.nodes)]
+
+	var flags uint8
+	if zone.NSEC3OptOut {
+		flags = 1
+	}
+
+	return &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: strings.ToLower(node.hash) + "." + dns.Fqdn(zone.Name), Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: ttl},
+		Hash:       dns.SHA1,
+		Flags:      flags,
+		Iterations: zone.NSEC3Iterations,
+		SaltLength: uint8(len(zone.NSEC3Salt) / 2),
+		Salt:       zone.NSEC3Salt,
+		HashLength: 20,
+		NextDomain: next.hash,
+		TypeBitMap: node.types,
+	}
+}
+
+// closestEncloser returns the longest existing ancestor of name
+func (c *denialChain) closestEncloser(name string) string {
+	for n := name; n != "."; n = parentName(n) {
+		if c.names[n] {
+			return n
+		}
+	}
+	return "."
+}
+
+// nsec3Param returns the NSEC3PARAM record of a signed NSEC3 zone, or nil
+func (h *DNSHandler) nsec3Param(zoneName, owner string) (dns.RR, error) {
+	keys, err := h.zoneKeys(zoneName)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	zone, err := h.mariadbClient.GetZone(zoneName)
+	if err != nil || zone == nil || zone.Denial != models.DenialNSEC3 {
+		return nil, err
+	}
+
+	return &dns.NSEC3PARAM{
+		Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET},
+		Hash:       dns.SHA1,
+		Iterations: zone.NSEC3Iterations,
+		SaltLength: uint8(len(zone.NSEC3Salt) / 2),
+		Salt:       zone.NSEC3Salt,
+	}, nil
+}
+
+// nextCloser returns the ancestor of name that is one label longer than the
+// closest encloser ce, or "" if name is ce
+func nextCloser(name, ce string) string {
+	labels := dns.CountLabel(ce) + 1
+	for n := name; n != "."; n = parentName(n) {
+		if dns.CountLabel(n) == labels {
+			return n
+		}
+	}
+	return ""
+}
+
+// parentName returns name with its first label removed
+func parentName(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
+
+// canonicalLess reports whether name a sorts before b in canonical DNS name
+// order (RFC 4034 section 6.1). Both names must be lower case.
+func canonicalLess(a, b string) bool {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		x, y := la[len(la)-i], lb[len(lb)-i]
+		if x != y {
+			return x < y
+		}
+	}
+	return len(la) < len(lb)
+}
+
+// sortTypes sorts a type bitmap
+func sortTypes(types []uint16) []uint16 {
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
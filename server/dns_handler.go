@@ -2,38 +2,87 @@ package server
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/PooriaJ/RediDNS/config"
 	"github.com/PooriaJ/RediDNS/db"
 	"github.com/PooriaJ/RediDNS/models"
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 )
 
+// recordCache is the part of *db.RedisClient used by the handler
+type recordCache interface {
+	GetRecordsByNameAndType(ctx context.Context, zone, name string, recordType models.RecordType) ([]models.Record, error)
+	GetRecord(ctx context.Context, zone, name string, recordType models.RecordType) (*models.Record, error)
+	SetRecords(ctx context.Context, records []models.Record, ttl time.Duration) error
+	SetRecord(ctx context.Context, record *models.Record, ttl time.Duration) error
+	GetSignatures(ctx context.Context, zone, name string, recordType models.RecordType) (*models.SignatureSet, error)
+	SetSignatures(ctx context.Context, sigs *models.SignatureSet, ttl time.Duration) error
+	GetWildcardRecords(ctx context.Context, zone, name string, recordType models.RecordType) ([]models.Record, error)
+	SetWildcardRecords(ctx context.Context, zone, name string, records []models.Record, ttl time.Duration) error
+	GetAliasAnswer(ctx context.Context, target string, recordType models.RecordType) (*models.AliasAnswer, error)
+	SetAliasAnswer(ctx context.Context, answer *models.AliasAnswer, ttl time.Duration) error
+	PublishRecordUpdate(ctx context.Context, record *models.Record) error
+	PublishZoneUpdate(ctx context.Context, update *models.ZoneUpdate) error
+}
+
+// recordStore is the part of *db.MariaDBClient used by the handler
+type recordStore interface {
+	GetZone(name string) (*models.Zone, error)
+	GetRecord(zone, name string, recordType models.RecordType) (*models.Record, error)
+	GetRecordsByNameAndType(zone, name string, recordType models.RecordType) ([]models.Record, error)
+	GetRecordsByZone(zone string) ([]models.Record, error)
+	GetZoneJournal(zone string) ([]models.JournalEntry, error)
+	NameExists(zone, name string) (bool, error)
+	GetRecordTypesByName(zone, name string) ([]models.RecordType, error)
+	GetDNSSECKeys(zone string) ([]models.DNSSECKey, error)
+	UpdateZoneRecords(zone string, keep int, update func(records []models.Record) (removed, added []models.Record, err error)) (*models.Record, error)
+}
+
 // DNSHandler handles DNS queries
 type DNSHandler struct {
-	redisClient   *db.RedisClient
-	mariadbClient *db.MariaDBClient
+	cfg           *config.Config
+	redisClient   recordCache
+	mariadbClient recordStore
 	logger        *logrus.Logger
 	stats         *DNSStats
+	secondaries   *secondaryManager // Nil when secondary zones are not served
+	signers       sync.Map          // Parsed DNSSEC private keys by key ID
+	keySets       sync.Map          // DNSSEC keys ready for signing by zone name
+	chains        sync.Map          // Denial of existence chains by zone name
+	cuts          sync.Map          // Delegations to child zones by zone name
 }
 
-// DNSStats holds statistics about DNS queries
+// DNSStats holds statistics about DNS queries. Listeners answer queries
+// concurrently, so the counters are updated atomically.
 type DNSStats struct {
 	Queries       int64
 	CacheHits     int64
 	CacheMisses   int64
 	NXDomain      int64
+	Refused       int64
 	ServerFailure int64
 }
 
+// listenerOptions are the per-listener settings that affect how queries are answered
+type listenerOptions struct {
+	// refuseUnhosted answers names outside our zones with REFUSED rather
+	// than a non-authoritative NXDOMAIN
+	refuseUnhosted bool
+}
+
+// defaultListenerOptions are used when the handler is served directly
+var defaultListenerOptions = listenerOptions{refuseUnhosted: true}
+
 // NewDNSHandler creates a new DNS handler
-func NewDNSHandler(redisClient *db.RedisClient, mariadbClient *db.MariaDBClient, logger *logrus.Logger) *DNSHandler {
+func NewDNSHandler(cfg *config.Config, redisClient *db.RedisClient, mariadbClient *db.MariaDBClient, logger *logrus.Logger) *DNSHandler {
 	return &DNSHandler{
+		cfg:           cfg,
 		redisClient:   redisClient,
 		mariadbClient: mariadbClient,
 		logger:        logger,
@@ -43,40 +92,188 @@ func NewDNSHandler(redisClient *db.RedisClient, mariadbClient *db.MariaDBClient,
 
 // ServeDNS implements the dns.Handler interface
 func (h *DNSHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
-	h.stats.Queries++
+	h.serve(w, r, defaultListenerOptions)
+}
+
+// forListener returns a dns.Handler answering with the options of a listener
+func (h *DNSHandler) forListener(opts listenerOptions) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		h.serve(w, r, opts)
+	})
+}
+
+// serve answers a single DNS message
+func (h *DNSHandler) serve(w dns.ResponseWriter, r *dns.Msg, opts listenerOptions) {
+	atomic.AddInt64(&h.stats.Queries, 1)
 
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Authoritative = true
 
-	// Process each question
-	for _, q := range r.Question {
-		h.logger.Debugf("Received query: %s %s %s", q.Name, dns.TypeToString[q.Qtype], dns.ClassToString[q.Qclass])
+	// Signed requests are verified by the listener, their responses are
+	// signed with the same key
+	if t := r.IsTsig(); t != nil {
+		if err := w.TsigStatus(); err != nil {
+			h.rejectTSIG(w, m, t, err)
+			return
+		}
+		w = &tsigWriter{ResponseWriter: w, tsig: t}
+	}
+
+	switch r.Opcode {
+	case dns.OpcodeQuery:
+	case dns.OpcodeNotify:
+		h.serveNotify(w, r, m)
+		return
+	case dns.OpcodeUpdate:
+		h.serveUpdate(w, r, m)
+		return
+	default:
+		m.Authoritative = false
+		m.Rcode = dns.RcodeNotImplemented
+		h.writeMsg(w, m, nil)
+		return
+	}
 
-		// Handle the query
-		if err := h.handleQuery(m, &q); err != nil {
-			h.logger.Errorf("Error handling query: %v", err)
-			m.Rcode = dns.RcodeServerFailure
-			h.stats.ServerFailure++
+	// Negotiate EDNS0. Only version 0 is supported, anything else gets
+	// BADVERS with our own OPT record (RFC 6891 section 6.1.3)
+	opt := r.IsEdns0()
+	if opt != nil {
+		m.SetEdns0(h.udpSize(), opt.Do())
+		if opt.Version() != 0 {
+			m.Authoritative = false
+			m.Rcode = dns.RcodeBadVers
+			h.writeMsg(w, m, opt)
+			return
 		}
 	}
 
-	// If no answers were found, set NXDOMAIN
-	if len(m.Answer) == 0 {
-		m.Rcode = dns.RcodeNameError
-		h.stats.NXDomain++
+	// Only a single question per message is supported (RFC 9619)
+	if len(r.Question) != 1 {
+		m.Authoritative = false
+		m.Rcode = dns.RcodeFormatError
+		h.writeMsg(w, m, opt)
+		return
+	}
+
+	q := r.Question[0]
+	h.logger.Debugf("Received query: %s %s %s", q.Name, dns.TypeToString[q.Qtype], dns.ClassToString[q.Qclass])
+
+	// Zone transfers write their own responses
+	switch q.Qtype {
+	case dns.TypeAXFR:
+		h.serveAXFR(w, r)
+		return
+	case dns.TypeIXFR:
+		h.serveIXFR(w, r)
+		return
+	}
+
+	// ANY queries may be refused or sent to TCP before anything is looked up
+	if q.Qtype == dns.TypeANY && h.restrictANY(m, isUDP(w)) {
+		if m.Rcode == dns.RcodeRefused {
+			atomic.AddInt64(&h.stats.Refused, 1)
+		}
+		h.writeMsg(w, m, opt)
+		return
+	}
+
+	// Handle the query
+	dnssecOK := opt != nil && opt.Do()
+	if err := h.handleQuery(m, &q, opts, dnssecOK); err != nil {
+		h.logger.Errorf("Error handling query: %v", err)
+		m.Answer, m.Ns = nil, nil
+		m.Rcode = dns.RcodeServerFailure
+	} else {
+		h.addAdditional(m, h.payloadSize(w, opt), dnssecOK)
+	}
+
+	switch m.Rcode {
+	case dns.RcodeNameError:
+		atomic.AddInt64(&h.stats.NXDomain, 1)
+	case dns.RcodeRefused:
+		atomic.AddInt64(&h.stats.Refused, 1)
+	case dns.RcodeServerFailure:
+		atomic.AddInt64(&h.stats.ServerFailure, 1)
+	}
+
+	h.writeMsg(w, m, opt)
+}
+
+// writeMsg writes the response, truncating it to the negotiated payload
+// size when the query arrived over UDP
+func (h *DNSHandler) writeMsg(w dns.ResponseWriter, m *dns.Msg, opt *dns.OPT) {
+	if isUDP(w) {
+		size := h.payloadSize(w, opt)
+		if tw, ok := w.(*tsigWriter); ok {
+			// Leave room for the TSIG record signing the response
+			size -= dns.Len(tw.tsig)
+		}
+		m.Truncate(size)
+	} else {
+		m.Compress = true
 	}
 
-	// Write response
 	if err := w.WriteMsg(m); err != nil {
 		h.logger.Errorf("Error writing DNS response: %v", err)
 	}
 }
 
-// handleQuery processes a single DNS query
-func (h *DNSHandler) handleQuery(m *dns.Msg, q *dns.Question) error {
-	// Normalize the query name (remove trailing dot)
-	name := strings.TrimSuffix(q.Name, ".")
+// payloadSize returns the largest response the client accepts: over UDP the
+// payload size both sides advertised, over TCP the largest DNS message
+func (h *DNSHandler) payloadSize(w dns.ResponseWriter, opt *dns.OPT) int {
+	if !isUDP(w) {
+		return dns.MaxMsgSize
+	}
+
+	size := dns.MinMsgSize
+	if opt != nil {
+		size = int(opt.UDPSize())
+		if advertised := int(h.udpSize()); size > advertised {
+			size = advertised
+		}
+		if size < dns.MinMsgSize {
+			size = dns.MinMsgSize
+		}
+	}
+	return size
+}
+
+// udpSize returns the EDNS0 UDP payload size we advertise
+func (h *DNSHandler) udpSize() uint16 {
+	size := h.cfg.DNS.EDNS.UDPSize
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	if size > dns.MaxMsgSize {
+		size = dns.MaxMsgSize
+	}
+	return uint16(size)
+}
+
+// normalizeName converts a query name to the form records are stored in:
+// lower case without the trailing dot
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// isUDP reports whether the request was received over UDP
+func isUDP(w dns.ResponseWriter) bool {
+	_, ok := w.RemoteAddr().(*net.UDPAddr)
+	return ok
+}
+
+// maxCNAMEChain is the number of CNAMEs followed within our zones before the
+// answer is returned as it is
+const maxCNAMEChain = 8
+
+// handleQuery processes a single DNS query. It fills the answer section and,
+// for negative answers, sets the response code and adds the zone SOA to the
+// authority section (RFC 2308). CNAMEs are followed as long as their targets
+// are in zones we host. Answers from signed zones are signed when the client
+// set the DO bit.
+func (h *DNSHandler) handleQuery(m *dns.Msg, q *dns.Question, opts listenerOptions, dnssecOK bool) error {
+	name := normalizeName(q.Name)
 
 	// Find the zone for this query
 	zone, err := h.findZone(name)
@@ -85,42 +282,263 @@ func (h *DNSHandler) handleQuery(m *dns.Msg, q *dns.Question) error {
 	}
 
 	if zone == "" {
-		// No zone found for this query
+		// Not authoritative for this name, don't pretend to be
+		m.Authoritative = false
+		if opts.refuseUnhosted {
+			m.Rcode = dns.RcodeRefused
+		} else {
+			m.Rcode = dns.RcodeNameError
+		}
 		return nil
 	}
 
-	// Try to get records from cache first
-	ctx := context.Background()
-	recordType := models.RecordType(dns.TypeToString[q.Qtype])
+	if q.Qtype == dns.TypeDS && name == zone {
+		// The DS records of a zone are served by its parent (RFC 4035
+		// section 3.1.4.1), which we may host as well
+		if i := strings.Index(name, "."); i >= 0 {
+			parent, err := h.findZone(name[i+1:])
+			if err != nil {
+				return err
+			}
+			if parent != "" {
+				zone = parent
+			}
+		}
+	}
 
-	// Try to get multiple records from cache
-	records, err := h.redisClient.GetRecordsByNameAndType(ctx, zone, name, recordType)
-	if err == nil && len(records) > 0 {
-		// Cache hit for multiple records
-		h.stats.CacheHits++
+	if h.secondaries.isExpired(zone) {
+		// Our copy of the zone is too old to be trusted (RFC 1034 section 4.3.5)
+		m.Authoritative = false
+		m.Rcode = dns.RcodeServerFailure
+		return nil
+	}
+
+	// Each name of a CNAME chain is answered on its own, as it may be in a
+	// different zone signed with different keys. The response code and
+	// authority section are those of the last name (RFC 6604).
+	seen := map[string]bool{name: true}
+	step := *q
+	for chain := 0; ; chain++ {
+		part := new(dns.Msg)
+		part.Authoritative = true
+		target, err := h.answerName(part, zone, &step, dnssecOK)
+		if err != nil {
+			return err
+		}
+		m.Answer = append(m.Answer, part.Answer...)
+		m.Ns = part.Ns
+		m.Extra = append(m.Extra, part.Extra...)
+		m.Rcode = part.Rcode
+		if chain == 0 {
+			m.Authoritative = part.Authoritative
+		}
+
+		if target == "" || chain == maxCNAMEChain {
+			return nil
+		}
+
+		// Stop at loops and at targets we are not authoritative for, the
+		// resolver carries on from there
+		name = normalizeName(target)
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+
+		zone, err = h.findZone(name)
+		if err != nil {
+			return err
+		}
+		if zone == "" || h.secondaries.isExpired(zone) {
+			return nil
+		}
+
+		step.Name = dns.Fqdn(target)
+	}
+}
+
+// answerName answers a question for a name in zone. If the name is an alias
+// it answers with the CNAME and returns its target.
+func (h *DNSHandler) answerName(m *dns.Msg, zone string, q *dns.Question, dnssecOK bool) (string, error) {
+	name := normalizeName(q.Name)
+
+	// Below a zone cut the child is authoritative, except for the DS
+	// records of the cut itself, which belong to this side
+	cut, ns, err := h.lookupCut(zone, name)
+	if err != nil {
+		return "", err
+	}
+	if cut != "" && (q.Qtype != dns.TypeDS || cut != name) {
+		return "", h.answerReferral(m, zone, cut, ns, dnssecOK)
+	}
+
+	// Source of synthesis when the answer comes from a wildcard
+	var wildcard string
+	var target string
+
+	switch {
+	case q.Qtype == dns.TypeDNSKEY && name == zone:
+		// The DNSKEY RRset is built from the zone's signing keys
+		keys, err := h.zoneKeys(zone)
+		if err != nil {
+			return "", err
+		}
+		m.Answer = append(m.Answer, h.dnskeyRRs(keys, q.Name)...)
+	case (q.Qtype == dns.TypeCDS || q.Qtype == dns.TypeCDNSKEY) && name == zone:
+		// So are CDS and CDNSKEY, pointing the parent at the current KSK
+		keys, err := h.zoneKeys(zone)
+		if err != nil {
+			return "", err
+		}
+		m.Answer = append(m.Answer, h.cdsRRs(keys, q.Name, q.Qtype)...)
+	case q.Qtype == dns.TypeNSEC3PARAM && name == zone:
+		// So is NSEC3PARAM, from the zone's denial settings
+		rr, err := h.nsec3Param(zone, q.Name)
+		if err != nil {
+			return "", err
+		}
+		if rr != nil {
+			m.Answer = append(m.Answer, rr)
+		}
+	case q.Qtype == dns.TypeANY:
+		// Names below a DNAME are redirected as for any other type
+		dname, err := h.lookupDNAME(zone, name)
+		if err != nil {
+			return "", err
+		}
+		if dname != nil {
+			return h.answerDNAME(m, zone, q, dname, dnssecOK)
+		}
+		if wildcard, err = h.answerANY(m, zone, q); err != nil {
+			return "", err
+		}
+	default:
+		recordType := models.RecordType(dns.Type(q.Qtype).String())
+		records, err := h.lookupRecords(zone, name, recordType)
+		if err != nil {
+			return "", err
+		}
+		if len(records) == 0 {
+			// Names below a DNAME are redirected (RFC 6672 section 3.2)
+			dname, err := h.lookupDNAME(zone, name)
+			if err != nil {
+				return "", err
+			}
+			if dname != nil {
+				return h.answerDNAME(m, zone, q, dname, dnssecOK)
+			}
+		}
+		if len(records) == 0 && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+			if records, err = h.aliasRecords(zone, name, recordType); err != nil {
+				return "", err
+			}
+		}
+		if len(records) == 0 && q.Qtype != dns.TypeCNAME {
+			// A CNAME answers for every type (RFC 1034 section 3.6.2)
+			if records, err = h.lookupRecords(zone, name, models.TypeCNAME); err != nil {
+				return "", err
+			}
+		}
+		if len(records) == 0 {
+			wildcard, records, err = h.lookupWildcard(zone, name, recordType)
+			if err != nil {
+				return "", err
+			}
+			if len(records) == 0 && wildcard != "" && q.Qtype != dns.TypeCNAME {
+				if records, err = h.lookupRecords(zone, wildcard, models.TypeCNAME); err != nil {
+					return "", err
+				}
+			}
+		}
+
+		// Wildcard records are answered with the query name as owner
 		for _, record := range records {
 			if err := h.addAnswerFromRecord(m, &record, q); err != nil {
 				h.logger.Warnf("Failed to add answer from record: %v", err)
 			}
 		}
+		if len(records) > 0 && records[0].Type == models.TypeCNAME && q.Qtype != dns.TypeCNAME {
+			target = records[0].Content
+		}
+	}
+
+	if len(m.Answer) > 0 {
+		return target, h.finishAnswer(m, zone, q, wildcard, dnssecOK)
+	}
+
+	// Negative answer. The name exists (NODATA) if it owns records of any
+	// other type, is an empty non-terminal or is matched by a wildcard,
+	// otherwise it is NXDOMAIN.
+	if wildcard == "" {
+		exists, err := h.mariadbClient.NameExists(zone, name)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			m.Rcode = dns.RcodeNameError
+		}
+	}
+
+	if err := h.addNegativeSOA(m, zone); err != nil {
+		return "", err
+	}
+	return "", h.finishAnswer(m, zone, q, wildcard, dnssecOK)
+}
+
+// finishAnswer signs an answer from zone if the client asked for DNSSEC
+// records, adding NSEC or NSEC3 records to negative answers and to answers
+// synthesized from the wildcard name
+func (h *DNSHandler) finishAnswer(m *dns.Msg, zone string, q *dns.Question, wildcard string, dnssecOK bool) error {
+	if !dnssecOK {
 		return nil
 	}
 
+	keys, err := h.zoneKeys(zone)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	var synthesized map[string]string
+	if wildcard != "" {
+		synthesized = map[string]string{strings.ToLower(q.Name): dns.Fqdn(wildcard)}
+	}
+
+	if len(m.Answer) == 0 || wildcard != "" {
+		if err := h.addDenial(m, zone, q.Name, q.Qtype, wildcard); err != nil {
+			return err
+		}
+	}
+	return h.signMsg(m, zone, keys, synthesized)
+}
+
+// lookupRecords returns the records of the given name and type, from the
+// cache if possible and from the database otherwise
+func (h *DNSHandler) lookupRecords(zone, name string, recordType models.RecordType) ([]models.Record, error) {
+	ctx := context.Background()
+
+	// Try to get multiple records from cache
+	records, err := h.redisClient.GetRecordsByNameAndType(ctx, zone, name, recordType)
+	if err == nil && len(records) > 0 {
+		// Cache hit for multiple records
+		atomic.AddInt64(&h.stats.CacheHits, 1)
+		return records, nil
+	}
+
 	// Try single record cache for backward compatibility
 	record, err := h.redisClient.GetRecord(ctx, zone, name, recordType)
 	if err == nil && record != nil {
 		// Cache hit for single record
-		h.stats.CacheHits++
-		return h.addAnswerFromRecord(m, record, q)
+		atomic.AddInt64(&h.stats.CacheHits, 1)
+		return []models.Record{*record}, nil
 	}
 
 	// Cache miss, try to get from database
-	h.stats.CacheMisses++
+	atomic.AddInt64(&h.stats.CacheMisses, 1)
 
 	// Get multiple records from database
 	records, err = h.mariadbClient.GetRecordsByNameAndType(zone, name, recordType)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if len(records) > 0 {
@@ -129,20 +547,13 @@ func (h *DNSHandler) handleQuery(m *dns.Msg, q *dns.Question) error {
 		if err := h.redisClient.SetRecords(ctx, records, ttl); err != nil {
 			h.logger.Warnf("Failed to cache records: %v", err)
 		}
-
-		// Add all records to the answer
-		for _, record := range records {
-			if err := h.addAnswerFromRecord(m, &record, q); err != nil {
-				h.logger.Warnf("Failed to add answer from record: %v", err)
-			}
-		}
-		return nil
+		return records, nil
 	}
 
 	// Try to get a single record for backward compatibility
 	record, err = h.mariadbClient.GetRecord(zone, name, recordType)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if record != nil {
@@ -151,11 +562,139 @@ func (h *DNSHandler) handleQuery(m *dns.Msg, q *dns.Question) error {
 		if err := h.redisClient.SetRecord(ctx, record, ttl); err != nil {
 			h.logger.Warnf("Failed to cache record: %v", err)
 		}
-
-		return h.addAnswerFromRecord(m, record, q)
+		return []models.Record{*record}, nil
 	}
 
 	// No record found
+	return nil, nil
+}
+
+// lookupDNAME returns the DNAME record owned by the closest ancestor of name
+// within zone, or nil if there is none
+func (h *DNSHandler) lookupDNAME(zone, name string) (*models.Record, error) {
+	for n := name; n != zone; {
+		i := strings.Index(n, ".")
+		if i < 0 {
+			break
+		}
+		n = n[i+1:]
+
+		records, err := h.lookupRecords(zone, n, models.TypeDNAME)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) > 0 {
+			return &records[0], nil
+		}
+	}
+	return nil, nil
+}
+
+// answerDNAME answers a question for a name below a DNAME with the DNAME and
+// a CNAME from the name to the same name below the DNAME's target, which it
+// returns
+func (h *DNSHandler) answerDNAME(m *dns.Msg, zone string, q *dns.Question, dname *models.Record, dnssecOK bool) (string, error) {
+	owner := dns.Fqdn(dname.Name)
+	rr, err := recordToRR(dname, owner)
+	if err != nil {
+		return "", err
+	}
+	m.Answer = append(m.Answer, rr)
+
+	// Substitute the DNAME's target for its owner in the query name. A
+	// result that is too long is not a valid name (RFC 6672 section 2.2).
+	target := q.Name[:len(q.Name)-len(owner)] + dns.Fqdn(dname.Content)
+	if _, ok := dns.IsDomainName(target); !ok || len(target) > 254 {
+		m.Rcode = dns.RcodeYXDomain
+		return "", h.finishAnswer(m, zone, q, "", dnssecOK)
+	}
+
+	if err := h.finishAnswer(m, zone, q, "", dnssecOK); err != nil {
+		return "", err
+	}
+
+	// Validators synthesize the CNAME from the signed DNAME themselves, so
+	// it is left unsigned (RFC 6672 section 5.3.1)
+	m.Answer = append(m.Answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: uint32(dname.TTL)},
+		Target: target,
+	})
+	return target, nil
+}
+
+// lookupWildcard looks for the wildcard that matches a name without records
+// of the given type (RFC 4592 section 3.3). It returns the wildcard, the
+// source of synthesis, and its records of the type, or "" if the name
+// exists or no wildcard matches it. A wildcard that exists without records
+// of the type yields a NODATA answer.
+func (h *DNSHandler) lookupWildcard(zone, name string, recordType models.RecordType) (string, []models.Record, error) {
+	ctx := context.Background()
+
+	records, err := h.redisClient.GetWildcardRecords(ctx, zone, name, recordType)
+	if err == nil && len(records) > 0 {
+		atomic.AddInt64(&h.stats.CacheHits, 1)
+		return records[0].Name, records, nil
+	}
+
+	// Wildcards never match names that exist, not even empty non-terminals
+	exists, err := h.mariadbClient.NameExists(zone, name)
+	if err != nil || exists || name == zone {
+		return "", nil, err
+	}
+
+	// Only the wildcard at the closest encloser can match, whether or not
+	// wildcards exist further up
+	ce := zone
+	for n := dns.Fqdn(name); ; {
+		n = parentName(n)
+		candidate := strings.TrimSuffix(n, ".")
+		if candidate == zone {
+			break
+		}
+		exists, err := h.mariadbClient.NameExists(zone, candidate)
+		if err != nil {
+			return "", nil, err
+		}
+		if exists {
+			ce = candidate
+			break
+		}
+	}
+
+	wildcard := "*." + ce
+	exists, err = h.mariadbClient.NameExists(zone, wildcard)
+	if err != nil || !exists {
+		return "", nil, err
+	}
+
+	records, err = h.lookupRecords(zone, wildcard, recordType)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(records) > 0 {
+		ttl := time.Duration(records[0].TTL) * time.Second
+		if err := h.redisClient.SetWildcardRecords(ctx, zone, name, records, ttl); err != nil {
+			h.logger.Warnf("Failed to cache wildcard answer: %v", err)
+		}
+	}
+	return wildcard, records, nil
+}
+
+// addNegativeSOA adds the zone SOA to the authority section of a negative
+// answer. Its TTL is capped by the SOA minimum field so that resolvers cache
+// the negative answer for at most that long (RFC 2308 section 3).
+func (h *DNSHandler) addNegativeSOA(m *dns.Msg, zone string) error {
+	soa, err := h.zoneSOA(zone)
+	if err != nil || soa == nil {
+		return err
+	}
+
+	if soa.Hdr.Ttl > soa.Minttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	m.Ns = append(m.Ns, soa)
+
 	return nil
 }
 
@@ -182,161 +721,11 @@ func (h *DNSHandler) findZone(name string) (string, error) {
 
 // addAnswerFromRecord adds a DNS answer from a record
 func (h *DNSHandler) addAnswerFromRecord(m *dns.Msg, record *models.Record, q *dns.Question) error {
-	switch record.Type {
-	case models.TypeA:
-		rr := &dns.A{
-			Hdr: dns.RR_Header{
-				Name:   q.Name,
-				Rrtype: dns.TypeA,
-				Class:  dns.ClassINET,
-				Ttl:    uint32(record.TTL),
-			},
-			A: net.ParseIP(record.Content),
-		}
-		m.Answer = append(m.Answer, rr)
-
-	case models.TypeAAAA:
-		rr := &dns.AAAA{
-			Hdr: dns.RR_Header{
-				Name:   q.Name,
-				Rrtype: dns.TypeAAAA,
-				Class:  dns.ClassINET,
-				Ttl:    uint32(record.TTL),
-			},
-			AAAA: net.ParseIP(record.Content),
-		}
-		m.Answer = append(m.Answer, rr)
-
-	case models.TypeCNAME:
-		rr := &dns.CNAME{
-			Hdr: dns.RR_Header{
-				Name:   q.Name,
-				Rrtype: dns.TypeCNAME,
-				Class:  dns.ClassINET,
-				Ttl:    uint32(record.TTL),
-			},
-			Target: dns.Fqdn(record.Content),
-		}
-		m.Answer = append(m.Answer, rr)
-
-	case models.TypeMX:
-		rr := &dns.MX{
-			Hdr: dns.RR_Header{
-				Name:   q.Name,
-				Rrtype: dns.TypeMX,
-				Class:  dns.ClassINET,
-				Ttl:    uint32(record.TTL),
-			},
-			Preference: uint16(record.Priority),
-			Mx:         dns.Fqdn(record.Content),
-		}
-		m.Answer = append(m.Answer, rr)
-
-	case models.TypeNS:
-		rr := &dns.NS{
-			Hdr: dns.RR_Header{
-				Name:   q.Name,
-				Rrtype: dns.TypeNS,
-				Class:  dns.ClassINET,
-				Ttl:    uint32(record.TTL),
-			},
-			Ns: dns.Fqdn(record.Content),
-		}
-		m.Answer = append(m.Answer, rr)
-
-	case models.TypePTR:
-		rr := &dns.PTR{
-			Hdr: dns.RR_Header{
-				Name:   q.Name,
-				Rrtype: dns.TypePTR,
-				Class:  dns.ClassINET,
-				Ttl:    uint32(record.TTL),
-			},
-			Ptr: dns.Fqdn(record.Content),
-		}
-		m.Answer = append(m.Answer, rr)
-
-	case models.TypeTXT:
-		rr := &dns.TXT{
-			Hdr: dns.RR_Header{
-				Name:   q.Name,
-				Rrtype: dns.TypeTXT,
-				Class:  dns.ClassINET,
-				Ttl:    uint32(record.TTL),
-			},
-			Txt: []string{record.Content},
-		}
-		m.Answer = append(m.Answer, rr)
-
-	case models.TypeSOA:
-		// Parse SOA record content
-		var soaData models.SOARecord
-		if err := json.Unmarshal([]byte(record.Content), &soaData); err != nil {
-			return fmt.Errorf("failed to parse SOA record: %w", err)
-		}
-
-		rr := &dns.SOA{
-			Hdr: dns.RR_Header{
-				Name:   q.Name,
-				Rrtype: dns.TypeSOA,
-				Class:  dns.ClassINET,
-				Ttl:    uint32(record.TTL),
-			},
-			Ns:      dns.Fqdn(soaData.Mname),
-			Mbox:    dns.Fqdn(soaData.Rname),
-			Serial:  soaData.Serial,
-			Refresh: soaData.Refresh,
-			Retry:   soaData.Retry,
-			Expire:  soaData.Expire,
-			Minttl:  soaData.Minimum,
-		}
-		m.Answer = append(m.Answer, rr)
-
-	case models.TypeSRV:
-		// Parse SRV record content
-		var srv models.SRVRecord
-		if err := json.Unmarshal([]byte(record.Content), &srv); err != nil {
-			return fmt.Errorf("failed to parse SRV record: %w", err)
-		}
-
-		rr := &dns.SRV{
-			Hdr: dns.RR_Header{
-				Name:   q.Name,
-				Rrtype: dns.TypeSRV,
-				Class:  dns.ClassINET,
-				Ttl:    uint32(record.TTL),
-			},
-			Priority: srv.Priority,
-			Weight:   srv.Weight,
-			Port:     srv.Port,
-			Target:   dns.Fqdn(srv.Target),
-		}
-		m.Answer = append(m.Answer, rr)
-
-	case models.TypeCAA:
-		// Parse CAA record content
-		var caa models.CAARecord
-		if err := json.Unmarshal([]byte(record.Content), &caa); err != nil {
-			return fmt.Errorf("failed to parse CAA record: %w", err)
-		}
-
-		rr := &dns.CAA{
-			Hdr: dns.RR_Header{
-				Name:   q.Name,
-				Rrtype: dns.TypeCAA,
-				Class:  dns.ClassINET,
-				Ttl:    uint32(record.TTL),
-			},
-			Flag:  caa.Flag,
-			Tag:   caa.Tag,
-			Value: caa.Value,
-		}
-		m.Answer = append(m.Answer, rr)
-
-	default:
-		return fmt.Errorf("unsupported record type: %s", record.Type)
+	rr, err := recordToRR(record, q.Name)
+	if err != nil {
+		return err
 	}
-
+	m.Answer = append(m.Answer, rr)
 	return nil
 }
 
@@ -0,0 +1,2394 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PooriaJ/RediDNS/config"
+	"github.com/PooriaJ/RediDNS/models"
+	"github.com/PooriaJ/RediDNS/util"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeResponseWriter captures the message written by the handler
+type fakeResponseWriter struct {
+	remote     net.Addr
+	msg        *dns.Msg
+	msgs       []*dns.Msg
+	wire       []byte
+	tsigStatus error // Result of verifying the request's TSIG
+}
+
+func newUDPWriter() *fakeResponseWriter {
+	return &fakeResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+}
+
+func newTCPWriter() *fakeResponseWriter {
+	return &fakeResponseWriter{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+}
+
+func (w *fakeResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+}
+func (w *fakeResponseWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *fakeResponseWriter) Write(b []byte) (int, error) {
+	w.wire = b
+	return len(b), nil
+}
+func (w *fakeResponseWriter) WriteMsg(m *dns.Msg) error {
+	wire, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	w.wire = wire
+	w.msg = new(dns.Msg)
+	w.msgs = append(w.msgs, w.msg)
+	return w.msg.Unpack(wire)
+}
+func (w *fakeResponseWriter) Close() error        { return nil }
+func (w *fakeResponseWriter) TsigStatus() error   { return w.tsigStatus }
+func (w *fakeResponseWriter) TsigTimersOnly(bool) {}
+func (w *fakeResponseWriter) Hijack()             {}
+
+// fakeStore is an in-memory recordStore
+type fakeStore struct {
+	zones   map[string]*models.Zone
+	records []models.Record
+	journal []models.JournalEntry
+	keys    []models.DNSSECKey
+}
+
+func (s *fakeStore) GetZone(name string) (*models.Zone, error) {
+	return s.zones[name], nil
+}
+
+func (s *fakeStore) GetRecord(zone, name string, recordType models.RecordType) (*models.Record, error) {
+	records, _ := s.GetRecordsByNameAndType(zone, name, recordType)
+	if len(records) == 0 {
+		return nil, nil
+	}
+	return &records[0], nil
+}
+
+func (s *fakeStore) GetRecordsByNameAndType(zone, name string, recordType models.RecordType) ([]models.Record, error) {
+	var records []models.Record
+	for _, record := range s.records {
+		if record.Zone == zone && record.Name == name && record.Type == recordType {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (s *fakeStore) GetRecordsByZone(zone string) ([]models.Record, error) {
+	var records []models.Record
+	for _, record := range s.records {
+		if record.Zone == zone {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (s *fakeStore) GetZoneJournal(zone string) ([]models.JournalEntry, error) {
+	return s.journal, nil
+}
+
+func (s *fakeStore) NameExists(zone, name string) (bool, error) {
+	for _, record := range s.records {
+		if record.Zone == zone && (record.Name == name || strings.HasSuffix(record.Name, "."+name)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *fakeStore) GetRecordTypesByName(zone, name string) ([]models.RecordType, error) {
+	var types []models.RecordType
+	seen := make(map[models.RecordType]bool)
+	for _, record := range s.records {
+		if record.Zone == zone && record.Name == name && !seen[record.Type] {
+			seen[record.Type] = true
+			types = append(types, record.Type)
+		}
+	}
+	return types, nil
+}
+
+func (s *fakeStore) GetDNSSECKeys(zone string) ([]models.DNSSECKey, error) {
+	var keys []models.DNSSECKey
+	for _, key := range s.keys {
+		if key.Zone == zone {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *fakeStore) UpdateZoneRecords(zone string, keep int, update func(records []models.Record) (removed, added []models.Record, err error)) (*models.Record, error) {
+	var nextID int64
+	for _, record := range s.records {
+		nextID = max(nextID, record.ID)
+	}
+	for i := range s.records {
+		if s.records[i].ID == 0 {
+			nextID++
+			s.records[i].ID = nextID
+		}
+	}
+
+	records, _ := s.GetRecordsByZone(zone)
+	removed, added, err := update(records)
+	if err != nil || len(removed) == 0 && len(added) == 0 {
+		return nil, err
+	}
+
+	s.records = slices.DeleteFunc(s.records, func(record models.Record) bool {
+		return slices.ContainsFunc(removed, func(r models.Record) bool { return r.ID == record.ID })
+	})
+	for _, record := range added {
+		nextID++
+		record.ID = nextID
+		s.records = append(s.records, record)
+	}
+
+	for i, record := range s.records {
+		if record.Zone == zone && record.Type == models.TypeSOA {
+			var soa models.SOARecord
+			json.Unmarshal([]byte(record.Content), &soa)
+			soa.Serial++
+			content, _ := json.Marshal(soa)
+			s.records[i].Content = string(content)
+			return &s.records[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// fakeCache is a recordCache that never hits
+type fakeCache struct{}
+
+func (fakeCache) GetRecordsByNameAndType(ctx context.Context, zone, name string, recordType models.RecordType) ([]models.Record, error) {
+	return nil, nil
+}
+func (fakeCache) GetRecord(ctx context.Context, zone, name string, recordType models.RecordType) (*models.Record, error) {
+	return nil, nil
+}
+func (fakeCache) SetRecords(ctx context.Context, records []models.Record, ttl time.Duration) error {
+	return nil
+}
+func (fakeCache) SetRecord(ctx context.Context, record *models.Record, ttl time.Duration) error {
+	return nil
+}
+func (fakeCache) GetSignatures(ctx context.Context, zone, name string, recordType models.RecordType) (*models.SignatureSet, error) {
+	return nil, nil
+}
+func (fakeCache) SetSignatures(ctx context.Context, sigs *models.SignatureSet, ttl time.Duration) error {
+	return nil
+}
+func (fakeCache) GetWildcardRecords(ctx context.Context, zone, name string, recordType models.RecordType) ([]models.Record, error) {
+	return nil, nil
+}
+func (fakeCache) SetWildcardRecords(ctx context.Context, zone, name string, records []models.Record, ttl time.Duration) error {
+	return nil
+}
+func (fakeCache) GetAliasAnswer(ctx context.Context, target string, recordType models.RecordType) (*models.AliasAnswer, error) {
+	return nil, nil
+}
+func (fakeCache) SetAliasAnswer(ctx context.Context, answer *models.AliasAnswer, ttl time.Duration) error {
+	return nil
+}
+func (fakeCache) PublishRecordUpdate(ctx context.Context, record *models.Record) error {
+	return nil
+}
+func (fakeCache) PublishZoneUpdate(ctx context.Context, update *models.ZoneUpdate) error {
+	return nil
+}
+
+// newTestHandler returns a handler serving example.com with the given records
+func newTestHandler(records ...models.Record) *DNSHandler {
+	cfg := &config.Config{}
+	cfg.DNS.EDNS.UDPSize = 1232
+	cfg.DNS.DNSSEC.SignatureValidity = 86400
+	cfg.DNS.DNSSEC.DNSKEYTTL = 3600
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	store := &fakeStore{
+		zones:   map[string]*models.Zone{"example.com": {Name: "example.com"}},
+		records: records,
+	}
+
+	return &DNSHandler{
+		cfg:           cfg,
+		redisClient:   fakeCache{},
+		mariadbClient: store,
+		logger:        logger,
+		stats:         &DNSStats{},
+	}
+}
+
+// soaRecord returns the example.com SOA record with the given TTL and minimum
+func soaRecord(ttl int, minimum uint32) models.Record {
+	return soaRecordWithSerial(ttl, minimum, 1)
+}
+
+// soaRecordWithSerial returns the example.com SOA record with the given serial
+func soaRecordWithSerial(ttl int, minimum, serial uint32) models.Record {
+	return models.Record{
+		Zone:    "example.com",
+		Name:    "example.com",
+		Type:    models.TypeSOA,
+		Content: fmt.Sprintf(`{"mname":"ns1.example.com","rname":"hostmaster.example.com","serial":%d,"refresh":7200,"retry":3600,"expire":1209600,"minimum":%d}`, serial, minimum),
+		TTL:     ttl,
+	}
+}
+
+// txtRecords returns n TXT records of 100 bytes each at name
+func txtRecords(name string, n int) []models.Record {
+	var records []models.Record
+	for i := 0; i < n; i++ {
+		records = append(records, models.Record{
+			Zone:    "example.com",
+			Name:    name,
+			Type:    models.TypeTXT,
+			Content: fmt.Sprintf("%03d%s", i, strings.Repeat("x", 97)),
+			TTL:     300,
+		})
+	}
+	return records
+}
+
+func newQuery(name string, qtype uint16) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), qtype)
+	return r
+}
+
+func TestServeDNSWithoutEDNS(t *testing.T) {
+	h := newTestHandler(txtRecords("txt.example.com", 1)...)
+	w := newUDPWriter()
+
+	h.ServeDNS(w, newQuery("txt.example.com", dns.TypeTXT))
+
+	if w.msg.IsEdns0() != nil {
+		t.Fatalf("response has OPT record for a query without EDNS0")
+	}
+	if len(w.msg.Answer) != 1 {
+		t.Fatalf("got %d answers, want 1", len(w.msg.Answer))
+	}
+}
+
+func TestServeDNSEchoesEDNS(t *testing.T) {
+	h := newTestHandler(txtRecords("txt.example.com", 1)...)
+	w := newUDPWriter()
+
+	r := newQuery("txt.example.com", dns.TypeTXT)
+	r.SetEdns0(4096, true)
+	h.ServeDNS(w, r)
+
+	opt := w.msg.IsEdns0()
+	if opt == nil {
+		t.Fatalf("response has no OPT record")
+	}
+	if opt.UDPSize() != 1232 {
+		t.Errorf("advertised UDP size = %d, want 1232", opt.UDPSize())
+	}
+	if !opt.Do() {
+		t.Errorf("DO bit not echoed")
+	}
+	if opt.Version() != 0 {
+		t.Errorf("EDNS version = %d, want 0", opt.Version())
+	}
+}
+
+func TestServeDNSBadVersion(t *testing.T) {
+	h := newTestHandler(txtRecords("txt.example.com", 1)...)
+	w := newUDPWriter()
+
+	r := newQuery("txt.example.com", dns.TypeTXT)
+	r.SetEdns0(4096, false)
+	r.IsEdns0().SetVersion(1)
+	h.ServeDNS(w, r)
+
+	if w.msg.Rcode != dns.RcodeBadVers {
+		t.Fatalf("rcode = %s, want BADVERS", dns.RcodeToString[w.msg.Rcode])
+	}
+	opt := w.msg.IsEdns0()
+	if opt == nil {
+		t.Fatalf("BADVERS response has no OPT record")
+	}
+	if opt.Version() != 0 {
+		t.Errorf("EDNS version = %d, want 0", opt.Version())
+	}
+	if len(w.msg.Answer) != 0 {
+		t.Errorf("BADVERS response has %d answers", len(w.msg.Answer))
+	}
+}
+
+func TestServeDNSTruncatesUDPWithoutEDNS(t *testing.T) {
+	h := newTestHandler(txtRecords("txt.example.com", 10)...)
+	w := newUDPWriter()
+
+	h.ServeDNS(w, newQuery("txt.example.com", dns.TypeTXT))
+
+	if !w.msg.Truncated {
+		t.Fatalf("TC bit not set")
+	}
+	if len(w.wire) > dns.MinMsgSize {
+		t.Errorf("response is %d bytes, want at most %d", len(w.wire), dns.MinMsgSize)
+	}
+}
+
+func TestServeDNSTruncatesToNegotiatedSize(t *testing.T) {
+	h := newTestHandler(txtRecords("txt.example.com", 10)...)
+
+	// 10 records fit in the client's buffer
+	w := newUDPWriter()
+	r := newQuery("txt.example.com", dns.TypeTXT)
+	r.SetEdns0(1232, false)
+	h.ServeDNS(w, r)
+
+	if w.msg.Truncated {
+		t.Errorf("TC bit set for a response that fits")
+	}
+	if len(w.msg.Answer) != 10 {
+		t.Errorf("got %d answers, want 10", len(w.msg.Answer))
+	}
+
+	// The client's buffer is honoured but capped by our own
+	h = newTestHandler(txtRecords("txt.example.com", 20)...)
+	w = newUDPWriter()
+	r = newQuery("txt.example.com", dns.TypeTXT)
+	r.SetEdns0(4096, false)
+	h.ServeDNS(w, r)
+
+	if !w.msg.Truncated {
+		t.Errorf("TC bit not set")
+	}
+	if len(w.wire) > 1232 {
+		t.Errorf("response is %d bytes, want at most 1232", len(w.wire))
+	}
+	if w.msg.IsEdns0() == nil {
+		t.Errorf("truncated response lost its OPT record")
+	}
+}
+
+func TestServeDNSDoesNotTruncateTCP(t *testing.T) {
+	h := newTestHandler(txtRecords("txt.example.com", 20)...)
+	w := newTCPWriter()
+
+	h.ServeDNS(w, newQuery("txt.example.com", dns.TypeTXT))
+
+	if w.msg.Truncated {
+		t.Errorf("TC bit set over TCP")
+	}
+	if len(w.msg.Answer) != 20 {
+		t.Errorf("got %d answers, want 20", len(w.msg.Answer))
+	}
+}
+
+func TestServeDNSNXDomain(t *testing.T) {
+	h := newTestHandler(soaRecord(86400, 180))
+	w := newUDPWriter()
+
+	h.ServeDNS(w, newQuery("missing.example.com", dns.TypeA))
+
+	if w.msg.Rcode != dns.RcodeNameError {
+		t.Fatalf("rcode = %s, want NXDOMAIN", dns.RcodeToString[w.msg.Rcode])
+	}
+	if !w.msg.Authoritative {
+		t.Errorf("AA bit not set")
+	}
+	if len(w.msg.Ns) != 1 {
+		t.Fatalf("got %d authority records, want 1", len(w.msg.Ns))
+	}
+	soa, ok := w.msg.Ns[0].(*dns.SOA)
+	if !ok {
+		t.Fatalf("authority record is %s, want SOA", dns.TypeToString[w.msg.Ns[0].Header().Rrtype])
+	}
+	if soa.Hdr.Name != "example.com." {
+		t.Errorf("SOA owner = %s, want example.com.", soa.Hdr.Name)
+	}
+	if soa.Hdr.Ttl != 180 {
+		t.Errorf("SOA TTL = %d, want it capped to the minimum 180", soa.Hdr.Ttl)
+	}
+}
+
+func TestServeDNSNoData(t *testing.T) {
+	records := append(txtRecords("txt.example.com", 1), soaRecord(60, 180))
+	h := newTestHandler(records...)
+	w := newUDPWriter()
+
+	h.ServeDNS(w, newQuery("txt.example.com", dns.TypeA))
+
+	if w.msg.Rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode = %s, want NOERROR", dns.RcodeToString[w.msg.Rcode])
+	}
+	if len(w.msg.Answer) != 0 {
+		t.Errorf("got %d answers, want 0", len(w.msg.Answer))
+	}
+	if len(w.msg.Ns) != 1 || w.msg.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("authority section = %v, want the zone SOA", w.msg.Ns)
+	}
+	if ttl := w.msg.Ns[0].Header().Ttl; ttl != 60 {
+		t.Errorf("SOA TTL = %d, want the record TTL 60", ttl)
+	}
+}
+
+func TestServeDNSEmptyNonTerminal(t *testing.T) {
+	records := append(txtRecords("a.b.example.com", 1), soaRecord(86400, 180))
+	h := newTestHandler(records...)
+	w := newUDPWriter()
+
+	h.ServeDNS(w, newQuery("b.example.com", dns.TypeA))
+
+	if w.msg.Rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode = %s, want NOERROR", dns.RcodeToString[w.msg.Rcode])
+	}
+}
+
+func TestServeDNSRefusesUnhostedNames(t *testing.T) {
+	h := newTestHandler(soaRecord(86400, 180))
+	w := newUDPWriter()
+
+	h.ServeDNS(w, newQuery("www.example.org", dns.TypeA))
+
+	if w.msg.Rcode != dns.RcodeRefused {
+		t.Fatalf("rcode = %s, want REFUSED", dns.RcodeToString[w.msg.Rcode])
+	}
+	if w.msg.Authoritative {
+		t.Errorf("AA bit set for an unhosted name")
+	}
+	if h.GetStats().Refused != 1 {
+		t.Errorf("refused counter = %d, want 1", h.GetStats().Refused)
+	}
+
+	// Listeners can opt into a non-authoritative NXDOMAIN instead
+	w = newUDPWriter()
+	h.forListener(listenerOptions{}).ServeDNS(w, newQuery("www.example.org", dns.TypeA))
+
+	if w.msg.Rcode != dns.RcodeNameError {
+		t.Fatalf("rcode = %s, want NXDOMAIN", dns.RcodeToString[w.msg.Rcode])
+	}
+	if w.msg.Authoritative {
+		t.Errorf("AA bit set for an unhosted name")
+	}
+}
+
+func TestServeDNSAXFR(t *testing.T) {
+	records := append(txtRecords("txt.example.com", 300), soaRecord(86400, 180))
+	h := newTestHandler(records...)
+	store := h.mariadbClient.(*fakeStore)
+
+	// Transfers are refused unless the client is on the allow-list
+	w := newTCPWriter()
+	h.ServeDNS(w, newQuery("example.com", dns.TypeAXFR))
+	if w.msg.Rcode != dns.RcodeRefused {
+		t.Fatalf("rcode = %s, want REFUSED", dns.RcodeToString[w.msg.Rcode])
+	}
+
+	store.zones["example.com"].AllowTransfer = []string{"192.0.2.0/24"}
+
+	// and over UDP
+	w = newUDPWriter()
+	h.ServeDNS(w, newQuery("example.com", dns.TypeAXFR))
+	if w.msg.Rcode != dns.RcodeRefused {
+		t.Fatalf("rcode over UDP = %s, want REFUSED", dns.RcodeToString[w.msg.Rcode])
+	}
+
+	w = newTCPWriter()
+	h.ServeDNS(w, newQuery("example.com", dns.TypeAXFR))
+
+	if len(w.msgs) < 2 {
+		t.Fatalf("got %d messages, want the zone split over several", len(w.msgs))
+	}
+	var rrs []dns.RR
+	for _, m := range w.msgs {
+		if m.Rcode != dns.RcodeSuccess {
+			t.Fatalf("rcode = %s, want NOERROR", dns.RcodeToString[m.Rcode])
+		}
+		rrs = append(rrs, m.Answer...)
+	}
+	if len(rrs) != 302 {
+		t.Fatalf("got %d records, want 302", len(rrs))
+	}
+	if rrs[0].Header().Rrtype != dns.TypeSOA || rrs[len(rrs)-1].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("transfer is not framed by the SOA")
+	}
+}
+
+// newIXFR returns an IXFR query from a client at the given serial
+func newIXFR(serial uint32) *dns.Msg {
+	r := newQuery("example.com", dns.TypeIXFR)
+	r.Ns = []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET},
+		Ns:     "ns1.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Serial: serial,
+	}}
+	return r
+}
+
+func TestServeDNSIXFR(t *testing.T) {
+	a := models.Record{Zone: "example.com", Name: "a.example.com", Type: models.TypeA, Content: "192.0.2.10", TTL: 300}
+	b := models.Record{Zone: "example.com", Name: "b.example.com", Type: models.TypeA, Content: "192.0.2.11", TTL: 300}
+	h := newTestHandler(soaRecordWithSerial(86400, 180, 12), b)
+	store := h.mariadbClient.(*fakeStore)
+	store.zones["example.com"].AllowTransfer = []string{"192.0.2.1"}
+	store.journal = []models.JournalEntry{
+		{Zone: "example.com", SerialFrom: 10, SerialTo: 11, Added: []models.Record{a}},
+		{Zone: "example.com", SerialFrom: 11, SerialTo: 12, Removed: []models.Record{a}, Added: []models.Record{b}},
+	}
+
+	w := newTCPWriter()
+	h.ServeDNS(w, newIXFR(10))
+
+	var got []string
+	for _, rr := range w.msg.Answer {
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			got = append(got, fmt.Sprintf("SOA %d", rr.Serial))
+		case *dns.A:
+			got = append(got, "A "+rr.A.String())
+		}
+	}
+	want := []string{"SOA 12", "SOA 10", "SOA 11", "A 192.0.2.10", "SOA 11", "A 192.0.2.10", "SOA 12", "A 192.0.2.11", "SOA 12"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("IXFR = %v, want %v", got, want)
+	}
+
+	// An up to date client only gets the SOA
+	w = newTCPWriter()
+	h.ServeDNS(w, newIXFR(12))
+	if len(w.msg.Answer) != 1 || w.msg.Answer[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("up to date IXFR = %v, want the SOA only", w.msg.Answer)
+	}
+
+	// A serial the journal no longer covers falls back to a full transfer
+	w = newTCPWriter()
+	h.ServeDNS(w, newIXFR(5))
+	if len(w.msg.Answer) != 3 || w.msg.Answer[1].Header().Rrtype != dns.TypeA {
+		t.Errorf("fallback IXFR = %v, want the whole zone", w.msg.Answer)
+	}
+}
+
+func TestServeDNSNotify(t *testing.T) {
+	h := newTestHandler(soaRecord(86400, 180))
+	store := h.mariadbClient.(*fakeStore)
+
+	newNotify := func() *dns.Msg {
+		r := new(dns.Msg)
+		r.SetNotify("example.com.")
+		return r
+	}
+
+	// example.com is a primary zone here
+	w := newUDPWriter()
+	h.ServeDNS(w, newNotify())
+	if w.msg.Rcode != dns.RcodeNotAuth {
+		t.Fatalf("rcode for primary zone = %s, want NOTAUTH", dns.RcodeToString[w.msg.Rcode])
+	}
+
+	store.zones["example.com"].Kind = models.ZoneSecondary
+	store.zones["example.com"].Primaries = []string{"192.0.2.2"}
+
+	w = newUDPWriter()
+	h.ServeDNS(w, newNotify())
+	if w.msg.Rcode != dns.RcodeRefused {
+		t.Fatalf("rcode from non-primary = %s, want REFUSED", dns.RcodeToString[w.msg.Rcode])
+	}
+
+	store.zones["example.com"].Primaries = []string{"192.0.2.1:5353"}
+
+	w = newUDPWriter()
+	h.ServeDNS(w, newNotify())
+	if w.msg.Rcode != dns.RcodeSuccess || w.msg.Opcode != dns.OpcodeNotify || !w.msg.Authoritative {
+		t.Errorf("NOTIFY from primary = %s/%s aa=%v, want an authoritative NOTIFY/NOERROR",
+			dns.OpcodeToString[w.msg.Opcode], dns.RcodeToString[w.msg.Rcode], w.msg.Authoritative)
+	}
+
+	// Other opcodes are not implemented
+	r := newQuery("example.com", dns.TypeSOA)
+	r.Opcode = dns.OpcodeStatus
+	w = newUDPWriter()
+	h.ServeDNS(w, r)
+	if w.msg.Rcode != dns.RcodeNotImplemented {
+		t.Errorf("rcode for STATUS = %s, want NOTIMP", dns.RcodeToString[w.msg.Rcode])
+	}
+}
+
+func TestServeDNSExpiredSecondary(t *testing.T) {
+	h := newTestHandler(soaRecord(86400, 180))
+
+	z := &secondaryZone{name: "example.com"}
+	z.expired.Store(true)
+	h.secondaries = &secondaryManager{zones: map[string]*secondaryZone{"example.com": z}}
+
+	w := newUDPWriter()
+	h.ServeDNS(w, newQuery("example.com", dns.TypeSOA))
+	if w.msg.Rcode != dns.RcodeServerFailure || len(w.msg.Answer) != 0 {
+		t.Errorf("expired zone answered %s with %d records, want SERVFAIL", dns.RcodeToString[w.msg.Rcode], len(w.msg.Answer))
+	}
+}
+
+func TestSecondaryPastExpiry(t *testing.T) {
+	soa := &dns.SOA{Expire: 3600}
+	tests := []struct {
+		lastRefresh time.Time
+		want        bool
+	}{
+		{time.Now(), false},
+		{time.Now().Add(-59 * time.Minute), false},
+		{time.Now().Add(-61 * time.Minute), true},
+	}
+	for _, tt := range tests {
+		if got := pastExpiry(soa, tt.lastRefresh); got != tt.want {
+			t.Errorf("pastExpiry(%s ago) = %t, want %t", time.Since(tt.lastRefresh).Round(time.Minute), got, tt.want)
+		}
+	}
+}
+
+func TestIncrementalChanges(t *testing.T) {
+	s := &secondaryManager{logger: logrus.New()}
+	soa := func(serial int) string {
+		return fmt.Sprintf("example.com. 3600 IN SOA ns1.example.com. admin.example.com. %d 3600 600 604800 300", serial)
+	}
+	parse := func(lines ...string) []dns.RR {
+		var rrs []dns.RR
+		for _, line := range lines {
+			rr, err := dns.NewRR(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rrs = append(rrs, rr)
+		}
+		return rrs
+	}
+	oldA := "www.example.com. 300 IN A 192.0.2.10"
+	newA := "www.example.com. 300 IN A 192.0.2.11"
+	mail := "mail.example.com. 300 IN A 192.0.2.25"
+
+	tests := []struct {
+		name    string
+		rrs     []dns.RR
+		changes int
+		wantErr bool
+	}{
+		{"two sequences", parse(soa(3), soa(1), oldA, soa(2), newA, soa(2), soa(3), mail, soa(3)), 2, false},
+		{"deletions only", parse(soa(2), soa(1), oldA, soa(2), soa(2)), 1, false},
+		{"gap between sequences", parse(soa(4), soa(1), oldA, soa(2), newA, soa(3), soa(4), mail, soa(4)), 0, true},
+		{"not starting at our serial", parse(soa(3), soa(2), oldA, soa(3), newA, soa(3)), 0, true},
+		{"ending short of the new serial", parse(soa(3), soa(1), oldA, soa(2), newA, soa(3)), 0, true},
+		{"without closing SOA", parse(soa(2), soa(1), oldA, soa(2), newA), 0, true},
+		{"truncated", parse(soa(2), soa(1), oldA), 0, true},
+	}
+	for _, tt := range tests {
+		changes, err := s.incrementalChanges("example.com", 1, tt.rrs)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %d changes, want an error", tt.name, len(changes))
+			}
+			continue
+		}
+		if err != nil || len(changes) != tt.changes {
+			t.Errorf("%s: got %d changes, %v, want %d", tt.name, len(changes), err, tt.changes)
+		}
+	}
+
+	changes, _ := s.incrementalChanges("example.com", 1, tests[0].rrs)
+	first, second := changes[0], changes[1]
+	if first.SerialFrom != 1 || first.SerialTo != 2 || len(first.Removed) != 1 || first.Added[0].Content != "192.0.2.11" {
+		t.Errorf("first change = %+v", first)
+	}
+	if second.SerialFrom != 2 || second.SerialTo != 3 || len(second.Removed) != 0 || second.Added[0].Name != "mail.example.com" {
+		t.Errorf("second change = %+v", second)
+	}
+}
+
+// signTestZone gives example.com a KSK and a ZSK and returns their DNSKEYs
+func signTestZone(t *testing.T, h *DNSHandler) (ksk, zsk *dns.DNSKEY) {
+	store := h.mariadbClient.(*fakeStore)
+	for i, role := range []models.KeyRole{models.KeyRoleKSK, models.KeyRoleZSK} {
+		key, err := util.GenerateDNSSECKey("example.com", role)
+		if err != nil {
+			t.Fatalf("GenerateDNSSECKey: %v", err)
+		}
+		key.ID = int64(i + 1)
+		key.State = models.KeyActive
+		store.keys = append(store.keys, *key)
+	}
+	h.invalidateKeys("example.com")
+	return util.DNSKEY(&store.keys[0]), util.DNSKEY(&store.keys[1])
+}
+
+// newDNSSECQuery returns a query with the DO bit set
+func newDNSSECQuery(name string, qtype uint16) *dns.Msg {
+	r := newQuery(name, qtype)
+	r.SetEdns0(4096, true)
+	return r
+}
+
+// verifyRRSIGs checks that section holds rrtype records followed by a valid
+// signature of them made with key
+func verifyRRSIGs(t *testing.T, section []dns.RR, rrtype uint16, key *dns.DNSKEY) {
+	t.Helper()
+
+	var rrset []dns.RR
+	var sig *dns.RRSIG
+	for _, rr := range section {
+		switch {
+		case rr.Header().Rrtype == rrtype:
+			rrset = append(rrset, rr)
+		case rr.Header().Rrtype == dns.TypeRRSIG && rr.(*dns.RRSIG).TypeCovered == rrtype:
+			sig = rr.(*dns.RRSIG)
+		}
+	}
+	if len(rrset) == 0 || sig == nil {
+		t.Fatalf("no signed %s RRset in %v", dns.TypeToString[rrtype], section)
+	}
+	if sig.KeyTag != key.KeyTag() {
+		t.Errorf("%s signed by key %d, want %d", dns.TypeToString[rrtype], sig.KeyTag, key.KeyTag())
+	}
+	if err := sig.Verify(key, rrset); err != nil {
+		t.Errorf("RRSIG over %s does not verify: %v", dns.TypeToString[rrtype], err)
+	}
+	if !sig.ValidityPeriod(time.Now()) {
+		t.Errorf("RRSIG over %s is not currently valid", dns.TypeToString[rrtype])
+	}
+}
+
+func TestServeDNSSigned(t *testing.T) {
+	h := newTestHandler(append(txtRecords("txt.example.com", 2), soaRecord(86400, 180))...)
+	ksk, zsk := signTestZone(t, h)
+
+	// Without the DO bit the answer is unsigned
+	w := newUDPWriter()
+	h.ServeDNS(w, newQuery("txt.example.com", dns.TypeTXT))
+	if len(w.msg.Answer) != 2 {
+		t.Fatalf("unsigned answer = %v, want the two TXT records only", w.msg.Answer)
+	}
+
+	w = newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("txt.example.com", dns.TypeTXT))
+	verifyRRSIGs(t, w.msg.Answer, dns.TypeTXT, zsk)
+
+	// The DNSKEY RRset is signed by the KSK
+	w = newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("example.com", dns.TypeDNSKEY))
+	if n := len(w.msg.Answer); n != 3 {
+		t.Fatalf("DNSKEY answer has %d records, want two keys and a signature", n)
+	}
+	verifyRRSIGs(t, w.msg.Answer, dns.TypeDNSKEY, ksk)
+
+	// Negative answers carry a signed SOA
+	w = newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("txt.example.com", dns.TypeA))
+	verifyRRSIGs(t, w.msg.Ns, dns.TypeSOA, zsk)
+}
+
+// denialRecords returns the NSEC or NSEC3 records of a section
+func denialRecords(section []dns.RR) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range section {
+		switch rr.Header().Rrtype {
+		case dns.TypeNSEC, dns.TypeNSEC3:
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+func TestServeDNSNSEC(t *testing.T) {
+	records := append(txtRecords("b.sub.example.com", 1), soaRecord(86400, 180))
+	h := newTestHandler(records...)
+	_, zsk := signTestZone(t, h)
+
+	// NXDOMAIN: c.example.com sorts between the apex and b.sub.example.com,
+	// as does the wildcard *.example.com
+	w := newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("c.example.com", dns.TypeA))
+	if w.msg.Rcode != dns.RcodeNameError {
+		t.Fatalf("rcode = %s, want NXDOMAIN", dns.RcodeToString[w.msg.Rcode])
+	}
+	nsecs := denialRecords(w.msg.Ns)
+	if len(nsecs) != 1 {
+		t.Fatalf("got %v, want a single NSEC", nsecs)
+	}
+	nsec := nsecs[0].(*dns.NSEC)
+	if nsec.Hdr.Name != "example.com." || nsec.NextDomain != "b.sub.example.com." {
+		t.Errorf("NSEC = %s, want example.com. -> b.sub.example.com.", nsec)
+	}
+	if nsec.Hdr.Ttl != 180 {
+		t.Errorf("NSEC TTL = %d, want the negative TTL 180", nsec.Hdr.Ttl)
+	}
+	verifyRRSIGs(t, w.msg.Ns, dns.TypeNSEC, zsk)
+
+	// NODATA at an existing name: the matching NSEC without the type
+	w = newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("b.sub.example.com", dns.TypeA))
+	nsecs = denialRecords(w.msg.Ns)
+	if len(nsecs) != 1 || nsecs[0].Header().Name != "b.sub.example.com." {
+		t.Fatalf("NODATA proof = %v, want the NSEC of b.sub.example.com.", nsecs)
+	}
+	types := nsecs[0].(*dns.NSEC).TypeBitMap
+	if fmt.Sprint(types) != fmt.Sprint([]uint16{dns.TypeTXT, dns.TypeRRSIG, dns.TypeNSEC}) {
+		t.Errorf("type bitmap = %v, want TXT RRSIG NSEC", types)
+	}
+
+	// NODATA at the empty non-terminal sub.example.com: the covering NSEC
+	w = newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("sub.example.com", dns.TypeA))
+	if w.msg.Rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode = %s, want NOERROR", dns.RcodeToString[w.msg.Rcode])
+	}
+	nsecs = denialRecords(w.msg.Ns)
+	if len(nsecs) != 1 || nsecs[0].Header().Name != "example.com." {
+		t.Errorf("ENT proof = %v, want the NSEC of example.com.", nsecs)
+	}
+}
+
+func TestServeDNSNSEC3(t *testing.T) {
+	records := append(txtRecords("b.sub.example.com", 1), soaRecord(86400, 180))
+	h := newTestHandler(records...)
+	_, zsk := signTestZone(t, h)
+	zone := h.mariadbClient.(*fakeStore).zones["example.com"]
+	zone.Denial = models.DenialNSEC3
+	zone.NSEC3Salt = "aabbccdd"
+	zone.NSEC3Iterations = 1
+
+	w := newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("example.com", dns.TypeNSEC3PARAM))
+	if len(w.msg.Answer) == 0 || w.msg.Answer[0].(*dns.NSEC3PARAM).Salt != "aabbccdd" {
+		t.Fatalf("NSEC3PARAM answer = %v", w.msg.Answer)
+	}
+
+	// NXDOMAIN: closest encloser sub.example.com matched, next closer
+	// x.sub.example.com and wildcard *.sub.example.com covered
+	w = newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("a.x.sub.example.com", dns.TypeA))
+	if w.msg.Rcode != dns.RcodeNameError {
+		t.Fatalf("rcode = %s, want NXDOMAIN", dns.RcodeToString[w.msg.Rcode])
+	}
+	nsec3s := denialRecords(w.msg.Ns)
+	proven := func(check func(*dns.NSEC3) bool) bool {
+		for _, rr := range nsec3s {
+			if check(rr.(*dns.NSEC3)) {
+				return true
+			}
+		}
+		return false
+	}
+	if !proven(func(rr *dns.NSEC3) bool { return rr.Match("sub.example.com.") }) {
+		t.Errorf("closest encloser sub.example.com. not matched by %v", nsec3s)
+	}
+	if !proven(func(rr *dns.NSEC3) bool { return rr.Cover("x.sub.example.com.") }) {
+		t.Errorf("next closer x.sub.example.com. not covered by %v", nsec3s)
+	}
+	if !proven(func(rr *dns.NSEC3) bool { return rr.Cover("*.sub.example.com.") }) {
+		t.Errorf("wildcard *.sub.example.com. not covered by %v", nsec3s)
+	}
+	verifyRRSIGs(t, w.msg.Ns, dns.TypeSOA, zsk)
+
+	// NODATA at the empty non-terminal: its NSEC3 with an empty bitmap
+	w = newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("sub.example.com", dns.TypeA))
+	nsec3s = denialRecords(w.msg.Ns)
+	if len(nsec3s) != 1 || !nsec3s[0].(*dns.NSEC3).Match("sub.example.com.") || len(nsec3s[0].(*dns.NSEC3).TypeBitMap) != 0 {
+		t.Errorf("ENT proof = %v, want the matching NSEC3 without types", nsec3s)
+	}
+}
+
+func TestZoneKeysCache(t *testing.T) {
+	h := newTestHandler(soaRecord(86400, 180))
+	store := h.mariadbClient.(*fakeStore)
+
+	// Unsigned zones are cached too, so signing one takes an invalidation
+	if keys, err := h.zoneKeys("example.com"); err != nil || keys != nil {
+		t.Fatalf("zoneKeys of an unsigned zone = %v, %v", keys, err)
+	}
+	signTestZone(t, h)
+	if keys, _ := h.zoneKeys("example.com"); len(keys) != 2 {
+		t.Fatalf("zoneKeys after signing = %d keys, want 2", len(keys))
+	}
+
+	// The keys are served from memory until they change
+	store.keys = nil
+	if keys, _ := h.zoneKeys("example.com"); len(keys) != 2 {
+		t.Errorf("zoneKeys read the store again, got %d keys", len(keys))
+	}
+	h.invalidateKeys("example.com")
+	if keys, _ := h.zoneKeys("example.com"); keys != nil {
+		t.Errorf("zoneKeys after invalidation = %d keys, want none", len(keys))
+	}
+}
+
+// rollKeys advances the keys of example.com to now and stores the result
+func rollKeys(t *testing.T, h *DNSHandler, s *rolloverScheduler, now time.Time) {
+	t.Helper()
+
+	store := h.mariadbClient.(*fakeStore)
+	var maxTTL time.Duration
+	for _, record := range store.records {
+		maxTTL = max(maxTTL, time.Duration(record.TTL)*time.Second)
+	}
+	changed, err := s.advance("example.com", append([]models.DNSSECKey(nil), store.keys...), maxTTL, now)
+	if err != nil {
+		t.Fatalf("advance: %v", err)
+	}
+	for _, key := range changed {
+		if key.ID == 0 {
+			key.ID = int64(len(store.keys) + 1)
+			store.keys = append(store.keys, key)
+		} else {
+			store.keys[key.ID-1] = key
+		}
+	}
+	h.invalidateKeys("example.com")
+}
+
+func TestZSKRollover(t *testing.T) {
+	h := newTestHandler(append(txtRecords("txt.example.com", 1), soaRecord(86400, 180))...)
+	h.cfg.DNS.DNSSEC.ZSKLifetime = 30 * 86400
+	h.cfg.DNS.DNSSEC.PropagationDelay = 3600
+	_, oldZSK := signTestZone(t, h)
+	store := h.mariadbClient.(*fakeStore)
+	s := newRolloverScheduler(h.cfg, nil, nil, h.logger)
+
+	start := time.Now()
+	for i := range store.keys {
+		store.keys[i].ActiveAt = &start
+	}
+
+	// Nothing happens before the lifetime is reached
+	rollKeys(t, h, s, start.Add(29*24*time.Hour))
+	if len(store.keys) != 2 {
+		t.Fatalf("rolled over before the ZSK lifetime: %v", store.keys)
+	}
+
+	// The new ZSK is published, the old one keeps signing
+	now := start.Add(30 * 24 * time.Hour)
+	rollKeys(t, h, s, now)
+	if len(store.keys) != 3 || store.keys[2].State != models.KeyPublished {
+		t.Fatalf("keys = %v, want a third, published key", store.keys)
+	}
+	newZSK := util.DNSKEY(&store.keys[2])
+
+	w := newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("example.com", dns.TypeDNSKEY))
+	if n := len(w.msg.Answer); n != 4 {
+		t.Errorf("DNSKEY answer has %d records, want three keys and a signature", n)
+	}
+	w = newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("txt.example.com", dns.TypeTXT))
+	verifyRRSIGs(t, w.msg.Answer, dns.TypeTXT, oldZSK)
+
+	// After the propagation delay the new ZSK takes over
+	rollKeys(t, h, s, now.Add(time.Hour))
+	if store.keys[1].State != models.KeyRetired || store.keys[2].State != models.KeyActive {
+		t.Fatalf("states = %s, %s, want retired, active", store.keys[1].State, store.keys[2].State)
+	}
+	w = newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("txt.example.com", dns.TypeTXT))
+	verifyRRSIGs(t, w.msg.Answer, dns.TypeTXT, newZSK)
+
+	// The old ZSK leaves the DNSKEY RRset once its signatures have expired,
+	// after the signature validity and another propagation delay
+	rollKeys(t, h, s, now.Add(2*time.Hour))
+	if store.keys[1].State != models.KeyRetired {
+		t.Fatalf("old ZSK is %s before its signatures expired, want retired", store.keys[1].State)
+	}
+	rollKeys(t, h, s, now.Add(26*time.Hour))
+	if store.keys[1].State != models.KeyRemoved {
+		t.Fatalf("old ZSK is %s, want removed", store.keys[1].State)
+	}
+	w = newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("example.com", dns.TypeDNSKEY))
+	if n := len(w.msg.Answer); n != 3 {
+		t.Errorf("DNSKEY answer has %d records, want two keys and a signature", n)
+	}
+}
+
+func TestZSKRolloverLongTTL(t *testing.T) {
+	records := txtRecords("txt.example.com", 1)
+	records[0].TTL = 7 * 86400
+	h := newTestHandler(append(records, soaRecord(86400, 180))...)
+	h.cfg.DNS.DNSSEC.ZSKLifetime = 30 * 86400
+	h.cfg.DNS.DNSSEC.PropagationDelay = 3600
+	signTestZone(t, h)
+	store := h.mariadbClient.(*fakeStore)
+	s := newRolloverScheduler(h.cfg, nil, nil, h.logger)
+
+	start := time.Now()
+	for i := range store.keys {
+		store.keys[i].ActiveAt = &start
+	}
+	now := start.Add(30 * 24 * time.Hour)
+	rollKeys(t, h, s, now)
+
+	// Resolvers may cache the TXT record and its signature for a week after
+	// the new ZSK takes over, so the old one stays that long plus a
+	// propagation delay
+	activeAt := now.Add(time.Hour)
+	if got := store.keys[1].RetireAt; got == nil || !got.Equal(activeAt) {
+		t.Errorf("old ZSK retires at %v, want %v", got, activeAt)
+	}
+	want := activeAt.Add(7*24*time.Hour + time.Hour)
+	if got := store.keys[1].RemoveAt; got == nil || !got.Equal(want) {
+		t.Errorf("old ZSK is removed at %v, want %v", got, want)
+	}
+
+	rollKeys(t, h, s, want.Add(-time.Minute))
+	if store.keys[1].State != models.KeyRetired {
+		t.Errorf("old ZSK is %s before the TXT record expired, want retired", store.keys[1].State)
+	}
+	rollKeys(t, h, s, want)
+	if store.keys[1].State != models.KeyRemoved {
+		t.Errorf("old ZSK is %s, want removed", store.keys[1].State)
+	}
+}
+
+func TestKSKRollover(t *testing.T) {
+	h := newTestHandler(soaRecord(86400, 180))
+	h.cfg.DNS.DNSSEC.KSKLifetime = 365 * 86400
+	h.cfg.DNS.DNSSEC.DSDelay = 86400
+	oldKSK, _ := signTestZone(t, h)
+	store := h.mariadbClient.(*fakeStore)
+	s := newRolloverScheduler(h.cfg, nil, nil, h.logger)
+
+	now := time.Now().Add(365 * 24 * time.Hour)
+	rollKeys(t, h, s, now)
+	if len(store.keys) != 3 || store.keys[2].State != models.KeyActive {
+		t.Fatalf("keys = %v, want a third, active key", store.keys)
+	}
+	newKSK := util.DNSKEY(&store.keys[2])
+
+	// Both KSKs sign the DNSKEY RRset until the DS delay has passed
+	w := newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("example.com", dns.TypeDNSKEY))
+	var signedBy []uint16
+	for _, rr := range w.msg.Answer {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			signedBy = append(signedBy, sig.KeyTag)
+		}
+	}
+	if fmt.Sprint(signedBy) != fmt.Sprint([]uint16{oldKSK.KeyTag(), newKSK.KeyTag()}) {
+		t.Errorf("DNSKEY signed by %v, want %d and %d", signedBy, oldKSK.KeyTag(), newKSK.KeyTag())
+	}
+
+	// CDS asks the parent for the DS of the new KSK
+	w = newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("example.com", dns.TypeCDS))
+	var cds []dns.RR
+	for _, rr := range w.msg.Answer {
+		if rr.Header().Rrtype == dns.TypeCDS {
+			cds = append(cds, rr)
+		}
+	}
+	if len(cds) != 1 || cds[0].(*dns.CDS).KeyTag != newKSK.KeyTag() {
+		t.Errorf("CDS = %v, want the DS of the new KSK", cds)
+	}
+
+	// The old KSK stays past the DS delay while the parent lacks the new DS
+	rollKeys(t, h, s, now.Add(30*24*time.Hour))
+	if store.keys[0].State != models.KeyActive {
+		t.Fatalf("old KSK is %s before the new DS was seen, want active", store.keys[0].State)
+	}
+
+	// Once the DS is seen it goes after the propagation delay
+	seen := now.Add(30 * 24 * time.Hour)
+	for _, key := range util.ConfirmDS(store.keys, seen, time.Hour) {
+		store.keys[key.ID-1] = key
+	}
+	rollKeys(t, h, s, seen.Add(time.Minute))
+	if store.keys[0].State != models.KeyActive {
+		t.Fatalf("old KSK is %s right after the new DS was seen, want active", store.keys[0].State)
+	}
+	rollKeys(t, h, s, seen.Add(time.Hour))
+	if store.keys[0].State != models.KeyRemoved {
+		t.Fatalf("old KSK is %s, want removed", store.keys[0].State)
+	}
+	w = newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("example.com", dns.TypeDNSKEY))
+	verifyRRSIGs(t, w.msg.Answer, dns.TypeDNSKEY, newKSK)
+}
+
+func TestServeDNSWildcard(t *testing.T) {
+	records := append(txtRecords("exists.apps.example.com", 1), soaRecord(86400, 180), models.Record{
+		Zone:    "example.com",
+		Name:    "*.apps.example.com",
+		Type:    models.TypeA,
+		Content: "192.0.2.1",
+		TTL:     300,
+	})
+	h := newTestHandler(records...)
+
+	// Names below the closest encloser are synthesized with their own owner
+	for _, name := range []string{"foo.apps.example.com.", "a.b.apps.example.com."} {
+		w := newUDPWriter()
+		h.ServeDNS(w, newQuery(name, dns.TypeA))
+		if w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 1 {
+			t.Fatalf("%s: rcode %s with %v, want a single A", name, dns.RcodeToString[w.msg.Rcode], w.msg.Answer)
+		}
+		if owner := w.msg.Answer[0].Header().Name; owner != name {
+			t.Errorf("%s: answer owned by %s", name, owner)
+		}
+	}
+
+	// The wildcard has no TXT records, so its matches have none either
+	w := newUDPWriter()
+	h.ServeDNS(w, newQuery("foo.apps.example.com", dns.TypeTXT))
+	if w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 0 {
+		t.Errorf("wildcard NODATA answered %s with %v", dns.RcodeToString[w.msg.Rcode], w.msg.Answer)
+	}
+
+	// Existing names and names outside the wildcard's parent don't match
+	w = newUDPWriter()
+	h.ServeDNS(w, newQuery("exists.apps.example.com", dns.TypeA))
+	if w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 0 {
+		t.Errorf("existing name answered %s with %v, want NODATA", dns.RcodeToString[w.msg.Rcode], w.msg.Answer)
+	}
+	w = newUDPWriter()
+	h.ServeDNS(w, newQuery("foo.example.com", dns.TypeA))
+	if w.msg.Rcode != dns.RcodeNameError {
+		t.Errorf("foo.example.com answered %s, want NXDOMAIN", dns.RcodeToString[w.msg.Rcode])
+	}
+
+	// Signed answers carry the wildcard's label count and prove that the
+	// query name does not exist
+	_, zsk := signTestZone(t, h)
+	w = newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("foo.apps.example.com", dns.TypeA))
+	verifyRRSIGs(t, w.msg.Answer, dns.TypeA, zsk)
+	if sig := w.msg.Answer[1].(*dns.RRSIG); sig.Labels != 3 {
+		t.Errorf("RRSIG labels = %d, want 3", sig.Labels)
+	}
+	nsecs := denialRecords(w.msg.Ns)
+	if len(nsecs) != 1 {
+		t.Fatalf("wildcard answer proof = %v, want a single NSEC", nsecs)
+	}
+	if nsec := nsecs[0].(*dns.NSEC); nsec.Hdr.Name != "exists.apps.example.com." || nsec.NextDomain != "example.com." {
+		t.Errorf("NSEC = %s, want exists.apps.example.com. -> example.com.", nsec)
+	}
+}
+
+func TestServeDNSCNAME(t *testing.T) {
+	cname := func(zone, name, target string) models.Record {
+		return models.Record{Zone: zone, Name: name, Type: models.TypeCNAME, Content: target, TTL: 300}
+	}
+	h := newTestHandler(
+		soaRecord(86400, 180),
+		cname("example.com", "www.example.com", "web.example.com"),
+		models.Record{Zone: "example.com", Name: "web.example.com", Type: models.TypeA, Content: "192.0.2.1", TTL: 300},
+		cname("example.com", "loop1.example.com", "loop2.example.com"),
+		cname("example.com", "loop2.example.com", "loop1.example.com"),
+		cname("example.com", "ext.example.com", "www.example.net"),
+		cname("example.com", "dangling.example.com", "missing.example.com"),
+		cname("example.com", "other.example.com", "host.example.org"),
+		models.Record{Zone: "example.org", Name: "host.example.org", Type: models.TypeA, Content: "192.0.2.2", TTL: 300},
+	)
+	h.mariadbClient.(*fakeStore).zones["example.org"] = &models.Zone{Name: "example.org"}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		types []uint16
+	}{
+		{"www.example.com", dns.TypeA, dns.RcodeSuccess, []uint16{dns.TypeCNAME, dns.TypeA}},
+		{"www.example.com", dns.TypeCNAME, dns.RcodeSuccess, []uint16{dns.TypeCNAME}},
+		{"loop1.example.com", dns.TypeA, dns.RcodeSuccess, []uint16{dns.TypeCNAME, dns.TypeCNAME}},
+		{"ext.example.com", dns.TypeA, dns.RcodeSuccess, []uint16{dns.TypeCNAME}},
+		{"dangling.example.com", dns.TypeA, dns.RcodeNameError, []uint16{dns.TypeCNAME}},
+		{"other.example.com", dns.TypeA, dns.RcodeSuccess, []uint16{dns.TypeCNAME, dns.TypeA}},
+	}
+	for _, tt := range tests {
+		w := newUDPWriter()
+		h.ServeDNS(w, newQuery(tt.name, tt.qtype))
+
+		var types []uint16
+		for _, rr := range w.msg.Answer {
+			types = append(types, rr.Header().Rrtype)
+		}
+		if w.msg.Rcode != tt.rcode || fmt.Sprint(types) != fmt.Sprint(tt.types) {
+			t.Errorf("%s %s: %s with %v, want %s with types %v", tt.name, dns.TypeToString[tt.qtype],
+				dns.RcodeToString[w.msg.Rcode], w.msg.Answer, dns.RcodeToString[tt.rcode], tt.types)
+		}
+	}
+}
+
+func TestServeDNSAlias(t *testing.T) {
+	// An upstream resolver for targets outside our zones
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	upstream := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 198.51.100.7")
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+
+	h := newTestHandler(
+		soaRecord(86400, 180),
+		models.Record{Zone: "example.com", Name: "example.com", Type: models.TypeALIAS, Content: "lb.example.org", TTL: 3600},
+		models.Record{Zone: "example.com", Name: "ext.example.com", Type: models.TypeALIAS, Content: "lb.example.net.", TTL: 3600},
+		models.Record{Zone: "example.org", Name: "lb.example.org", Type: models.TypeA, Content: "192.0.2.1", TTL: 600},
+		models.Record{Zone: "example.org", Name: "lb.example.org", Type: models.TypeA, Content: "192.0.2.2", TTL: 600},
+	)
+	h.mariadbClient.(*fakeStore).zones["example.org"] = &models.Zone{Name: "example.org"}
+	h.cfg.DNS.Alias.MaxTTL = 300
+	h.cfg.DNS.Alias.Resolvers = []string{conn.LocalAddr().String()}
+
+	// The apex is answered with the addresses of a target in our own zones
+	w := newUDPWriter()
+	h.ServeDNS(w, newQuery("example.com", dns.TypeA))
+	if len(w.msg.Answer) != 2 {
+		t.Fatalf("apex A answer = %v, want the two addresses of lb.example.org", w.msg.Answer)
+	}
+	for _, rr := range w.msg.Answer {
+		if rr.Header().Name != "example.com." || rr.Header().Ttl != 300 {
+			t.Errorf("synthesized %s, want owner example.com. and the maximum TTL 300", rr)
+		}
+	}
+
+	// The target has no AAAA records, and the ALIAS leaves other types alone
+	w = newUDPWriter()
+	h.ServeDNS(w, newQuery("example.com", dns.TypeAAAA))
+	if w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 0 {
+		t.Errorf("apex AAAA answered %s with %v, want NODATA", dns.RcodeToString[w.msg.Rcode], w.msg.Answer)
+	}
+	w = newUDPWriter()
+	h.ServeDNS(w, newQuery("example.com", dns.TypeSOA))
+	if len(w.msg.Answer) != 1 {
+		t.Errorf("apex SOA answer = %v", w.msg.Answer)
+	}
+
+	// Other targets are resolved upstream, keeping the lower upstream TTL
+	w = newUDPWriter()
+	h.ServeDNS(w, newQuery("ext.example.com", dns.TypeA))
+	if len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.A).A.String() != "198.51.100.7" || w.msg.Answer[0].Header().Ttl != 60 {
+		t.Errorf("ext A answer = %v, want 198.51.100.7 with TTL 60", w.msg.Answer)
+	}
+}
+
+func TestServeDNSALIASSigned(t *testing.T) {
+	h := newTestHandler(
+		soaRecord(86400, 180),
+		models.Record{Zone: "example.com", Name: "www.example.com", Type: models.TypeALIAS, Content: "lb.example.com", TTL: 3600},
+		models.Record{Zone: "example.com", Name: "lb.example.com", Type: models.TypeA, Content: "192.0.2.1", TTL: 600},
+	)
+	_, zsk := signTestZone(t, h)
+	zone := h.mariadbClient.(*fakeStore).zones["example.com"]
+
+	for _, denial := range []models.DenialMode{models.DenialNSEC, models.DenialNSEC3} {
+		zone.Denial = denial
+
+		// The target has only A records: the AAAA answer is empty and its
+		// proof must not list AAAA, though the A proof still would
+		w := newUDPWriter()
+		h.ServeDNS(w, newDNSSECQuery("www.example.com", dns.TypeAAAA))
+		if w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 0 {
+			t.Fatalf("%s: AAAA answered %s with %v, want NODATA", denial, dns.RcodeToString[w.msg.Rcode], w.msg.Answer)
+		}
+		rrs := denialRecords(w.msg.Ns)
+		if len(rrs) != 1 {
+			t.Fatalf("%s: NODATA proof = %v, want a single record", denial, rrs)
+		}
+		var types []uint16
+		switch rr := rrs[0].(type) {
+		case *dns.NSEC:
+			if rr.Hdr.Name != "www.example.com." {
+				t.Errorf("NSEC owner = %s, want www.example.com.", rr.Hdr.Name)
+			}
+			types = rr.TypeBitMap
+		case *dns.NSEC3:
+			if !rr.Match("www.example.com.") {
+				t.Errorf("NSEC3 %s does not match www.example.com.", rr)
+			}
+			types = rr.TypeBitMap
+		}
+		want := []uint16{dns.TypeA, dns.TypeRRSIG}
+		if denial == models.DenialNSEC {
+			want = append(want, dns.TypeNSEC)
+		}
+		if fmt.Sprint(types) != fmt.Sprint(want) {
+			t.Errorf("%s: type bitmap = %v, want %v", denial, types, want)
+		}
+		verifyRRSIGs(t, w.msg.Ns, rrs[0].Header().Rrtype, zsk)
+	}
+}
+
+func TestServeDNSDNAME(t *testing.T) {
+	h := newTestHandler(
+		soaRecord(86400, 180),
+		models.Record{Zone: "example.com", Name: "old.example.com", Type: models.TypeDNAME, Content: "new.example.org", TTL: 3600},
+		models.Record{Zone: "example.org", Name: "www.new.example.org", Type: models.TypeA, Content: "192.0.2.1", TTL: 300},
+	)
+	h.mariadbClient.(*fakeStore).zones["example.org"] = &models.Zone{Name: "example.org"}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		types []uint16
+	}{
+		{"www.old.example.com", dns.TypeA, dns.RcodeSuccess, []uint16{dns.TypeDNAME, dns.TypeCNAME, dns.TypeA}},
+		{"old.example.com", dns.TypeDNAME, dns.RcodeSuccess, []uint16{dns.TypeDNAME}},
+		{"old.example.com", dns.TypeA, dns.RcodeSuccess, nil},
+		{"missing.old.example.com", dns.TypeA, dns.RcodeNameError, []uint16{dns.TypeDNAME, dns.TypeCNAME}},
+	}
+	for _, tt := range tests {
+		w := newUDPWriter()
+		h.ServeDNS(w, newQuery(tt.name, tt.qtype))
+
+		var types []uint16
+		for _, rr := range w.msg.Answer {
+			types = append(types, rr.Header().Rrtype)
+		}
+		if w.msg.Rcode != tt.rcode || fmt.Sprint(types) != fmt.Sprint(tt.types) {
+			t.Errorf("%s %s: %s with %v, want %s with types %v", tt.name, dns.TypeToString[tt.qtype],
+				dns.RcodeToString[w.msg.Rcode], w.msg.Answer, dns.RcodeToString[tt.rcode], tt.types)
+		}
+	}
+
+	// The synthesized CNAME points below the target and is left unsigned
+	_, zsk := signTestZone(t, h)
+	w := newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("WWW.old.example.com", dns.TypeA))
+	verifyRRSIGs(t, w.msg.Answer, dns.TypeDNAME, zsk)
+	for _, rr := range w.msg.Answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			if rr.Hdr.Name != "WWW.old.example.com." || rr.Target != "WWW.new.example.org." {
+				t.Errorf("synthesized CNAME = %s", rr)
+			}
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeCNAME {
+				t.Errorf("synthesized CNAME is signed")
+			}
+		}
+	}
+}
+
+func TestServeDNSReferral(t *testing.T) {
+	records := []models.Record{
+		soaRecord(86400, 180),
+		{Zone: "example.com", Name: "sub.example.com", Type: models.TypeNS, Content: "ns1.sub.example.com", TTL: 3600},
+		{Zone: "example.com", Name: "sub.example.com", Type: models.TypeNS, Content: "ns.example.net", TTL: 3600},
+		{Zone: "example.com", Name: "ns1.sub.example.com", Type: models.TypeA, Content: "192.0.2.53", TTL: 3600},
+	}
+	h := newTestHandler(records...)
+
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"www.sub.example.com", dns.TypeA},
+		{"ns1.sub.example.com", dns.TypeA},
+		{"sub.example.com", dns.TypeNS},
+	} {
+		w := newUDPWriter()
+		h.ServeDNS(w, newQuery(q.name, q.qtype))
+		if w.msg.Authoritative || w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 0 {
+			t.Errorf("%s: AA=%t %s with %v, want a referral", q.name, w.msg.Authoritative, dns.RcodeToString[w.msg.Rcode], w.msg.Answer)
+		}
+		if len(w.msg.Ns) != 2 || w.msg.Ns[0].Header().Rrtype != dns.TypeNS || w.msg.Ns[0].Header().Name != "sub.example.com." {
+			t.Errorf("%s: authority = %v, want the NS records of sub.example.com.", q.name, w.msg.Ns)
+		}
+		if len(w.msg.Extra) != 1 || w.msg.Extra[0].Header().Name != "ns1.sub.example.com." {
+			t.Errorf("%s: additional = %v, want only the glue of ns1.sub.example.com.", q.name, w.msg.Extra)
+		}
+	}
+
+	// The DS records of the cut are answered by the parent
+	w := newUDPWriter()
+	h.ServeDNS(w, newQuery("sub.example.com", dns.TypeDS))
+	if !w.msg.Authoritative || len(w.msg.Ns) != 1 || w.msg.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("DS query answered AA=%t with authority %v, want an authoritative NODATA", w.msg.Authoritative, w.msg.Ns)
+	}
+
+	// Signed referrals carry the signed DS records, the NS records stay unsigned
+	store := h.mariadbClient.(*fakeStore)
+	store.records = append(store.records, models.Record{
+		Zone:    "example.com",
+		Name:    "sub.example.com",
+		Type:    models.TypeDS,
+		Content: `{"key_tag":12345,"algorithm":13,"digest_type":2,"digest":"` + strings.Repeat("ab", 32) + `"}`,
+		TTL:     3600,
+	})
+	_, zsk := signTestZone(t, h)
+	w = newUDPWriter()
+	h.ServeDNS(w, newDNSSECQuery("www.sub.example.com", dns.TypeA))
+	verifyRRSIGs(t, w.msg.Ns, dns.TypeDS, zsk)
+	for _, rr := range w.msg.Ns {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeNS {
+			t.Errorf("delegation NS records are signed")
+		}
+	}
+}
+
+func TestServeDNSAdditional(t *testing.T) {
+	h := newTestHandler(
+		soaRecord(86400, 180),
+		models.Record{Zone: "example.com", Name: "example.com", Type: models.TypeMX, Content: "mail.example.com", Priority: 10, TTL: 3600},
+		models.Record{Zone: "example.com", Name: "example.com", Type: models.TypeMX, Content: "mail.example.com.", Priority: 20, TTL: 3600},
+		models.Record{Zone: "example.com", Name: "example.com", Type: models.TypeMX, Content: "mx.example.net", Priority: 30, TTL: 3600},
+		models.Record{Zone: "example.com", Name: "mail.example.com", Type: models.TypeA, Content: "192.0.2.25", TTL: 3600},
+		models.Record{Zone: "example.com", Name: "mail.example.com", Type: models.TypeAAAA, Content: "2001:db8::25", TTL: 3600},
+		models.Record{Zone: "example.com", Name: "_sip._tcp.example.com", Type: models.TypeSRV, Content: `{"priority":10,"weight":5,"port":5060,"target":"sip.example.com"}`, TTL: 3600},
+		models.Record{Zone: "example.com", Name: "sip.example.com", Type: models.TypeA, Content: "192.0.2.50", TTL: 3600},
+	)
+
+	// Both MX records point to the same host, whose addresses are added
+	// once. The target outside our zones is left to the resolver.
+	w := newUDPWriter()
+	h.ServeDNS(w, newQuery("example.com", dns.TypeMX))
+	if len(w.msg.Answer) != 3 {
+		t.Fatalf("MX answer = %v", w.msg.Answer)
+	}
+	if len(w.msg.Extra) != 2 {
+		t.Fatalf("MX additional = %v, want the A and AAAA records of mail.example.com", w.msg.Extra)
+	}
+	if a, ok := w.msg.Extra[0].(*dns.A); !ok || a.Hdr.Name != "mail.example.com." || a.A.String() != "192.0.2.25" {
+		t.Errorf("additional %s, want the A record of mail.example.com", w.msg.Extra[0])
+	}
+	if _, ok := w.msg.Extra[1].(*dns.AAAA); !ok {
+		t.Errorf("additional %s, want the AAAA record of mail.example.com", w.msg.Extra[1])
+	}
+
+	w = newUDPWriter()
+	h.ServeDNS(w, newQuery("_sip._tcp.example.com", dns.TypeSRV))
+	if len(w.msg.Extra) != 1 || w.msg.Extra[0].Header().Name != "sip.example.com." {
+		t.Errorf("SRV additional = %v, want the A record of sip.example.com", w.msg.Extra)
+	}
+
+	// Addresses that would not fit a UDP response are left out rather than
+	// truncating it
+	many := []models.Record{soaRecord(86400, 180)}
+	many = append(many, models.Record{Zone: "example.com", Name: "example.com", Type: models.TypeMX, Content: "mail.example.com", Priority: 10, TTL: 3600})
+	for i := 0; i < 40; i++ {
+		many = append(many, models.Record{Zone: "example.com", Name: "mail.example.com", Type: models.TypeAAAA, Content: fmt.Sprintf("2001:db8::%x", i+1), TTL: 3600})
+	}
+	h = newTestHandler(many...)
+	w = newUDPWriter()
+	h.ServeDNS(w, newQuery("example.com", dns.TypeMX))
+	if w.msg.Truncated || len(w.msg.Answer) != 1 || len(w.msg.Extra) != 0 {
+		t.Errorf("oversized additional section: truncated %v, answer %v, additional %d records", w.msg.Truncated, w.msg.Answer, len(w.msg.Extra))
+	}
+	w = newTCPWriter()
+	h.ServeDNS(w, newQuery("example.com", dns.TypeMX))
+	if len(w.msg.Extra) != 40 {
+		t.Errorf("TCP additional has %d records, want 40", len(w.msg.Extra))
+	}
+
+	// Minimal responses leave the additional section empty
+	h.cfg.DNS.MinimalResponses = true
+	w = newTCPWriter()
+	h.ServeDNS(w, newQuery("example.com", dns.TypeMX))
+	if len(w.msg.Extra) != 0 {
+		t.Errorf("minimal response additional = %v, want none", w.msg.Extra)
+	}
+}
+
+func TestServeDNSANY(t *testing.T) {
+	h := newTestHandler(
+		soaRecord(86400, 180),
+		models.Record{Zone: "example.com", Name: "www.example.com", Type: models.TypeA, Content: "192.0.2.1", TTL: 3600},
+		models.Record{Zone: "example.com", Name: "www.example.com", Type: models.TypeTXT, Content: "hello", TTL: 3600},
+		models.Record{Zone: "example.com", Name: "*.apps.example.com", Type: models.TypeA, Content: "192.0.2.2", TTL: 3600},
+	)
+
+	// By default names that own records get a single HINFO record
+	for _, name := range []string{"www.example.com", "foo.apps.example.com"} {
+		w := newUDPWriter()
+		h.ServeDNS(w, newQuery(name, dns.TypeANY))
+		if len(w.msg.Answer) != 1 {
+			t.Fatalf("%s ANY answer = %v, want a single HINFO record", name, w.msg.Answer)
+		}
+		hinfo, ok := w.msg.Answer[0].(*dns.HINFO)
+		if !ok || hinfo.Hdr.Name != name+"." || hinfo.Cpu != "RFC8482" || hinfo.Os != "" {
+			t.Errorf("%s ANY answer = %s, want HINFO \"RFC8482\" \"\"", name, w.msg.Answer[0])
+		}
+	}
+
+	w := newUDPWriter()
+	h.ServeDNS(w, newQuery("missing.example.com", dns.TypeANY))
+	if w.msg.Rcode != dns.RcodeNameError {
+		t.Errorf("missing ANY rcode = %s, want NXDOMAIN", dns.RcodeToString[w.msg.Rcode])
+	}
+
+	// The tcp policy sends UDP clients to TCP, where all RRsets are served
+	h.cfg.DNS.ANY = "tcp"
+	w = newUDPWriter()
+	h.ServeDNS(w, newQuery("www.example.com", dns.TypeANY))
+	if !w.msg.Truncated || len(w.msg.Answer) != 0 {
+		t.Errorf("UDP ANY with the tcp policy: truncated %v, answer %v", w.msg.Truncated, w.msg.Answer)
+	}
+	w = newTCPWriter()
+	h.ServeDNS(w, newQuery("www.example.com", dns.TypeANY))
+	types := make(map[uint16]bool)
+	for _, rr := range w.msg.Answer {
+		types[rr.Header().Rrtype] = true
+	}
+	if len(w.msg.Answer) != 2 || !types[dns.TypeA] || !types[dns.TypeTXT] {
+		t.Errorf("TCP ANY answer = %v, want the A and TXT records", w.msg.Answer)
+	}
+
+	h.cfg.DNS.ANY = "refuse"
+	w = newTCPWriter()
+	h.ServeDNS(w, newQuery("www.example.com", dns.TypeANY))
+	if w.msg.Rcode != dns.RcodeRefused || len(w.msg.Answer) != 0 {
+		t.Errorf("ANY with the refuse policy answered %s with %v", dns.RcodeToString[w.msg.Rcode], w.msg.Answer)
+	}
+}
+
+func TestServeDNSExtendedTypes(t *testing.T) {
+	tests := []struct {
+		recordType models.RecordType
+		content    string
+		want       string
+	}{
+		{models.TypeHTTPS, `{"priority":1,"target":".","params":{"alpn":"h2,h3","port":"443"}}`, `HTTPS 1 . alpn="h2,h3" port="443"`},
+		{models.TypeSVCB, `{"priority":0,"target":"svc.example.net"}`, `SVCB 0 svc.example.net.`},
+		{models.TypeTLSA, `{"usage":3,"selector":1,"matching_type":1,"certificate":"0C72AC70B745AC19998811B131D662C9AC69DBDBE7CB23E5B514B56664C5D3D6"}`, "TLSA 3 1 1 0c72ac70b745ac19998811b131d662c9ac69dbdbe7cb23e5b514b56664c5d3d6"},
+		{models.TypeSSHFP, `{"algorithm":4,"type":2,"fingerprint":"123456789abcdef67890123456789abcdef67890123456789abcdef123456789"}`, "SSHFP 4 2 123456789ABCDEF67890123456789ABCDEF67890123456789ABCDEF123456789"},
+		{models.TypeNAPTR, `{"order":100,"preference":10,"flags":"S","service":"SIP+D2U","regexp":"","replacement":"_sip._udp.example.com"}`, `NAPTR 100 10 "S" "SIP+D2U" "" _sip._udp.example.com.`},
+		{models.TypeLOC, `{"latitude":52.3731,"longitude":-4.8922,"altitude":-2,"size":1,"horiz_pre":10000,"vert_pre":10}`, "LOC 52 22 23.160 N 04 53 31.920 W -2m 1m 10000m 10m"},
+		{models.TypeLOC, `{"latitude":52.3731,"longitude":-4.8922,"altitude":-2}`, "LOC 52 22 23.160 N 04 53 31.920 W -2m 1m 10000m 10m"},
+		{models.TypeLOC, `{"latitude":52.3731,"longitude":-4.8922,"altitude":-2,"size":0,"horiz_pre":2.5,"vert_pre":0.04}`, "LOC 52 22 23.160 N 04 53 31.920 W -2m 0.00m 2m 0.04m"},
+		{models.TypeURI, `{"priority":10,"weight":1,"target":"ftp://ftp.example.com/public"}`, `URI 10 1 "ftp://ftp.example.com/public"`},
+		{models.TypeDS, `{"key_tag":60485,"algorithm":5,"digest_type":1,"digest":"2bb183af5f22588179a53b0a98631fad1a292118"}`, "DS 60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118"},
+	}
+
+	for _, tt := range tests {
+		record := models.Record{Zone: "example.com", Name: "host.example.com", Type: tt.recordType, Content: tt.content, TTL: 3600}
+		h := newTestHandler(soaRecord(86400, 180), record)
+
+		w := newUDPWriter()
+		h.ServeDNS(w, newQuery("host.example.com", dns.StringToType[string(tt.recordType)]))
+		if len(w.msg.Answer) != 1 {
+			t.Errorf("%s answer = %v", tt.recordType, w.msg.Answer)
+			continue
+		}
+		want := "host.example.com. 3600 IN " + tt.want
+		if got := w.msg.Answer[0].String(); normalizeSpace(got) != want {
+			t.Errorf("%s answer = %s, want %s", tt.recordType, got, want)
+		}
+
+		// Records received in zone transfers are stored the same way
+		stored, err := rrToRecord(w.msg.Answer[0], "example.com")
+		if err != nil {
+			t.Errorf("rrToRecord(%s): %v", tt.recordType, err)
+			continue
+		}
+		rr, err := recordToRR(stored, "host.example.com.")
+		if err != nil || rr.String() != w.msg.Answer[0].String() {
+			t.Errorf("%s round trip = %v (%v), want %s", tt.recordType, rr, err, w.msg.Answer[0])
+		}
+	}
+}
+
+// normalizeSpace collapses the whitespace of a record in zone file format
+func normalizeSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func TestServeDNSGenericTypes(t *testing.T) {
+	h := newTestHandler(
+		soaRecord(86400, 180),
+		models.Record{Zone: "example.com", Name: "host.example.com", Type: "HINFO", Content: `"PC" "Linux"`, TTL: 3600},
+		models.Record{Zone: "example.com", Name: "host.example.com", Type: "EUI48", Content: `\# 6 00005e0053ff`, TTL: 3600},
+		models.Record{Zone: "example.com", Name: "host.example.com", Type: "TYPE65280", Content: `\# 4 0a000001`, TTL: 3600},
+	)
+
+	tests := []struct {
+		qtype uint16
+		want  string
+	}{
+		{dns.TypeHINFO, `IN HINFO "PC" "Linux"`},
+		{dns.TypeEUI48, "IN EUI48 00-00-5e-00-53-ff"},
+		{65280, `CLASS1 TYPE65280 \# 4 0a000001`},
+	}
+	for _, tt := range tests {
+		w := newUDPWriter()
+		h.ServeDNS(w, newQuery("host.example.com", tt.qtype))
+		if len(w.msg.Answer) != 1 {
+			t.Errorf("%s answer = %v", dns.Type(tt.qtype), w.msg.Answer)
+			continue
+		}
+		if got := normalizeSpace(w.msg.Answer[0].String()); got != "host.example.com. 3600 "+tt.want {
+			t.Errorf("%s answer = %s, want %s", dns.Type(tt.qtype), got, tt.want)
+		}
+
+		stored, err := rrToRecord(w.msg.Answer[0], "example.com")
+		if err != nil {
+			t.Errorf("rrToRecord(%s): %v", dns.Type(tt.qtype), err)
+			continue
+		}
+		if rr, err := recordToRR(stored, "host.example.com."); err != nil || rr.String() != w.msg.Answer[0].String() {
+			t.Errorf("%s round trip = %v (%v), want %s", dns.Type(tt.qtype), rr, err, w.msg.Answer[0])
+		}
+	}
+
+	// DNSSEC records are generated, never stored
+	rrsig, _ := dns.NewRR("host.example.com. 3600 IN RRSIG A 13 3 3600 20300101000000 20200101000000 12345 example.com. AAAA")
+	if _, err := rrToRecord(rrsig, "example.com"); err == nil {
+		t.Errorf("rrToRecord accepted an RRSIG")
+	}
+}
+
+func TestServeDNSTXTStrings(t *testing.T) {
+	dkim := "v=DKIM1; k=rsa; p=" + strings.Repeat("MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8A", 12)
+	tests := []struct {
+		content string
+		want    []string // Character-strings on the wire
+		stored  string   // Content of the record received in a zone transfer
+	}{
+		{dkim, []string{dkim[:255], dkim[255:]}, dkim},
+		{`["v=spf1 ", "include:example.net ~all"]`, []string{"v=spf1 ", "include:example.net ~all"}, `["v=spf1 ","include:example.net ~all"]`},
+		{`"hello world" "say \"hi\""`, []string{"hello world", `say "hi"`}, `["hello world","say \"hi\""]`},
+		{`C:\temp`, []string{`C:\temp`}, `C:\temp`},
+	}
+
+	for _, tt := range tests {
+		h := newTestHandler(
+			soaRecord(86400, 180),
+			models.Record{Zone: "example.com", Name: "txt.example.com", Type: models.TypeTXT, Content: tt.content, TTL: 3600},
+		)
+
+		w := newTCPWriter()
+		h.ServeDNS(w, newQuery("txt.example.com", dns.TypeTXT))
+		if len(w.msg.Answer) != 1 {
+			t.Errorf("TXT %q answer = %v", tt.content, w.msg.Answer)
+			continue
+		}
+
+		// Decode the character-strings from the wire
+		txt := w.msg.Answer[0].(*dns.TXT)
+		generic := new(dns.RFC3597)
+		if err := generic.ToRFC3597(txt); err != nil {
+			t.Fatalf("ToRFC3597: %v", err)
+		}
+		rdata, _ := hex.DecodeString(generic.Rdata)
+		var got []string
+		for len(rdata) > 0 {
+			n := 1 + int(rdata[0])
+			got = append(got, string(rdata[1:n]))
+			rdata = rdata[n:]
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("TXT %q character-strings = %q, want %q", tt.content, got, tt.want)
+		}
+
+		record, err := rrToRecord(txt, "example.com")
+		if err != nil || record.Content != tt.stored {
+			t.Errorf("TXT %q stored as %v (%v), want %s", tt.content, record, err, tt.stored)
+		}
+	}
+}
+
+// newUpdate returns an UPDATE of example.com as received on the wire
+func newUpdate(t *testing.T, build func(u *dns.Msg)) *dns.Msg {
+	u := new(dns.Msg)
+	u.SetUpdate("example.com.")
+	build(u)
+
+	wire, err := u.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(wire); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestServeDNSUpdate(t *testing.T) {
+	h := newTestHandler(
+		soaRecord(86400, 180),
+		models.Record{Zone: "example.com", Name: "example.com", Type: models.TypeNS, Content: "ns1.example.com", TTL: 3600},
+		models.Record{Zone: "example.com", Name: "www.example.com", Type: models.TypeA, Content: "192.0.2.10", TTL: 300},
+	)
+	store := h.mariadbClient.(*fakeStore)
+
+	serve := func(r *dns.Msg) int {
+		w := newUDPWriter()
+		h.ServeDNS(w, r)
+		return w.msg.Rcode
+	}
+	mustRR := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	addHost := newUpdate(t, func(u *dns.Msg) {
+		u.NameNotUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "host.example.com."}}})
+		u.Insert([]dns.RR{mustRR("host.example.com. 60 IN A 192.0.2.20")})
+	})
+
+	// Updates are refused unless the zone allows the client
+	if rcode := serve(addHost); rcode != dns.RcodeRefused {
+		t.Fatalf("rcode without allow_update = %s, want REFUSED", dns.RcodeToString[rcode])
+	}
+	store.zones["example.com"].AllowUpdate = []string{"192.0.2.0/24"}
+
+	if rcode := serve(addHost); rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode of add = %s, want NOERROR", dns.RcodeToString[rcode])
+	}
+	w := newUDPWriter()
+	h.ServeDNS(w, newQuery("host.example.com", dns.TypeA))
+	if len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.A).A.String() != "192.0.2.20" {
+		t.Fatalf("answer after add = %v, want 192.0.2.20", w.msg.Answer)
+	}
+	soa, _ := store.GetRecord("example.com", "example.com", models.TypeSOA)
+	if !strings.Contains(soa.Content, `"serial":2`) {
+		t.Errorf("SOA after add = %s, want serial 2", soa.Content)
+	}
+
+	// The name is in use now, so the prerequisite fails
+	if rcode := serve(addHost); rcode != dns.RcodeYXDomain {
+		t.Errorf("rcode of repeated add = %s, want YXDOMAIN", dns.RcodeToString[rcode])
+	}
+
+	// A value dependent prerequisite must match the whole RRset
+	replace := newUpdate(t, func(u *dns.Msg) {
+		u.Used([]dns.RR{mustRR("www.example.com. 0 IN A 192.0.2.99")})
+		u.RemoveRRset([]dns.RR{mustRR("www.example.com. 0 IN A 0.0.0.0")})
+		u.Insert([]dns.RR{mustRR("www.example.com. 300 IN AAAA 2001:db8::10")})
+	})
+	if rcode := serve(replace); rcode != dns.RcodeNXRrset {
+		t.Errorf("rcode of mismatched RRset = %s, want NXRRSET", dns.RcodeToString[rcode])
+	}
+	replace = newUpdate(t, func(u *dns.Msg) {
+		u.Used([]dns.RR{mustRR("www.example.com. 0 IN A 192.0.2.10")})
+		u.RemoveRRset([]dns.RR{mustRR("www.example.com. 0 IN A 0.0.0.0")})
+		u.Insert([]dns.RR{mustRR("www.example.com. 300 IN AAAA 2001:db8::10")})
+	})
+	if rcode := serve(replace); rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode of replace = %s, want NOERROR", dns.RcodeToString[rcode])
+	}
+	if types, _ := store.GetRecordTypesByName("example.com", "www.example.com"); !slices.Equal(types, []models.RecordType{models.TypeAAAA}) {
+		t.Errorf("types at www after replace = %v, want [AAAA]", types)
+	}
+
+	// Deleting everything at the apex keeps its SOA and NS records
+	deleteApex := newUpdate(t, func(u *dns.Msg) {
+		u.RemoveName([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "example.com."}}})
+		u.Remove([]dns.RR{mustRR("example.com. 0 IN NS ns1.example.com.")})
+	})
+	if rcode := serve(deleteApex); rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode of apex delete = %s, want NOERROR", dns.RcodeToString[rcode])
+	}
+	if types, _ := store.GetRecordTypesByName("example.com", "example.com"); len(types) != 2 {
+		t.Errorf("types at apex after delete = %v, want SOA and NS", types)
+	}
+
+	// Names outside the zone and records we can't store are rejected
+	outside := newUpdate(t, func(u *dns.Msg) {
+		u.Insert([]dns.RR{mustRR("www.example.org. 300 IN A 192.0.2.30")})
+	})
+	if rcode := serve(outside); rcode != dns.RcodeNotZone {
+		t.Errorf("rcode for name outside the zone = %s, want NOTZONE", dns.RcodeToString[rcode])
+	}
+	rrsig := newUpdate(t, func(u *dns.Msg) {
+		u.Insert([]dns.RR{mustRR("www.example.com. 300 IN RRSIG A 8 3 300 20300101000000 20200101000000 12345 example.com. AAAA")})
+	})
+	if rcode := serve(rrsig); rcode != dns.RcodeRefused {
+		t.Errorf("rcode for RRSIG = %s, want REFUSED", dns.RcodeToString[rcode])
+	}
+
+	// Secondary zones are updated through their primaries
+	store.zones["example.com"].Kind = models.ZoneSecondary
+	if rcode := serve(addHost); rcode != dns.RcodeNotAuth {
+		t.Errorf("rcode for secondary zone = %s, want NOTAUTH", dns.RcodeToString[rcode])
+	}
+}
+
+func TestTSIGKeyring(t *testing.T) {
+	keyring := &tsigKeyring{}
+	keyring.set([]models.TSIGKey{{Name: "xfr-key", Algorithm: models.TSIGHmacSHA256, Secret: "c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0IQ=="}})
+
+	sign := func(key, algorithm string) []byte {
+		m := newQuery("example.com", dns.TypeAXFR)
+		m.SetTsig(key, algorithm, 300, time.Now().Unix())
+		wire, _, err := dns.TsigGenerateWithProvider(m, keyring, "", false)
+		if err != nil {
+			t.Fatalf("signing with %s: %v", key, err)
+		}
+		return wire
+	}
+
+	if err := dns.TsigVerifyWithProvider(sign("xfr-key.", dns.HmacSHA256), keyring, "", false); err != nil {
+		t.Errorf("verifying a signed request: %v", err)
+	}
+
+	// Outgoing requests name the key, the algorithm comes from the keyring
+	m := newQuery("example.com", dns.TypeSOA)
+	if err := keyring.sign(m, "XFR-Key."); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if tsig := m.IsTsig(); tsig == nil || tsig.Hdr.Name != "xfr-key." || tsig.Algorithm != dns.HmacSHA256 {
+		t.Fatalf("sign added %v", m.IsTsig())
+	}
+	signed, _, err := dns.TsigGenerateWithProvider(m, keyring, "", false)
+	if err != nil {
+		t.Fatalf("signing an outgoing request: %v", err)
+	}
+	if err := dns.TsigVerifyWithProvider(signed, keyring, "", false); err != nil {
+		t.Errorf("verifying an outgoing request: %v", err)
+	}
+	if err := keyring.sign(newQuery("example.com", dns.TypeSOA), "other-key"); err == nil {
+		t.Error("signing with an unknown key succeeded")
+	}
+	unsigned := newQuery("example.com", dns.TypeSOA)
+	if err := keyring.sign(unsigned, ""); err != nil || unsigned.IsTsig() != nil {
+		t.Errorf("signing without a key = %v, TSIG %v", err, unsigned.IsTsig())
+	}
+
+	// Verification strips the TSIG record from the message, so each check
+	// gets its own copy
+	wire := sign("xfr-key.", dns.HmacSHA256)
+	keyring.set([]models.TSIGKey{{Name: "xfr-key", Algorithm: models.TSIGHmacSHA256, Secret: "b3RoZXI="}})
+	if err := dns.TsigVerifyWithProvider(slices.Clone(wire), keyring, "", false); err != dns.ErrSig {
+		t.Errorf("verifying with another secret = %v, want %v", err, dns.ErrSig)
+	}
+
+	keyring.set(nil)
+	if err := dns.TsigVerifyWithProvider(wire, keyring, "", false); err != dns.ErrSecret {
+		t.Errorf("verifying with an unknown key = %v, want %v", err, dns.ErrSecret)
+	}
+}
+
+func TestServeDNSTSIG(t *testing.T) {
+	h := newTestHandler(soaRecord(86400, 180), models.Record{Zone: "example.com", Name: "www.example.com", Type: models.TypeA, Content: "192.0.2.10", TTL: 300})
+	store := h.mariadbClient.(*fakeStore)
+	store.zones["example.com"].TSIGPolicy = []models.TSIGGrant{
+		{Key: "xfr-key", Operations: []models.TSIGOperation{models.TSIGAXFR, models.TSIGIXFR}},
+	}
+
+	signed := func(r *dns.Msg, key string) *dns.Msg {
+		r.SetTsig(dns.Fqdn(key), dns.HmacSHA256, 300, time.Now().Unix())
+		return r
+	}
+
+	// Without an address list the policy alone lets transfers through
+	w := newTCPWriter()
+	h.ServeDNS(w, newQuery("example.com", dns.TypeAXFR))
+	if w.msg.Rcode != dns.RcodeRefused {
+		t.Errorf("rcode of unsigned AXFR = %s, want REFUSED", dns.RcodeToString[w.msg.Rcode])
+	}
+
+	w = newTCPWriter()
+	h.ServeDNS(w, signed(newQuery("example.com", dns.TypeAXFR), "other-key"))
+	if w.msg.Rcode != dns.RcodeRefused {
+		t.Errorf("rcode of AXFR signed with another key = %s, want REFUSED", dns.RcodeToString[w.msg.Rcode])
+	}
+
+	w = newTCPWriter()
+	h.ServeDNS(w, signed(newQuery("example.com", dns.TypeAXFR), "xfr-key"))
+	if w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 3 {
+		t.Fatalf("signed AXFR = %s with %d records, want the zone", dns.RcodeToString[w.msg.Rcode], len(w.msg.Answer))
+	}
+	if tsig := w.msg.IsTsig(); tsig == nil || tsig.Hdr.Name != "xfr-key." {
+		t.Errorf("signed AXFR response TSIG = %v, want one for xfr-key", tsig)
+	}
+
+	// Responses to other signed requests are signed too
+	w = newUDPWriter()
+	h.ServeDNS(w, signed(newQuery("www.example.com", dns.TypeA), "xfr-key"))
+	if w.msg.IsTsig() == nil || len(w.msg.Answer) != 1 {
+		t.Errorf("signed query answered with %v, want a signed answer", w.msg)
+	}
+
+	// Requests that fail verification get NOTAUTH and the TSIG error
+	for _, tc := range []struct {
+		status error
+		want   uint16
+	}{
+		{dns.ErrSig, dns.RcodeBadSig},
+		{dns.ErrSecret, dns.RcodeBadKey},
+		{dns.ErrTime, dns.RcodeBadTime},
+	} {
+		w = newTCPWriter()
+		w.tsigStatus = tc.status
+		h.ServeDNS(w, signed(newQuery("example.com", dns.TypeAXFR), "xfr-key"))
+		tsig := w.msg.IsTsig()
+		if w.msg.Rcode != dns.RcodeNotAuth || tsig == nil || tsig.Error != tc.want {
+			t.Errorf("response to %v = %s with TSIG %v, want NOTAUTH with %s", tc.status, dns.RcodeToString[w.msg.Rcode], tsig, dns.RcodeToString[int(tc.want)])
+			continue
+		}
+		if tc.want == dns.RcodeBadTime && tsig.OtherLen != 6 {
+			t.Errorf("BADTIME other data = %q, want the server time", tsig.OtherData)
+		}
+	}
+
+	// With both set up, updates need an allowed address and a granted key
+	store.zones["example.com"].AllowUpdate = []string{"192.0.2.0/24"}
+	store.zones["example.com"].TSIGPolicy = append(store.zones["example.com"].TSIGPolicy,
+		models.TSIGGrant{Key: "ddns-key", Operations: []models.TSIGOperation{models.TSIGUpdate}})
+	addHost := func() *dns.Msg {
+		return newUpdate(t, func(u *dns.Msg) {
+			u.Insert([]dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "host.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.20")}})
+		})
+	}
+
+	w = newUDPWriter()
+	h.ServeDNS(w, addHost())
+	if w.msg.Rcode != dns.RcodeRefused {
+		t.Errorf("rcode of unsigned UPDATE = %s, want REFUSED", dns.RcodeToString[w.msg.Rcode])
+	}
+
+	w = newUDPWriter()
+	h.ServeDNS(w, signed(addHost(), "ddns-key"))
+	if w.msg.Rcode != dns.RcodeSuccess || w.msg.IsTsig() == nil {
+		t.Errorf("signed UPDATE = %s, want a signed NOERROR", dns.RcodeToString[w.msg.Rcode])
+	}
+}
+
+// writeTestCert writes a self-signed certificate for dns.example.com with
+// the given serial number to certFile and keyFile
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "dns.example.com"},
+		DNSNames:     []string{"dns.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeDNSOverTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, 1)
+
+	h := newTestHandler(soaRecord(86400, 180), models.Record{Zone: "example.com", Name: "www.example.com", Type: models.TypeA, Content: "192.0.2.10", TTL: 300})
+	h.cfg.DNS.TLS.CertFile = certFile
+	h.cfg.DNS.TLS.KeyFile = keyFile
+
+	s := &DNSServer{cfg: h.cfg, logger: h.logger, handler: h, tsigKeys: &tsigKeyring{}}
+	l, err := s.bind(config.ListenerConfig{Address: "127.0.0.1", Port: 0, Protocol: "tcp-tls"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go l.server.ActivateAndServe()
+	defer l.server.Shutdown()
+	addr := l.server.Listener.Addr().String()
+
+	// query answers a query over TLS and returns the serial number of the
+	// server's certificate
+	query := func() int64 {
+		c := &dns.Client{Net: "tcp-tls", Timeout: 5 * time.Second, TLSConfig: &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"dot"}}}
+		conn, err := c.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		resp, _, err := c.ExchangeWithConn(newQuery("www.example.com", dns.TypeA), conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || !resp.Authoritative {
+			t.Errorf("answer over TLS = %v, want the A record", resp.Answer)
+		}
+		state := conn.Conn.(*tls.Conn).ConnectionState()
+		if state.NegotiatedProtocol != "dot" {
+			t.Errorf("ALPN protocol = %q, want dot", state.NegotiatedProtocol)
+		}
+		return state.PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	if serial := query(); serial != 1 {
+		t.Fatalf("certificate serial = %d, want 1", serial)
+	}
+
+	// A renewed certificate is used for new connections
+	writeTestCert(t, certFile, keyFile, 2)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if reloaded, err := s.certs.reload(); err != nil || !reloaded {
+		t.Fatalf("reload = %v, %v, want the new certificate", reloaded, err)
+	}
+	if serial := query(); serial != 2 {
+		t.Errorf("certificate serial after reload = %d, want 2", serial)
+	}
+
+	// A broken certificate leaves the current one in use
+	os.WriteFile(certFile, []byte("not a certificate"), 0o600)
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if _, err := s.certs.reload(); err == nil {
+		t.Error("reloading a broken certificate succeeded")
+	}
+	if serial := query(); serial != 2 {
+		t.Errorf("certificate serial after failed reload = %d, want 2", serial)
+	}
+}
+
+// freePort returns a port that is free for both UDP and TCP on each of the
+// given addresses, bound to their own address family as listeners are
+func freePort(t *testing.T, addresses ...string) int {
+	t.Helper()
+
+	for attempt := 0; attempt < 10; attempt++ {
+		ln, err := net.Listen("tcp", net.JoinHostPort(addresses[0], "0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := ln.Addr().(*net.TCPAddr).Port
+		ln.Close()
+
+		var closers []io.Closer
+		free := true
+		for _, address := range addresses {
+			for _, protocol := range []string{"udp", "tcp"} {
+				lc := config.ListenerConfig{Address: address, Port: port, Protocol: protocol}
+				addr := net.JoinHostPort(address, fmt.Sprint(port))
+				var c io.Closer
+				if protocol == "udp" {
+					c, err = net.ListenPacket(listenerNetwork(lc), addr)
+				} else {
+					c, err = net.Listen(listenerNetwork(lc), addr)
+				}
+				if err != nil {
+					free = false
+					continue
+				}
+				closers = append(closers, c)
+			}
+		}
+		for _, c := range closers {
+			c.Close()
+		}
+		if free {
+			return port
+		}
+	}
+	t.Fatalf("no port free on %v", addresses)
+	return 0
+}
+
+// serveListeners serves the bound listeners of s until the test ends
+func serveListeners(t *testing.T, s *DNSServer) {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.errs = make(chan error, len(s.listeners))
+	for _, l := range s.listeners {
+		started := make(chan struct{})
+		l.server.NotifyStartedFunc = func() { close(started) }
+		go s.serve(l)
+		<-started
+	}
+	t.Cleanup(s.Stop)
+}
+
+func TestListenersSamePort(t *testing.T) {
+	h := newTestHandler(soaRecord(86400, 180), models.Record{Zone: "example.com", Name: "www.example.com", Type: models.TypeA, Content: "192.0.2.10", TTL: 300})
+	port := freePort(t, "127.0.0.1")
+	h.cfg.DNS.Listeners = []config.ListenerConfig{
+		{Address: "127.0.0.1", Port: port, Protocol: "udp"},
+		{Address: "127.0.0.1", Port: port, Protocol: "tcp"},
+	}
+
+	s := &DNSServer{cfg: h.cfg, logger: h.logger, handler: h, tsigKeys: &tsigKeyring{}}
+	if err := s.bindListeners(); err != nil {
+		t.Fatal(err)
+	}
+	serveListeners(t, s)
+
+	addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(port))
+	for _, network := range []string{"udp", "tcp"} {
+		c := &dns.Client{Net: network, Timeout: 5 * time.Second}
+		resp, _, err := c.Exchange(newQuery("www.example.com", dns.TypeA), addr)
+		if err != nil {
+			t.Errorf("query over %s: %v", network, err)
+			continue
+		}
+		if len(resp.Answer) != 1 || !resp.Authoritative {
+			t.Errorf("answer over %s = %v, want the A record", network, resp.Answer)
+		}
+	}
+}
+
+func TestListenersDualStack(t *testing.T) {
+	if ln, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	} else {
+		ln.Close()
+	}
+
+	h := newTestHandler(soaRecord(86400, 180), models.Record{Zone: "example.com", Name: "www.example.com", Type: models.TypeA, Content: "192.0.2.10", TTL: 300})
+	port := freePort(t, "0.0.0.0", "::")
+	for _, address := range []string{"0.0.0.0", "::"} {
+		for _, protocol := range []string{"udp", "tcp"} {
+			h.cfg.DNS.Listeners = append(h.cfg.DNS.Listeners, config.ListenerConfig{Address: address, Port: port, Protocol: protocol})
+		}
+	}
+
+	// The IPv4 and IPv6 wildcard addresses are bound side by side on the
+	// same port, each answering its own address family
+	s := &DNSServer{cfg: h.cfg, logger: h.logger, handler: h, tsigKeys: &tsigKeyring{}}
+	if err := s.bindListeners(); err != nil {
+		t.Fatal(err)
+	}
+	serveListeners(t, s)
+
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		for _, network := range []string{"udp", "tcp"} {
+			c := &dns.Client{Net: network, Timeout: 5 * time.Second}
+			resp, _, err := c.Exchange(newQuery("www.example.com", dns.TypeA), net.JoinHostPort(host, fmt.Sprint(port)))
+			if err != nil {
+				t.Errorf("query to %s over %s: %v", host, network, err)
+				continue
+			}
+			if len(resp.Answer) != 1 {
+				t.Errorf("answer from %s over %s = %v, want the A record", host, network, resp.Answer)
+			}
+		}
+	}
+}
+
+func TestListenersBindFailure(t *testing.T) {
+	h := newTestHandler(soaRecord(86400, 180))
+	port := freePort(t, "127.0.0.1")
+	addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(port))
+
+	// Something else holds the TCP port, so the second listener can't bind
+	blocker, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocker.Close()
+	h.cfg.DNS.Listeners = []config.ListenerConfig{
+		{Address: "127.0.0.1", Port: port, Protocol: "udp"},
+		{Address: "127.0.0.1", Port: port, Protocol: "tcp"},
+	}
+
+	s := &DNSServer{cfg: h.cfg, logger: h.logger, handler: h, tsigKeys: &tsigKeyring{}}
+	err = s.bindListeners()
+	var lerr *ListenerError
+	if !errors.As(err, &lerr) {
+		t.Fatalf("bindListeners = %v, want a *ListenerError", err)
+	}
+	if want := addr + "/tcp"; lerr.Listener != want {
+		t.Errorf("failing listener = %s, want %s", lerr.Listener, want)
+	}
+	if len(s.listeners) != 0 {
+		t.Errorf("%d listeners left bound", len(s.listeners))
+	}
+
+	// The UDP socket bound before the failure was released
+	conn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		t.Fatalf("UDP port still in use: %v", err)
+	}
+	conn.Close()
+}
+
+func TestListenerStopsUnexpectedly(t *testing.T) {
+	h := newTestHandler(soaRecord(86400, 180))
+	h.cfg.DNS.Listeners = []config.ListenerConfig{{Address: "127.0.0.1", Port: 0, Protocol: "tcp"}}
+
+	s := &DNSServer{cfg: h.cfg, logger: h.logger, handler: h, tsigKeys: &tsigKeyring{}}
+	if err := s.bindListeners(); err != nil {
+		t.Fatal(err)
+	}
+	serveListeners(t, s)
+
+	// A listener whose socket goes away is reported on Errors
+	s.listeners[0].server.Listener.Close()
+	select {
+	case err := <-s.Errors():
+		var lerr *ListenerError
+		if !errors.As(err, &lerr) || lerr.Listener != "127.0.0.1:0/tcp" {
+			t.Errorf("error = %v, want a *ListenerError for 127.0.0.1:0/tcp", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error reported for the stopped listener")
+	}
+}
+
+func TestServeDNSOverHTTPS(t *testing.T) {
+	h := newTestHandler(soaRecord(86400, 180), models.Record{Zone: "example.com", Name: "www.example.com", Type: models.TypeA, Content: "192.0.2.10", TTL: 300})
+	keys := &tsigKeyring{}
+	keys.set([]models.TSIGKey{{Name: "doh-key", Algorithm: models.TSIGHmacSHA256, Secret: base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))}})
+	doh := &dohHandler{handler: h, tsigKeys: keys, opts: defaultListenerOptions}
+
+	// do serves an HTTP request and returns the DNS response it was answered with
+	do := func(req *http.Request) (*httptest.ResponseRecorder, *dns.Msg) {
+		rec := httptest.NewRecorder()
+		doh.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			return rec, nil
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/dns-message" {
+			t.Fatalf("Content-Type = %q, want application/dns-message", ct)
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(rec.Body.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		return rec, resp
+	}
+
+	wire, err := newQuery("www.example.com", dns.TypeA).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// GET with the message in the dns parameter
+	rec, resp := do(httptest.NewRequest(http.MethodGet, DoHPath+"?dns="+base64.RawURLEncoding.EncodeToString(wire), nil))
+	if resp == nil || len(resp.Answer) != 1 || !resp.Authoritative {
+		t.Fatalf("GET answered %d with %v, want the A record", rec.Code, resp)
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "max-age=300" {
+		t.Errorf("Cache-Control = %q, want max-age=300", cc)
+	}
+
+	// POST with the message as body
+	req := httptest.NewRequest(http.MethodPost, DoHPath, bytes.NewReader(wire))
+	req.Header.Set("Content-Type", "application/dns-message")
+	if rec, resp := do(req); resp == nil || len(resp.Answer) != 1 {
+		t.Errorf("POST answered %d with %v, want the A record", rec.Code, resp)
+	}
+	if h.stats.Queries != 2 {
+		t.Errorf("queries counted = %d, want 2", h.stats.Queries)
+	}
+
+	// Malformed requests are rejected before reaching the handler
+	req = httptest.NewRequest(http.MethodPost, DoHPath, bytes.NewReader(wire))
+	req.Header.Set("Content-Type", "text/plain")
+	if rec, _ := do(req); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("POST of text/plain answered %d, want 415", rec.Code)
+	}
+	if rec, _ := do(httptest.NewRequest(http.MethodGet, DoHPath+"?dns=!!", nil)); rec.Code != http.StatusBadRequest {
+		t.Errorf("GET with an invalid dns parameter answered %d, want 400", rec.Code)
+	}
+	if rec, _ := do(httptest.NewRequest(http.MethodPut, DoHPath, nil)); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT answered %d, want 405", rec.Code)
+	}
+
+	// Zone transfers don't fit in a single response
+	wire, _ = newQuery("example.com", dns.TypeAXFR).Pack()
+	if _, resp := do(httptest.NewRequest(http.MethodGet, DoHPath+"?dns="+base64.RawURLEncoding.EncodeToString(wire), nil)); resp == nil || resp.Rcode != dns.RcodeRefused {
+		t.Errorf("AXFR answered with %v, want REFUSED", resp)
+	}
+
+	// Only queries are answered, other opcodes are for the DNS listeners
+	update := new(dns.Msg)
+	update.SetUpdate("example.com.")
+	update.Insert([]dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "new.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("192.0.2.20")}})
+	notify := new(dns.Msg)
+	notify.SetNotify("example.com.")
+	for _, m := range []*dns.Msg{update, notify} {
+		wire, _ = m.Pack()
+		req = httptest.NewRequest(http.MethodPost, DoHPath, bytes.NewReader(wire))
+		req.Header.Set("Content-Type", "application/dns-message")
+		if _, resp := do(req); resp == nil || resp.Rcode != dns.RcodeRefused {
+			t.Errorf("%s answered with %v, want REFUSED", dns.OpcodeToString[m.Opcode], resp)
+		}
+	}
+	if records, _ := h.mariadbClient.GetRecordsByNameAndType("example.com", "new.example.com", models.TypeA); len(records) != 0 {
+		t.Errorf("UPDATE over DNS over HTTPS added %v", records)
+	}
+
+	// Signed requests are verified and their responses signed
+	signed := newQuery("www.example.com", dns.TypeA)
+	signed.SetTsig("doh-key.", dns.HmacSHA256, 300, time.Now().Unix())
+	wire, mac, err := dns.TsigGenerateWithProvider(signed, keys, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest(http.MethodPost, DoHPath, bytes.NewReader(wire))
+	req.Header.Set("Content-Type", "application/dns-message")
+	rec = httptest.NewRecorder()
+	doh.ServeHTTP(rec, req)
+	if err := dns.TsigVerifyWithProvider(rec.Body.Bytes(), keys, mac, false); err != nil {
+		t.Errorf("verifying the signed response: %v", err)
+	}
+
+	signed = newQuery("www.example.com", dns.TypeA)
+	signed.SetTsig("unknown-key.", dns.HmacSHA256, 300, time.Now().Unix())
+	signed.Extra[0].(*dns.TSIG).MAC = strings.Repeat("00", sha256.Size)
+	signed.Extra[0].(*dns.TSIG).MACSize = sha256.Size
+	wire, _ = signed.Pack()
+	req = httptest.NewRequest(http.MethodPost, DoHPath, bytes.NewReader(wire))
+	req.Header.Set("Content-Type", "application/dns-message")
+	if _, resp := do(req); resp == nil || resp.Rcode != dns.RcodeNotAuth || resp.IsTsig() == nil || resp.IsTsig().Error != dns.RcodeBadKey {
+		t.Errorf("request signed with an unknown key answered with %v, want NOTAUTH with BADKEY", resp)
+	}
+
+	// The JSON API
+	rec = httptest.NewRecorder()
+	doh.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, DoHPath+"?name=www.example.com&type=a", nil))
+	var body dohJSONResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("JSON response %q: %v", rec.Body.String(), err)
+	}
+	if body.Status != dns.RcodeSuccess || len(body.Answer) != 1 || body.Answer[0].Data != "192.0.2.10" || body.Answer[0].TTL != 300 {
+		t.Errorf("JSON response = %+v, want the A record", body)
+	}
+
+	rec = httptest.NewRecorder()
+	doh.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, DoHPath+"?name=missing.example.com&type=28", nil))
+	body = dohJSONResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if body.Status != dns.RcodeNameError || len(body.Authority) != 1 || body.Authority[0].Type != dns.TypeSOA {
+		t.Errorf("JSON response for a missing name = %+v, want NXDOMAIN with the SOA", body)
+	}
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/PooriaJ/RediDNS/config"
+	"github.com/PooriaJ/RediDNS/models"
+	"github.com/PooriaJ/RediDNS/util"
+	"github.com/miekg/dns"
+)
+
+// signingKey is a DNSSEC key of a zone ready for signing
+type signingKey struct {
+	role   models.KeyRole
+	state  models.KeyState
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+	// current is set on the KSK the parent should reference, which is
+	// published as CDS and CDNSKEY (RFC 7344)
+	current bool
+}
+
+// keySetTTL bounds how long the keys of a zone are kept in memory, in case
+// the announcement of a change to them is missed
+const keySetTTL = rolloverInterval
+
+// keySet is the cached result of zoneKeys for a zone
+type keySet struct {
+	keys     []signingKey
+	loadedAt time.Time
+}
+
+// zoneKeys returns the keys of a zone that are not removed, or nil if the
+// zone is not signed. The keys of each zone are kept in memory until they
+// change, and parsed private keys for as long as the server runs since only
+// the state of a key changes once it is created.
+func (h *DNSHandler) zoneKeys(zone string) ([]signingKey, error) {
+	if cached, ok := h.keySets.Load(zone); ok {
+		set := cached.(*keySet)
+		if time.Since(set.loadedAt) < keySetTTL {
+			return set.keys, nil
+		}
+	}
+
+	loadedAt := time.Now()
+	keys, err := h.mariadbClient.GetDNSSECKeys(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	currentKSK := util.CurrentKey(keys, models.KeyRoleKSK)
+	var signingKeys []signingKey
+	for i := range keys {
+		key := &keys[i]
+		if key.State == models.KeyRemoved {
+			continue
+		}
+
+		var signer crypto.Signer
+		if cached, ok := h.signers.Load(key.ID); ok {
+			signer = cached.(crypto.Signer)
+		} else {
+			signer, err = util.DNSSECSigner(key)
+			if err != nil {
+				h.logger.Errorf("Skipping DNSSEC key: %v", err)
+				continue
+			}
+			h.signers.Store(key.ID, signer)
+		}
+
+		signingKeys = append(signingKeys, signingKey{
+			role:    key.Role,
+			state:   key.State,
+			dnskey:  util.DNSKEY(key),
+			signer:  signer,
+			current: i == currentKSK,
+		})
+	}
+
+	h.keySets.Store(zone, &keySet{keys: signingKeys, loadedAt: loadedAt})
+	return signingKeys, nil
+}
+
+// invalidateKeys drops the cached keys of a zone after they changed
+func (h *DNSHandler) invalidateKeys(zone string) {
+	h.keySets.Delete(zone)
+}
+
+// dnskeyRRs returns the DNSKEY RRset of a zone with the given owner name.
+// Published and retired keys are included alongside the active ones so that
+// validators holding either the old or new keys during a rollover succeed.
+func (h *DNSHandler) dnskeyRRs(keys []signingKey, owner string) []dns.RR {
+	var rrs []dns.RR
+	for _, key := range keys {
+		rr := dns.Copy(key.dnskey).(*dns.DNSKEY)
+		rr.Hdr.Name = owner
+		rr.Hdr.Ttl = uint32(h.cfg.DNS.DNSSEC.DNSKEYTTL)
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// cdsRRs returns the CDS or CDNSKEY RRset of a zone with the given owner
+// name, which asks the parent to reference the current KSK. During a KSK
+// rollover that is the new key, so parents polling for it (RFC 7344) replace
+// the DS on their own.
+func (h *DNSHandler) cdsRRs(keys []signingKey, owner string, qtype uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, key := range keys {
+		if !key.current {
+			continue
+		}
+		hdr := dns.RR_Header{Name: owner, Rrtype: qtype, Class: dns.ClassINET, Ttl: uint32(h.cfg.DNS.DNSSEC.DNSKEYTTL)}
+		if qtype == dns.TypeCDS {
+			ds := key.dnskey.ToDS(dns.SHA256)
+			rrs = append(rrs, &dns.CDS{DS: dns.DS{Hdr: hdr, KeyTag: ds.KeyTag, Algorithm: ds.Algorithm, DigestType: ds.DigestType, Digest: ds.Digest}})
+		} else {
+			dnskey := *key.dnskey
+			dnskey.Hdr = hdr
+			rrs = append(rrs, &dns.CDNSKEY{DNSKEY: dnskey})
+		}
+	}
+	return rrs
+}
+
+// signatureValidity returns how long new signatures are valid for
+func signatureValidity(cfg *config.Config) time.Duration {
+	validity := time.Duration(cfg.DNS.DNSSEC.SignatureValidity) * time.Second
+	if validity < time.Hour {
+		validity = time.Hour
+	}
+	return validity
+}
+
+// signMsg adds RRSIGs to the answer and authority sections of a response
+// from a signed zone (RFC 4035 section 3.1). synthesized maps the lower case
+// owner names of RRsets synthesized from wildcards to their wildcard.
+func (h *DNSHandler) signMsg(m *dns.Msg, zone string, keys []signingKey, synthesized map[string]string) error {
+	var err error
+	if m.Answer, err = h.signSection(m.Answer, zone, keys, synthesized); err != nil {
+		return err
+	}
+	m.Ns, err = h.signSection(m.Ns, zone, keys, nil)
+	return err
+}
+
+// signSection groups the records of a message section into RRsets and
+// follows each RRset with its signatures
+func (h *DNSHandler) signSection(rrs []dns.RR, zone string, keys []signingKey, synthesized map[string]string) ([]dns.RR, error) {
+	var order []string
+	rrsets := make(map[string][]dns.RR)
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		key := strings.ToLower(rr.Header().Name) + "/" + dns.Type(rr.Header().Rrtype).String()
+		if _, ok := rrsets[key]; !ok {
+			order = append(order, key)
+		}
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	var signed []dns.RR
+	for _, key := range order {
+		rrset := rrsets[key]
+		owner := rrset[0].Header().Name
+		wildcard, ok := synthesized[strings.ToLower(owner)]
+		if !ok {
+			wildcard = owner
+		}
+
+		// Synthesized RRsets are signed as the wildcard, which sets the
+		// RRSIG labels field for validators to reconstruct it (RFC 4035
+		// section 5.3.2), and served with the query name as owner
+		sigs, err := h.signRRset(zone, withOwner(rrset, wildcard), keys)
+		if err != nil {
+			return nil, err
+		}
+		for _, sig := range sigs {
+			sig.Header().Name = owner
+		}
+		signed = append(signed, rrset...)
+		signed = append(signed, sigs...)
+	}
+	return signed, nil
+}
+
+// signRRset returns the RRSIGs of an RRset, from the cache if it holds
+// signatures of the same contents that are not close to expiring
+func (h *DNSHandler) signRRset(zone string, rrset []dns.RR, keys []signingKey) ([]dns.RR, error) {
+	hdr := rrset[0].Header()
+
+	// NS records below the apex are the child's, only it signs them
+	if hdr.Rrtype == dns.TypeNS && normalizeName(hdr.Name) != zone {
+		return nil, nil
+	}
+
+	// The DNSKEY RRset and the CDS and CDNSKEY RRsets, which must be signed
+	// by a key the parent references, are signed with the active KSKs,
+	// everything else with the active ZSKs
+	wantRole := models.KeyRoleZSK
+	switch hdr.Rrtype {
+	case dns.TypeDNSKEY, dns.TypeCDS, dns.TypeCDNSKEY:
+		wantRole = models.KeyRoleKSK
+	}
+	var signing []signingKey
+	for _, key := range keys {
+		if key.role == wantRole && key.state == models.KeyActive {
+			signing = append(signing, key)
+		}
+	}
+	if len(signing) == 0 {
+		return nil, nil
+	}
+
+	ctx := context.Background()
+	name := normalizeName(hdr.Name)
+	recordType := models.RecordType(dns.Type(hdr.Rrtype).String())
+	digest := rrsetDigest(rrset, signing)
+	now := time.Now()
+	validity := signatureValidity(h.cfg)
+
+	cached, err := h.redisClient.GetSignatures(ctx, zone, name, recordType)
+	if err == nil && cached != nil && cached.Digest == digest {
+		if sigs := cachedSignatures(cached, hdr, now.Add(validity/4)); sigs != nil {
+			atomic.AddInt64(&h.stats.CacheHits, 1)
+			return sigs, nil
+		}
+	}
+
+	sigSet := &models.SignatureSet{Zone: zone, Name: name, Type: recordType, Digest: digest}
+	var sigs []dns.RR
+	for _, key := range signing {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: hdr.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: hdr.Ttl},
+			KeyTag:     key.dnskey.KeyTag(),
+			SignerName: dns.Fqdn(zone),
+			Algorithm:  key.dnskey.Algorithm,
+			// Allow for clock skew between us and validators
+			Inception:  uint32(now.Add(-time.Hour).Unix()),
+			Expiration: uint32(now.Add(validity).Unix()),
+		}
+		if err := sig.Sign(key.signer, rrset); err != nil {
+			return nil, fmt.Errorf("failed to sign %s %s: %w", hdr.Name, recordType, err)
+		}
+		sigs = append(sigs, sig)
+		sigSet.RRSIGs = append(sigSet.RRSIGs, sig.String())
+	}
+
+	if err := h.redisClient.SetSignatures(ctx, sigSet, validity/2); err != nil {
+		h.logger.Warnf("Failed to cache signatures: %v", err)
+	}
+
+	return sigs, nil
+}
+
+// withOwner returns copies of the records of an RRset with a different
+// owner name, or the RRset itself if the name is the same
+func withOwner(rrset []dns.RR, owner string) []dns.RR {
+	if rrset[0].Header().Name == owner {
+		return rrset
+	}
+
+	renamed := make([]dns.RR, len(rrset))
+	for i, rr := range rrset {
+		renamed[i] = dns.Copy(rr)
+		renamed[i].Header().Name = owner
+	}
+	return renamed
+}
+
+// cachedSignatures parses cached RRSIGs for an RRset with the given header.
+// It returns nil if any signature expires before notAfter or was made for a
+// lower TTL than the RRset is served with.
+func cachedSignatures(sigSet *models.SignatureSet, hdr *dns.RR_Header, notAfter time.Time) []dns.RR {
+	var sigs []dns.RR
+	for _, text := range sigSet.RRSIGs {
+		rr, err := dns.NewRR(text)
+		if err != nil {
+			return nil
+		}
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok || int64(sig.Expiration) < notAfter.Unix() || sig.OrigTtl < hdr.Ttl {
+			return nil
+		}
+
+		// Answer with the owner name and TTL of the RRset as served
+		sig.Hdr.Name = hdr.Name
+		sig.Hdr.Ttl = hdr.Ttl
+		sigs = append(sigs, sig)
+	}
+	return sigs
+}
+
+// rrsetDigest identifies the contents of an RRset and the keys signing it,
+// ignoring TTLs and the case of owner names
+func rrsetDigest(rrset []dns.RR, keys []signingKey) string {
+	var lines []string
+	for _, rr := range rrset {
+		rr = dns.Copy(rr)
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		rr.Header().Ttl = 0
+		lines = append(lines, rr.String())
+	}
+	sort.Strings(lines)
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("key %d", key.dnskey.KeyTag()))
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/PooriaJ/RediDNS/util"
+	"github.com/miekg/dns"
+)
+
+// DoHPath is the path DNS over HTTPS queries are answered at (RFC 8484)
+const DoHPath = "/dns-query"
+
+// Media types of DNS over HTTPS requests and responses
+const (
+	dnsMessageType = "application/dns-message" // RFC 8484 section 6
+	dnsJSONType    = "application/dns-json"    // JSON API of public resolvers
+)
+
+// dohHandler answers DNS over HTTPS requests with the DNSHandler, so they
+// share its caches and statistics with the DNS listeners. Besides the wire
+// format of RFC 8484 it answers GET requests with a name parameter in the
+// JSON format of the DoH APIs of public resolvers.
+type dohHandler struct {
+	handler  *DNSHandler
+	tsigKeys dns.TsigProvider
+	opts     listenerOptions
+}
+
+// ServeHTTP implements http.Handler
+func (d *dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var wire []byte
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		if !query.Has("dns") && query.Has("name") {
+			d.serveJSON(w, r)
+			return
+		}
+		// The parameter is base64url without padding, which some clients send anyway
+		var err error
+		wire, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(query.Get("dns"), "="))
+		if err != nil || len(wire) == 0 {
+			http.Error(w, "Invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != dnsMessageType {
+			http.Error(w, "Content-Type must be "+dnsMessageType, http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		wire, err = io.ReadAll(http.MaxBytesReader(w, r.Body, dns.MaxMsgSize))
+		if err != nil {
+			http.Error(w, "Invalid DNS message", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(wire); err != nil {
+		http.Error(w, "Invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	resp, requestMAC := d.exchange(r, req, wire)
+	var body []byte
+	var err error
+	if resp.IsTsig() != nil {
+		body, _, err = dns.TsigGenerateWithProvider(resp, d.tsigKeys, requestMAC, false)
+	} else {
+		body, err = resp.Pack()
+	}
+	if err != nil {
+		d.handler.logger.Errorf("Error packing DNS over HTTPS response: %v", err)
+		http.Error(w, "Failed to pack DNS response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dnsMessageType)
+	setCacheControl(w, resp)
+	w.Write(body)
+}
+
+// serveJSON answers a query given by the name, type, do and cd parameters
+// with the response in JSON
+func (d *dohHandler) serveJSON(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	name := dns.Fqdn(query.Get("name"))
+	if _, ok := dns.IsDomainName(name); !ok {
+		http.Error(w, "Invalid name parameter", http.StatusBadRequest)
+		return
+	}
+	qtype := dns.TypeA
+	if t := query.Get("type"); t != "" {
+		code, ok := util.RecordTypeCode(strings.ToUpper(t))
+		if !ok {
+			n, err := strconv.ParseUint(t, 10, 16)
+			if err != nil {
+				http.Error(w, "Invalid type parameter", http.StatusBadRequest)
+				return
+			}
+			code = uint16(n)
+		}
+		qtype = code
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.CheckingDisabled = isTrue(query.Get("cd"))
+	if isTrue(query.Get("do")) {
+		req.SetEdns0(dns.DefaultMsgSize, true)
+	}
+
+	resp, _ := d.exchange(r, req, nil)
+	body := dohJSONResponse{
+		Status: resp.Rcode,
+		TC:     resp.Truncated,
+		RD:     resp.RecursionDesired,
+		RA:     resp.RecursionAvailable,
+		AD:     resp.AuthenticatedData,
+		CD:     resp.CheckingDisabled,
+	}
+	for _, q := range resp.Question {
+		body.Question = append(body.Question, dohJSONQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	body.Answer = jsonRecords(resp.Answer)
+	body.Authority = jsonRecords(resp.Ns)
+	body.Additional = jsonRecords(resp.Extra)
+
+	w.Header().Set("Content-Type", dnsJSONType)
+	setCacheControl(w, resp)
+	json.NewEncoder(w).Encode(body)
+}
+
+// exchange answers a request with the DNSHandler and returns the response
+// and the MAC of the request's TSIG record, which signing the response
+// needs. wire is the request as received, nil if it was built here.
+func (d *dohHandler) exchange(r *http.Request, req *dns.Msg, wire []byte) (*dns.Msg, string) {
+	w := &dohWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{}}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		w.local = local
+	}
+	if remote, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		w.remote = net.TCPAddrFromAddrPort(remote)
+	}
+
+	// Only queries are answered: zone transfers take several messages,
+	// which a response can't carry, and NOTIFY and UPDATE are left to the
+	// DNS listeners their address lists are written for
+	if req.Opcode != dns.OpcodeQuery ||
+		len(req.Question) == 1 && (req.Question[0].Qtype == dns.TypeAXFR || req.Question[0].Qtype == dns.TypeIXFR) {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+		atomic.AddInt64(&d.handler.stats.Queries, 1)
+		atomic.AddInt64(&d.handler.stats.Refused, 1)
+		return m, ""
+	}
+
+	// Signed requests are verified here as the DNS listeners do
+	var requestMAC string
+	if t := req.IsTsig(); t != nil {
+		requestMAC = t.MAC
+		w.tsigStatus = dns.TsigVerifyWithProvider(wire, d.tsigKeys, "", false)
+	}
+
+	d.handler.serve(w, req, d.opts)
+	if w.msg == nil {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		return m, ""
+	}
+	return w.msg, requestMAC
+}
+
+// setCacheControl lets HTTP caches keep a response as long as its shortest
+// TTL (RFC 8484 section 5.1)
+func setCacheControl(w http.ResponseWriter, m *dns.Msg) {
+	ttl := -1
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			switch rr.Header().Rrtype {
+			case dns.TypeOPT, dns.TypeTSIG:
+				continue
+			}
+			if ttl < 0 || int(rr.Header().Ttl) < ttl {
+				ttl = int(rr.Header().Ttl)
+			}
+		}
+	}
+	if ttl >= 0 {
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(ttl))
+	}
+}
+
+// isTrue reports whether a flag parameter of a JSON query is set
+func isTrue(value string) bool {
+	return value == "1" || strings.EqualFold(value, "true")
+}
+
+// dohJSONResponse is a DNS response in the JSON format of public resolvers
+type dohJSONResponse struct {
+	Status     int               `json:"Status"`
+	TC         bool              `json:"TC"`
+	RD         bool              `json:"RD"`
+	RA         bool              `json:"RA"`
+	AD         bool              `json:"AD"`
+	CD         bool              `json:"CD"`
+	Question   []dohJSONQuestion `json:"Question"`
+	Answer     []dohJSONRecord   `json:"Answer,omitempty"`
+	Authority  []dohJSONRecord   `json:"Authority,omitempty"`
+	Additional []dohJSONRecord   `json:"Additional,omitempty"`
+}
+
+// dohJSONQuestion is the question of a JSON response
+type dohJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+// dohJSONRecord is a record of a JSON response
+type dohJSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// jsonRecords converts the records of a section to JSON, leaving out the
+// OPT pseudo-record
+func jsonRecords(rrs []dns.RR) []dohJSONRecord {
+	var records []dohJSONRecord
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		records = append(records, dohJSONRecord{Name: hdr.Name, Type: hdr.Rrtype, TTL: hdr.Ttl, Data: util.RData(rr)})
+	}
+	return records
+}
+
+// dohWriter is the dns.ResponseWriter of a DNS over HTTPS request. It keeps
+// the response to be written to the HTTP response.
+type dohWriter struct {
+	local      net.Addr
+	remote     net.Addr
+	msg        *dns.Msg
+	tsigStatus error // Result of verifying the request's TSIG
+}
+
+// LocalAddr implements dns.ResponseWriter
+func (w *dohWriter) LocalAddr() net.Addr { return w.local }
+
+// RemoteAddr implements dns.ResponseWriter
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+
+// WriteMsg implements dns.ResponseWriter
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	if w.msg != nil {
+		return errors.New("DNS over HTTPS responses are a single message")
+	}
+	w.msg = m
+	return nil
+}
+
+// Write implements dns.ResponseWriter
+func (w *dohWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(m)
+}
+
+// Close implements dns.ResponseWriter
+func (w *dohWriter) Close() error { return nil }
+
+// TsigStatus implements dns.ResponseWriter
+func (w *dohWriter) TsigStatus() error { return w.tsigStatus }
+
+// TsigTimersOnly implements dns.ResponseWriter
+func (w *dohWriter) TsigTimersOnly(bool) {}
+
+// Hijack implements dns.ResponseWriter
+func (w *dohWriter) Hijack() {}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/PooriaJ/RediDNS/config"
+	"github.com/PooriaJ/RediDNS/db"
+	"github.com/PooriaJ/RediDNS/models"
+	"github.com/PooriaJ/RediDNS/util"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// notifier sends DNS NOTIFY messages (RFC 1996) to the secondaries listed in
+// a zone's also_notify setting whenever the zone's serial changes
+type notifier struct {
+	cfg           *config.Config
+	redisClient   *db.RedisClient
+	mariadbClient *db.MariaDBClient
+	logger        *logrus.Logger
+	tsigKeys      *tsigKeyring // Signs messages to zones with a transfer key
+
+	mu   sync.Mutex
+	runs map[string]*notifyRun // Notifications in progress per zone
+}
+
+// notifyRun is the notification of all secondaries of a zone about a serial
+type notifyRun struct {
+	cancel context.CancelCauseFunc
+	done   chan struct{} // Closed once every target is finished
+}
+
+// errSuperseded cancels the notification of a serial once a newer one is
+// announced
+var errSuperseded = errors.New("superseded by a newer serial")
+
+// newNotifier creates a new notifier
+func newNotifier(cfg *config.Config, redisClient *db.RedisClient, mariadbClient *db.MariaDBClient, tsigKeys *tsigKeyring, logger *logrus.Logger) *notifier {
+	return &notifier{
+		cfg:           cfg,
+		redisClient:   redisClient,
+		mariadbClient: mariadbClient,
+		logger:        logger,
+		tsigKeys:      tsigKeys,
+		runs:          make(map[string]*notifyRun),
+	}
+}
+
+// run listens for zone updates from Redis pub/sub until ctx is done
+func (n *notifier) run(ctx context.Context) {
+	pubsub := n.redisClient.SubscribeToZoneUpdates(ctx)
+	defer pubsub.Close()
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-ch:
+			var update models.ZoneUpdate
+			if err := json.Unmarshal([]byte(msg.Payload), &update); err != nil {
+				n.logger.Errorf("Failed to parse zone update: %v", err)
+				continue
+			}
+			n.notifyZone(ctx, &update)
+		}
+	}
+}
+
+// notifyZone notifies all secondaries of a zone about a new serial. Retries
+// still running for an older serial are abandoned, and the new notification
+// starts once they have recorded it so their states don't overwrite ours.
+func (n *notifier) notifyZone(ctx context.Context, update *models.ZoneUpdate) {
+	zone, err := n.mariadbClient.GetZone(update.Zone)
+	if err != nil {
+		n.logger.Errorf("Failed to get zone %s for NOTIFY: %v", update.Zone, err)
+		return
+	}
+	if zone == nil || len(zone.AlsoNotify) == 0 {
+		return
+	}
+
+	n.mu.Lock()
+	prev := n.runs[zone.Name]
+	if prev != nil {
+		prev.cancel(errSuperseded)
+	}
+	zoneCtx, cancel := context.WithCancelCause(ctx)
+	run := &notifyRun{cancel: cancel, done: make(chan struct{})}
+	n.runs[zone.Name] = run
+	n.mu.Unlock()
+
+	go func() {
+		defer close(run.done)
+		if prev != nil {
+			<-prev.done
+		}
+
+		var wg sync.WaitGroup
+		for _, target := range zone.AlsoNotify {
+			wg.Add(1)
+			go func(target string) {
+				defer wg.Done()
+				n.notifyTarget(zoneCtx, zone.Name, zone.TransferKey, target, update.Serial)
+			}(target)
+		}
+		wg.Wait()
+
+		n.mu.Lock()
+		if n.runs[zone.Name] == run {
+			delete(n.runs, zone.Name)
+		}
+		n.mu.Unlock()
+		cancel(nil)
+	}()
+}
+
+// notifyTarget sends a NOTIFY to a single secondary, retrying with
+// exponential backoff until it is acknowledged or the retries run out. The
+// NOTIFY is signed with key unless it is empty.
+func (n *notifier) notifyTarget(ctx context.Context, zone, key, target string, serial uint32) {
+	status := &models.NotifyStatus{
+		Zone:   zone,
+		Target: target,
+		Serial: serial,
+		State:  models.NotifyPending,
+	}
+
+	retries := n.cfg.DNS.Notify.Retries
+	if retries < 1 {
+		retries = 1
+	}
+	interval := time.Duration(n.cfg.DNS.Notify.Interval) * time.Second
+
+	for attempt := 1; ; attempt++ {
+		if ctx.Err() != nil {
+			n.abandon(ctx, status)
+			return
+		}
+
+		status.Attempts = attempt
+		err := n.send(zone, key, util.HostPort(target, 53), serial)
+		if err == nil {
+			n.logger.Infof("NOTIFY for %s serial %d acknowledged by %s", zone, serial, target)
+			status.State = models.NotifySucceeded
+			status.LastError = ""
+			n.saveStatus(status)
+			return
+		}
+
+		status.LastError = err.Error()
+		if attempt >= retries {
+			break
+		}
+		n.saveStatus(status)
+
+		select {
+		case <-ctx.Done():
+			n.abandon(ctx, status)
+			return
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+
+	n.logger.Warnf("NOTIFY for %s serial %d to %s failed after %d attempts: %s", zone, serial, target, status.Attempts, status.LastError)
+	status.State = models.NotifyFailed
+	n.saveStatus(status)
+}
+
+// send sends one NOTIFY message and waits for the acknowledgement, which
+// must be signed too when the NOTIFY is
+func (n *notifier) send(zone, key, addr string, serial uint32) error {
+	m := new(dns.Msg)
+	m.SetNotify(dns.Fqdn(zone))
+
+	// Include the new SOA as a hint (RFC 1996 section 3.7)
+	records, err := n.mariadbClient.GetRecordsByNameAndType(zone, zone, models.TypeSOA)
+	if err == nil && len(records) > 0 {
+		if rr, err := recordToRR(&records[0], dns.Fqdn(zone)); err == nil {
+			rr.(*dns.SOA).Serial = serial
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+
+	if err := n.tsigKeys.sign(m, key); err != nil {
+		return err
+	}
+
+	c := &dns.Client{
+		Net:          "udp",
+		Timeout:      time.Duration(n.cfg.DNS.Notify.Timeout) * time.Second,
+		TsigProvider: n.tsigKeys,
+	}
+	resp, _, err := c.Exchange(m, addr)
+	if err != nil {
+		return err
+	}
+	if key != "" && resp.IsTsig() == nil {
+		return fmt.Errorf("unsigned reply to signed NOTIFY")
+	}
+	if resp.Opcode != dns.OpcodeNotify || resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("unexpected reply %s/%s", dns.OpcodeToString[resp.Opcode], dns.RcodeToString[resp.Rcode])
+	}
+
+	return nil
+}
+
+// abandon records a NOTIFY given up on before it was acknowledged, as
+// superseded if a newer serial is being announced and as failed otherwise
+func (n *notifier) abandon(ctx context.Context, status *models.NotifyStatus) {
+	status.State = models.NotifyFailed
+	if errors.Is(context.Cause(ctx), errSuperseded) {
+		status.State = models.NotifySuperseded
+	} else if status.LastError == "" {
+		status.LastError = context.Cause(ctx).Error()
+	}
+	n.logger.Debugf("NOTIFY for %s serial %d to %s abandoned: %v", status.Zone, status.Serial, status.Target, context.Cause(ctx))
+	n.saveStatus(status)
+}
+
+// saveStatus stores the delivery state of a NOTIFY for the API
+func (n *notifier) saveStatus(status *models.NotifyStatus) {
+	if err := n.mariadbClient.SetNotifyStatus(status); err != nil {
+		n.logger.Warnf("Failed to store NOTIFY status for %s: %v", status.Zone, err)
+	}
+}
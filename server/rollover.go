@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/PooriaJ/RediDNS/config"
+	"github.com/PooriaJ/RediDNS/db"
+	"github.com/PooriaJ/RediDNS/models"
+	"github.com/PooriaJ/RediDNS/util"
+	"github.com/sirupsen/logrus"
+)
+
+// rolloverInterval is how often the key timelines of signed zones are checked
+const rolloverInterval = 5 * time.Minute
+
+// rolloverScheduler rolls the DNSSEC keys of signed zones over once they
+// reach their configured lifetime. ZSKs are rolled with the pre-publish
+// method and KSKs with the double-signature method (RFC 6781 section 4.1),
+// the old KSK staying until the parent publishes the DS of the new one.
+type rolloverScheduler struct {
+	cfg           *config.Config
+	redisClient   *db.RedisClient
+	mariadbClient *db.MariaDBClient
+	logger        *logrus.Logger
+}
+
+// newRolloverScheduler creates a new rollover scheduler
+func newRolloverScheduler(cfg *config.Config, redisClient *db.RedisClient, mariadbClient *db.MariaDBClient, logger *logrus.Logger) *rolloverScheduler {
+	return &rolloverScheduler{
+		cfg:           cfg,
+		redisClient:   redisClient,
+		mariadbClient: mariadbClient,
+		logger:        logger,
+	}
+}
+
+// run advances the key timelines of all signed zones until ctx is done
+func (s *rolloverScheduler) run(ctx context.Context) {
+	ticker := time.NewTicker(rolloverInterval)
+	defer ticker.Stop()
+
+	for {
+		s.rollZones()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rollZones advances the key timeline of every signed zone
+func (s *rolloverScheduler) rollZones() {
+	zones, err := s.mariadbClient.GetSignedZones()
+	if err != nil {
+		s.logger.Errorf("Failed to get signed zones for key rollover: %v", err)
+		return
+	}
+
+	for _, zone := range zones {
+		s.checkParentDS(zone)
+
+		maxTTL, err := s.mariadbClient.MaxRecordTTL(zone)
+		if err != nil {
+			s.logger.Errorf("Failed to get the maximum TTL of zone %s: %v", zone, err)
+			continue
+		}
+
+		changed := false
+		err = s.mariadbClient.UpdateDNSSECKeys(zone, func(keys []models.DNSSECKey) ([]models.DNSSECKey, error) {
+			updated, err := s.advance(zone, keys, time.Duration(maxTTL)*time.Second, time.Now())
+			changed = len(updated) > 0
+			return updated, err
+		})
+		if err != nil {
+			s.logger.Errorf("Failed to roll DNSSEC keys of zone %s: %v", zone, err)
+			continue
+		}
+		if changed {
+			s.keysChanged(zone)
+		}
+	}
+}
+
+// keysChanged announces that the keys of a zone changed, so the DNS servers
+// reload them
+func (s *rolloverScheduler) keysChanged(zone string) {
+	if err := s.redisClient.PublishDNSSECKeysUpdate(context.Background(), zone); err != nil {
+		s.logger.Warnf("Failed to publish DNSSEC key update of zone %s: %v", zone, err)
+	}
+}
+
+// advance moves the keys of a zone along their timelines and starts a new
+// rollover for each role whose active key has reached its lifetime. maxTTL is
+// the longest TTL of the records in the zone. It returns the keys that
+// changed, including newly generated ones.
+func (s *rolloverScheduler) advance(zone string, keys []models.DNSSECKey, maxTTL time.Duration, now time.Time) ([]models.DNSSECKey, error) {
+	// KSKs being replaced stay until the parent publishes the DS of their
+	// successor, however long that takes
+	awaitingDS := util.AwaitingDS(keys)
+
+	changed := make(map[int]bool)
+	for i := range keys {
+		key := &keys[i]
+		state := key.State
+		switch {
+		case key.State == models.KeyRemoved:
+			continue
+		case awaitingDS && key.Role == models.KeyRoleKSK && key.RetireAt != nil:
+			continue
+		case due(key.RemoveAt, now):
+			key.State = models.KeyRemoved
+		case key.State != models.KeyRetired && due(key.RetireAt, now):
+			key.State = models.KeyRetired
+		case key.State == models.KeyPublished && due(key.ActiveAt, now):
+			key.State = models.KeyActive
+		}
+		if key.State != state {
+			s.logger.Infof("DNSSEC %s %d of zone %s is now %s", key.Role, key.KeyTag, zone, key.State)
+			changed[i] = true
+		}
+	}
+
+	propagation := time.Duration(s.cfg.DNS.DNSSEC.PropagationDelay) * time.Second
+	lifetimes := map[models.KeyRole]int{
+		models.KeyRoleKSK: s.cfg.DNS.DNSSEC.KSKLifetime,
+		models.KeyRoleZSK: s.cfg.DNS.DNSSEC.ZSKLifetime,
+	}
+
+	var created []models.DNSSECKey
+	for _, role := range []models.KeyRole{models.KeyRoleKSK, models.KeyRoleZSK} {
+		lifetime := time.Duration(lifetimes[role]) * time.Second
+		if lifetime <= 0 {
+			continue
+		}
+
+		current := util.CurrentKey(keys, role)
+		if current < 0 || rollingOver(keys, role) || now.Sub(activeSince(&keys[current])) < lifetime {
+			continue
+		}
+
+		key, err := util.GenerateDNSSECKey(zone, role)
+		if err != nil {
+			return nil, err
+		}
+		key.PublishedAt = &now
+
+		old := &keys[current]
+		if role == models.KeyRoleZSK {
+			// Pre-publish: the new ZSK is in the DNSKEY RRset for a
+			// propagation delay before it signs, then the old ZSK stays
+			// published until signatures made with it have expired, both
+			// from caches, which keep them for up to the longest TTL in the
+			// zone, and from responses signed just before the switch
+			activeAt := now.Add(propagation)
+			removeAt := activeAt.Add(max(maxTTL, signatureValidity(s.cfg)) + propagation)
+			key.State = models.KeyPublished
+			key.ActiveAt = &activeAt
+			old.RetireAt = &activeAt
+			old.RemoveAt = &removeAt
+		} else {
+			// Double-signature: both KSKs sign the DNSKEY RRset until the
+			// parent publishes the DS of the new one, which is not expected
+			// before the DS delay
+			removeAt := now.Add(time.Duration(s.cfg.DNS.DNSSEC.DSDelay) * time.Second)
+			key.State = models.KeyActive
+			key.ActiveAt = &now
+			old.RetireAt = &removeAt
+			old.RemoveAt = &removeAt
+		}
+		changed[current] = true
+		created = append(created, *key)
+
+		s.logger.Infof("Rolling DNSSEC %s %d of zone %s over to %d", role, old.KeyTag, zone, key.KeyTag)
+	}
+
+	var result []models.DNSSECKey
+	for i := range keys {
+		if changed[i] {
+			result = append(result, keys[i])
+		}
+	}
+	return append(result, created...), nil
+}
+
+// rollingOver reports whether a rollover of the given role is in progress,
+// that is whether any key besides the current one is still in the zone
+func rollingOver(keys []models.DNSSECKey, role models.KeyRole) bool {
+	for i := range keys {
+		key := &keys[i]
+		if key.Role != role || key.State == models.KeyRemoved {
+			continue
+		}
+		if key.State != models.KeyActive || key.RetireAt != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// activeSince returns when a key started signing. Keys created before key
+// timelines were tracked fall back to their creation time.
+func activeSince(key *models.DNSSECKey) time.Time {
+	if key.ActiveAt != nil {
+		return *key.ActiveAt
+	}
+	return key.CreatedAt
+}
+
+// due reports whether a timeline event has been reached
+func due(at *time.Time, now time.Time) bool {
+	return at != nil && !now.Before(*at)
+}
+
+// checkParentDS asks the configured resolvers whether the parent of a zone
+// whose KSK rollover waits for the new DS publishes it now, and records it
+// if so. Without resolvers the DS has to be confirmed through the API.
+func (s *rolloverScheduler) checkParentDS(zone string) {
+	if len(s.cfg.DNS.DNSSEC.Resolvers) == 0 {
+		return
+	}
+
+	keys, err := s.mariadbClient.GetDNSSECKeys(zone)
+	if err != nil {
+		s.logger.Errorf("Failed to get DNSSEC keys of zone %s: %v", zone, err)
+		return
+	}
+	if !util.AwaitingDS(keys) {
+		return
+	}
+
+	ksk := &keys[util.CurrentKey(keys, models.KeyRoleKSK)]
+	published, err := s.parentPublishesDS(zone, ksk)
+	if err != nil {
+		s.logger.Warnf("Failed to look up the DS of zone %s: %v", zone, err)
+		return
+	}
+	if !published {
+		s.logger.Debugf("Parent of zone %s does not publish the DS of KSK %d yet", zone, ksk.KeyTag)
+		return
+	}
+
+	propagation := time.Duration(s.cfg.DNS.DNSSEC.PropagationDelay) * time.Second
+	err = s.mariadbClient.UpdateDNSSECKeys(zone, func(keys []models.DNSSECKey) ([]models.DNSSECKey, error) {
+		if !util.AwaitingDS(keys) {
+			return nil, nil
+		}
+		return util.ConfirmDS(keys, time.Now(), propagation), nil
+	})
+	if err != nil {
+		s.logger.Errorf("Failed to record the DS of zone %s: %v", zone, err)
+		return
+	}
+	s.logger.Infof("Parent of zone %s publishes the DS of KSK %d", zone, ksk.KeyTag)
+	s.keysChanged(zone)
+}
+
+// parentPublishesDS reports whether the DS RRset of a zone, as the
+// configured resolvers see it, references a KSK. A zone without DS records
+// is insecurely delegated, which needs no KSK either, so that counts too.
+func (s *rolloverScheduler) parentPublishesDS(zone string, ksk *models.DNSSECKey) (bool, error) {
+	records, err := util.LookupDS(s.cfg.DNS.DNSSEC.Resolvers, zone)
+	if err != nil {
+		return false, err
+	}
+	for _, ds := range records {
+		if util.MatchesDS(ds, ksk) {
+			return true, nil
+		}
+	}
+	return len(records) == 0, nil
+}
@@ -0,0 +1,555 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+
+	"github.com/PooriaJ/RediDNS/models"
+	"github.com/PooriaJ/RediDNS/util"
+	"github.com/miekg/dns"
+)
+
+// recordToRR converts a stored record into a resource record owned by owner
+func recordToRR(record *models.Record, owner string) (dns.RR, error) {
+	var rr dns.RR
+
+	switch record.Type {
+	case models.TypeA:
+		rr = &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(record.TTL),
+			},
+			A: net.ParseIP(record.Content),
+		}
+
+	case models.TypeAAAA:
+		rr = &dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(record.TTL),
+			},
+			AAAA: net.ParseIP(record.Content),
+		}
+
+	case models.TypeCNAME:
+		rr = &dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeCNAME,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(record.TTL),
+			},
+			Target: dns.Fqdn(record.Content),
+		}
+
+	case models.TypeDNAME:
+		rr = &dns.DNAME{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeDNAME,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(record.TTL),
+			},
+			Target: dns.Fqdn(record.Content),
+		}
+
+	case models.TypeMX:
+		rr = &dns.MX{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeMX,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(record.TTL),
+			},
+			Preference: uint16(record.Priority),
+			Mx:         dns.Fqdn(record.Content),
+		}
+
+	case models.TypeNS:
+		rr = &dns.NS{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeNS,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(record.TTL),
+			},
+			Ns: dns.Fqdn(record.Content),
+		}
+
+	case models.TypePTR:
+		rr = &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(record.TTL),
+			},
+			Ptr: dns.Fqdn(record.Content),
+		}
+
+	case models.TypeTXT:
+		// Long values are split into several character-strings
+		txt, err := util.TXTStrings(record.Content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse TXT record: %w", err)
+		}
+
+		rr = &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(record.TTL),
+			},
+			Txt: txt,
+		}
+
+	case models.TypeSOA:
+		// Parse SOA record content
+		var soaData models.SOARecord
+		if err := json.Unmarshal([]byte(record.Content), &soaData); err != nil {
+			return nil, fmt.Errorf("failed to parse SOA record: %w", err)
+		}
+
+		rr = &dns.SOA{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeSOA,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(record.TTL),
+			},
+			Ns:      dns.Fqdn(soaData.Mname),
+			Mbox:    dns.Fqdn(soaData.Rname),
+			Serial:  soaData.Serial,
+			Refresh: soaData.Refresh,
+			Retry:   soaData.Retry,
+			Expire:  soaData.Expire,
+			Minttl:  soaData.Minimum,
+		}
+
+	case models.TypeSRV:
+		// Parse SRV record content
+		var srv models.SRVRecord
+		if err := json.Unmarshal([]byte(record.Content), &srv); err != nil {
+			return nil, fmt.Errorf("failed to parse SRV record: %w", err)
+		}
+
+		rr = &dns.SRV{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeSRV,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(record.TTL),
+			},
+			Priority: srv.Priority,
+			Weight:   srv.Weight,
+			Port:     srv.Port,
+			Target:   dns.Fqdn(srv.Target),
+		}
+
+	case models.TypeCAA:
+		// Parse CAA record content
+		var caa models.CAARecord
+		if err := json.Unmarshal([]byte(record.Content), &caa); err != nil {
+			return nil, fmt.Errorf("failed to parse CAA record: %w", err)
+		}
+
+		rr = &dns.CAA{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeCAA,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(record.TTL),
+			},
+			Flag:  caa.Flag,
+			Tag:   caa.Tag,
+			Value: caa.Value,
+		}
+
+	case models.TypeDS:
+		// Parse DS record content
+		var ds models.DSRecord
+		if err := json.Unmarshal([]byte(record.Content), &ds); err != nil {
+			return nil, fmt.Errorf("failed to parse DS record: %w", err)
+		}
+
+		rr = &dns.DS{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeDS,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(record.TTL),
+			},
+			KeyTag:     ds.KeyTag,
+			Algorithm:  ds.Algorithm,
+			DigestType: ds.DigestType,
+			Digest:     strings.ToUpper(ds.Digest),
+		}
+
+	case models.TypeSVCB, models.TypeHTTPS:
+		// Parse SVCB record content, which HTTPS records share
+		var svcb models.SVCBRecord
+		if err := json.Unmarshal([]byte(record.Content), &svcb); err != nil {
+			return nil, fmt.Errorf("failed to parse %s record: %w", record.Type, err)
+		}
+		params, err := util.SVCBParams(svcb.Params)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s record: %w", record.Type, err)
+		}
+
+		binding := dns.SVCB{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.StringToType[string(record.Type)],
+				Class:  dns.ClassINET,
+				Ttl:    uint32(record.TTL),
+			},
+			Priority: svcb.Priority,
+			Target:   dns.Fqdn(svcb.Target),
+			Value:    params,
+		}
+		if record.Type == models.TypeHTTPS {
+			rr = &dns.HTTPS{SVCB: binding}
+		} else {
+			rr = &binding
+		}
+
+	case models.TypeTLSA:
+		// Parse TLSA record content
+		var tlsa models.TLSARecord
+		if err := json.Unmarshal([]byte(record.Content), &tlsa); err != nil {
+			return nil, fmt.Errorf("failed to parse TLSA record: %w", err)
+		}
+
+		rr = &dns.TLSA{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeTLSA,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(record.TTL),
+			},
+			Usage:        tlsa.Usage,
+			Selector:     tlsa.Selector,
+			MatchingType: tlsa.MatchingType,
+			Certificate:  strings.ToLower(tlsa.Certificate),
+		}
+
+	case models.TypeSSHFP:
+		// Parse SSHFP record content
+		var sshfp models.SSHFPRecord
+		if err := json.Unmarshal([]byte(record.Content), &sshfp); err != nil {
+			return nil, fmt.Errorf("failed to parse SSHFP record: %w", err)
+		}
+
+		rr = &dns.SSHFP{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeSSHFP,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(record.TTL),
+			},
+			Algorithm:   sshfp.Algorithm,
+			Type:        sshfp.Type,
+			FingerPrint: strings.ToLower(sshfp.Fingerprint),
+		}
+
+	case models.TypeNAPTR:
+		// Parse NAPTR record content
+		var naptr models.NAPTRRecord
+		if err := json.Unmarshal([]byte(record.Content), &naptr); err != nil {
+			return nil, fmt.Errorf("failed to parse NAPTR record: %w", err)
+		}
+
+		rr = &dns.NAPTR{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeNAPTR,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(record.TTL),
+			},
+			Order:       naptr.Order,
+			Preference:  naptr.Preference,
+			Flags:       naptr.Flags,
+			Service:     naptr.Service,
+			Regexp:      naptr.Regexp,
+			Replacement: dns.Fqdn(naptr.Replacement),
+		}
+
+	case models.TypeLOC:
+		// Parse LOC record content
+		var loc models.LOCRecord
+		if err := json.Unmarshal([]byte(record.Content), &loc); err != nil {
+			return nil, fmt.Errorf("failed to parse LOC record: %w", err)
+		}
+
+		rr = &dns.LOC{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeLOC,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(record.TTL),
+			},
+			Size:      locPrecision(loc.Size, locDefaultSize),
+			HorizPre:  locPrecision(loc.HorizPre, locDefaultHorizPre),
+			VertPre:   locPrecision(loc.VertPre, locDefaultVertPre),
+			Latitude:  locAngle(loc.Latitude),
+			Longitude: locAngle(loc.Longitude),
+			Altitude:  uint32(math.Round((loc.Altitude + locAltitudeBase) * 100)),
+		}
+
+	case models.TypeURI:
+		// Parse URI record content
+		var uri models.URIRecord
+		if err := json.Unmarshal([]byte(record.Content), &uri); err != nil {
+			return nil, fmt.Errorf("failed to parse URI record: %w", err)
+		}
+
+		rr = &dns.URI{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeURI,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(record.TTL),
+			},
+			Priority: uri.Priority,
+			Weight:   uri.Weight,
+			Target:   uri.Target,
+		}
+
+	default:
+		// Other types keep their RDATA in presentation format (RFC 3597)
+		if !record.Type.IsGeneric() {
+			return nil, fmt.Errorf("unsupported record type: %s", record.Type)
+		}
+		return util.ParseRData(owner, uint32(record.TTL), string(record.Type), record.Content)
+	}
+
+	return rr, nil
+}
+
+// rrToRecord converts a resource record received in a zone transfer into a
+// record of zone, the inverse of recordToRR
+func rrToRecord(rr dns.RR, zone string) (*models.Record, error) {
+	record := &models.Record{
+		Zone: zone,
+		Name: normalizeName(rr.Header().Name),
+		TTL:  int(rr.Header().Ttl),
+	}
+
+	switch rr := rr.(type) {
+	case *dns.A:
+		record.Type = models.TypeA
+		record.Content = rr.A.String()
+
+	case *dns.AAAA:
+		record.Type = models.TypeAAAA
+		record.Content = rr.AAAA.String()
+
+	case *dns.CNAME:
+		record.Type = models.TypeCNAME
+		record.Content = strings.TrimSuffix(rr.Target, ".")
+
+	case *dns.DNAME:
+		record.Type = models.TypeDNAME
+		record.Content = strings.TrimSuffix(rr.Target, ".")
+
+	case *dns.MX:
+		record.Type = models.TypeMX
+		record.Priority = int(rr.Preference)
+		record.Content = strings.TrimSuffix(rr.Mx, ".")
+
+	case *dns.NS:
+		record.Type = models.TypeNS
+		record.Content = strings.TrimSuffix(rr.Ns, ".")
+
+	case *dns.PTR:
+		record.Type = models.TypePTR
+		record.Content = strings.TrimSuffix(rr.Ptr, ".")
+
+	case *dns.TXT:
+		record.Type = models.TypeTXT
+		record.Content = util.TXTContent(rr.Txt)
+
+	case *dns.SOA:
+		return recordWithJSON(record, models.TypeSOA, models.SOARecord{
+			Mname:   strings.TrimSuffix(rr.Ns, "."),
+			Rname:   strings.TrimSuffix(rr.Mbox, "."),
+			Serial:  rr.Serial,
+			Refresh: rr.Refresh,
+			Retry:   rr.Retry,
+			Expire:  rr.Expire,
+			Minimum: rr.Minttl,
+		})
+
+	case *dns.SRV:
+		return recordWithJSON(record, models.TypeSRV, map[string]interface{}{
+			"priority": rr.Priority,
+			"weight":   rr.Weight,
+			"port":     rr.Port,
+			"target":   strings.TrimSuffix(rr.Target, "."),
+		})
+
+	case *dns.CAA:
+		return recordWithJSON(record, models.TypeCAA, map[string]interface{}{
+			"flag":  rr.Flag,
+			"tag":   rr.Tag,
+			"value": rr.Value,
+		})
+
+	case *dns.DS:
+		return recordWithJSON(record, models.TypeDS, map[string]interface{}{
+			"key_tag":     rr.KeyTag,
+			"algorithm":   rr.Algorithm,
+			"digest_type": rr.DigestType,
+			"digest":      rr.Digest,
+		})
+
+	case *dns.SVCB:
+		return recordWithJSON(record, models.TypeSVCB, svcbContent(rr))
+
+	case *dns.HTTPS:
+		return recordWithJSON(record, models.TypeHTTPS, svcbContent(&rr.SVCB))
+
+	case *dns.TLSA:
+		return recordWithJSON(record, models.TypeTLSA, models.TLSARecord{
+			Usage:        rr.Usage,
+			Selector:     rr.Selector,
+			MatchingType: rr.MatchingType,
+			Certificate:  rr.Certificate,
+		})
+
+	case *dns.SSHFP:
+		return recordWithJSON(record, models.TypeSSHFP, models.SSHFPRecord{
+			Algorithm:   rr.Algorithm,
+			Type:        rr.Type,
+			Fingerprint: rr.FingerPrint,
+		})
+
+	case *dns.NAPTR:
+		replacement := rr.Replacement
+		if replacement != "." {
+			replacement = strings.TrimSuffix(replacement, ".")
+		}
+		return recordWithJSON(record, models.TypeNAPTR, models.NAPTRRecord{
+			Order:       rr.Order,
+			Preference:  rr.Preference,
+			Flags:       rr.Flags,
+			Service:     rr.Service,
+			Regexp:      rr.Regexp,
+			Replacement: replacement,
+		})
+
+	case *dns.LOC:
+		return recordWithJSON(record, models.TypeLOC, models.LOCRecord{
+			Latitude:  locDegrees(rr.Latitude),
+			Longitude: locDegrees(rr.Longitude),
+			Altitude:  float64(rr.Altitude)/100 - locAltitudeBase,
+			Size:      locMeters(rr.Size),
+			HorizPre:  locMeters(rr.HorizPre),
+			VertPre:   locMeters(rr.VertPre),
+		})
+
+	case *dns.URI:
+		return recordWithJSON(record, models.TypeURI, models.URIRecord{
+			Priority: rr.Priority,
+			Weight:   rr.Weight,
+			Target:   rr.Target,
+		})
+
+	default:
+		// Types without a content model of their own are stored as RDATA
+		record.Type = models.RecordType(dns.Type(rr.Header().Rrtype).String())
+		record.Content = util.RData(rr)
+		if _, err := util.ParseRData(rr.Header().Name, rr.Header().Ttl, string(record.Type), record.Content); err != nil {
+			return nil, err
+		}
+	}
+
+	return record, nil
+}
+
+// recordWithJSON sets the type of record and its content to the JSON encoding of data
+func recordWithJSON(record *models.Record, recordType models.RecordType, data interface{}) (*models.Record, error) {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	record.Type = recordType
+	record.Content = string(content)
+	return record, nil
+}
+
+// svcbContent returns the stored content of an SVCB or HTTPS record
+func svcbContent(rr *dns.SVCB) models.SVCBRecord {
+	content := models.SVCBRecord{Priority: rr.Priority, Target: rr.Target}
+	if content.Target != "." {
+		content.Target = strings.TrimSuffix(content.Target, ".")
+	}
+	if len(rr.Value) > 0 {
+		content.Params = make(map[string]string)
+		for _, kv := range rr.Value {
+			content.Params[kv.Key().String()] = kv.String()
+		}
+	}
+	return content
+}
+
+// LOC records store altitudes in centimeters above 100000m below the WGS 84
+// reference spheroid and angles in thousandths of an arc second from the
+// equator or prime meridian, offset by 2^31 (RFC 1876 section 2)
+const (
+	locAltitudeBase = 100000
+	locAngleBase    = 1 << 31
+)
+
+// Sizes and precisions in meters of LOC records that omit them (RFC 1876
+// section 3)
+const (
+	locDefaultSize     = 1
+	locDefaultHorizPre = 10000
+	locDefaultVertPre  = 10
+)
+
+// locAngle encodes degrees as a LOC latitude or longitude
+func locAngle(degrees float64) uint32 {
+	return uint32(locAngleBase + int64(math.Round(degrees*3600000)))
+}
+
+// locDegrees decodes a LOC latitude or longitude
+func locDegrees(angle uint32) float64 {
+	return float64(int64(angle)-locAngleBase) / 3600000
+}
+
+// locPrecision encodes a size or precision in meters as a digit and a power
+// of ten of centimeters, or the default if it is omitted. The value is
+// rounded to whole centimeters, then any digits after the first are dropped.
+func locPrecision(meters *float64, defaultMeters float64) uint8 {
+	if meters == nil {
+		meters = &defaultMeters
+	}
+	cm := uint64(math.Round(*meters * 100))
+	var exponent uint8
+	for cm >= 10 && exponent < 9 {
+		cm /= 10
+		exponent++
+	}
+	if cm > 9 {
+		cm = 9
+	}
+	return uint8(cm)<<4 | exponent
+}
+
+// locMeters decodes a LOC size or precision
+func locMeters(precision uint8) *float64 {
+	meters := float64(precision>>4) * math.Pow10(int(precision&0x0f)) / 100
+	return &meters
+}
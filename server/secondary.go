@@ -0,0 +1,554 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PooriaJ/RediDNS/config"
+	"github.com/PooriaJ/RediDNS/db"
+	"github.com/PooriaJ/RediDNS/models"
+	"github.com/PooriaJ/RediDNS/util"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// secondaryResync is how often the list of secondary zones is reloaded
+	// from the database, picking up zones added or removed through the API
+	secondaryResync = time.Minute
+
+	// secondaryRetry is how long to wait before retrying a zone that has
+	// never been transferred and so has no SOA retry interval yet
+	secondaryRetry = time.Minute
+
+	// secondaryTimeout bounds SOA queries and zone transfers from a primary
+	secondaryTimeout = 30 * time.Second
+)
+
+// secondaryManager keeps secondary zones in sync with their primaries. Each
+// zone is refreshed on its own schedule, following the refresh, retry and
+// expire timers of its SOA (RFC 1034 section 4.3.5), and immediately when a
+// primary sends a NOTIFY.
+type secondaryManager struct {
+	cfg           *config.Config
+	redisClient   *db.RedisClient
+	mariadbClient *db.MariaDBClient
+	logger        *logrus.Logger
+	tsigKeys      *tsigKeyring // Signs requests of zones with a transfer key
+
+	mu    sync.Mutex
+	zones map[string]*secondaryZone
+}
+
+// secondaryZone is the refresh state of a single secondary zone
+type secondaryZone struct {
+	name    string
+	trigger chan struct{} // Requests an immediate refresh
+	cancel  context.CancelFunc
+	expired atomic.Bool // Set when the zone must no longer be served
+
+	mu        sync.Mutex
+	primaries []string
+	key       string // TSIG key requests to the primaries are signed with
+}
+
+// newSecondaryManager creates a new secondary zone manager
+func newSecondaryManager(cfg *config.Config, redisClient *db.RedisClient, mariadbClient *db.MariaDBClient, tsigKeys *tsigKeyring, logger *logrus.Logger) *secondaryManager {
+	return &secondaryManager{
+		cfg:           cfg,
+		redisClient:   redisClient,
+		mariadbClient: mariadbClient,
+		logger:        logger,
+		tsigKeys:      tsigKeys,
+		zones:         make(map[string]*secondaryZone),
+	}
+}
+
+// run keeps the secondary zones in sync until ctx is done
+func (s *secondaryManager) run(ctx context.Context) {
+	ticker := time.NewTicker(secondaryResync)
+	defer ticker.Stop()
+
+	for {
+		s.sync(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync starts refreshing newly configured secondary zones and stops
+// refreshing zones that were deleted or turned into primary zones
+func (s *secondaryManager) sync(ctx context.Context) {
+	zones, err := s.mariadbClient.GetAllZones()
+	if err != nil {
+		s.logger.Errorf("Failed to load secondary zones: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, zone := range zones {
+		if zone.Kind != models.ZoneSecondary {
+			continue
+		}
+		seen[zone.Name] = true
+
+		z, ok := s.zones[zone.Name]
+		if !ok {
+			zoneCtx, cancel := context.WithCancel(ctx)
+			z = &secondaryZone{
+				name:    zone.Name,
+				trigger: make(chan struct{}, 1),
+				cancel:  cancel,
+			}
+			s.zones[zone.Name] = z
+			s.logger.Infof("Serving %s as a secondary zone", zone.Name)
+			go s.refreshLoop(zoneCtx, z, zone.RefreshedAt)
+		}
+
+		z.mu.Lock()
+		z.primaries = zone.Primaries
+		z.key = zone.TransferKey
+		z.mu.Unlock()
+	}
+
+	for name, z := range s.zones {
+		if !seen[name] {
+			z.cancel()
+			delete(s.zones, name)
+		}
+	}
+}
+
+// notify requests an immediate refresh of a secondary zone. It reports
+// whether the zone is a secondary zone known to the manager.
+func (s *secondaryManager) notify(zone string) bool {
+	if s == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	z, ok := s.zones[zone]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	select {
+	case z.trigger <- struct{}{}:
+	default:
+		// A refresh is already pending
+	}
+	return true
+}
+
+// isExpired reports whether zone is a secondary zone that has expired, or has
+// not been transferred yet, and so must not be answered from
+func (s *secondaryManager) isExpired(zone string) bool {
+	if s == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	z, ok := s.zones[zone]
+	s.mu.Unlock()
+	return ok && z.expired.Load()
+}
+
+// refreshLoop refreshes a zone whenever its SOA timers or a NOTIFY say so.
+// refreshedAt is the last successful refresh stored for the zone, if any,
+// so a restart does not extend the time the zone is served for.
+func (s *secondaryManager) refreshLoop(ctx context.Context, z *secondaryZone, refreshedAt *time.Time) {
+	local, err := s.localSOA(z.name)
+	if err != nil {
+		s.logger.Errorf("Failed to load SOA of secondary zone %s: %v", z.name, err)
+	}
+
+	// A copy of the zone refreshed before this was recorded is considered
+	// fresh as of startup
+	lastRefresh := time.Now()
+	if refreshedAt != nil {
+		lastRefresh = *refreshedAt
+	}
+	z.expired.Store(local == nil || pastExpiry(local, lastRefresh))
+	if local != nil && z.expired.Load() {
+		s.logger.Errorf("Secondary zone %s expired, no successful refresh since %s", z.name, lastRefresh.Format(time.RFC3339))
+	}
+
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		case <-z.trigger:
+		}
+
+		soa, err := s.refresh(ctx, z)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			lastRefresh = time.Now()
+			if err := s.mariadbClient.SetZoneRefreshed(z.name, lastRefresh); err != nil {
+				s.logger.Warnf("Failed to store refresh time of secondary zone %s: %v", z.name, err)
+			}
+			z.expired.Store(false)
+			wait = time.Duration(soa.Refresh) * time.Second
+			continue
+		}
+
+		s.logger.Warnf("Failed to refresh secondary zone %s: %v", z.name, err)
+
+		// Without a SOA of our own there are no timers to follow yet
+		local, _ := s.localSOA(z.name)
+		if local == nil {
+			wait = secondaryRetry
+			continue
+		}
+
+		wait = time.Duration(local.Retry) * time.Second
+		if pastExpiry(local, lastRefresh) && !z.expired.Load() {
+			s.logger.Errorf("Secondary zone %s expired, no successful refresh for %s", z.name, time.Duration(local.Expire)*time.Second)
+			z.expired.Store(true)
+		}
+	}
+}
+
+// pastExpiry reports whether a zone last refreshed at lastRefresh has gone
+// past the expire timer of its SOA
+func pastExpiry(soa *dns.SOA, lastRefresh time.Time) bool {
+	return time.Since(lastRefresh) > time.Duration(soa.Expire)*time.Second
+}
+
+// refresh compares the zone's serial with its primaries and transfers the
+// zone from the first primary that has a newer copy. It returns the zone's
+// SOA after the refresh.
+func (s *secondaryManager) refresh(ctx context.Context, z *secondaryZone) (*dns.SOA, error) {
+	z.mu.Lock()
+	primaries, key := z.primaries, z.key
+	z.mu.Unlock()
+	if len(primaries) == 0 {
+		return nil, fmt.Errorf("no primaries configured")
+	}
+
+	local, err := s.localSOA(z.name)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, primary := range primaries {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		addr := util.HostPort(primary, 53)
+		remote, err := s.primarySOA(z.name, key, addr)
+		if err != nil {
+			lastErr = fmt.Errorf("SOA query to %s: %w", primary, err)
+			continue
+		}
+
+		if local != nil && !serialLess(local.Serial, remote.Serial) {
+			s.logger.Debugf("Secondary zone %s is up to date at serial %d", z.name, local.Serial)
+			return local, nil
+		}
+
+		soa, err := s.transfer(z.name, key, addr, local)
+		if err != nil {
+			lastErr = fmt.Errorf("transfer from %s: %w", primary, err)
+			continue
+		}
+		return soa, nil
+	}
+
+	return nil, lastErr
+}
+
+// localSOA returns the SOA of our copy of a zone, or nil if we have none
+func (s *secondaryManager) localSOA(zone string) (*dns.SOA, error) {
+	records, err := s.mariadbClient.GetRecordsByNameAndType(zone, zone, models.TypeSOA)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+
+	rr, err := recordToRR(&records[0], dns.Fqdn(zone))
+	if err != nil {
+		return nil, err
+	}
+	return rr.(*dns.SOA), nil
+}
+
+// primarySOA queries a primary for the SOA of a zone, signing the query
+// with key unless it is empty
+func (s *secondaryManager) primarySOA(zone, key, addr string) (*dns.SOA, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(zone), dns.TypeSOA)
+	if err := s.tsigKeys.sign(m, key); err != nil {
+		return nil, err
+	}
+
+	c := &dns.Client{Net: "udp", Timeout: secondaryTimeout, TsigProvider: s.tsigKeys}
+	resp, _, err := c.Exchange(m, addr)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.Exchange(m, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key != "" && resp.IsTsig() == nil {
+		return nil, fmt.Errorf("unsigned reply to signed query")
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("rcode %s", dns.RcodeToString[resp.Rcode])
+	}
+	if !resp.Authoritative {
+		return nil, fmt.Errorf("primary is not authoritative for the zone")
+	}
+
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa, nil
+		}
+	}
+	return nil, fmt.Errorf("no SOA in answer")
+}
+
+// transfer pulls a zone from a primary and stores it. An IXFR is requested
+// when we hold a copy already; primaries that cannot answer it incrementally
+// reply with the full zone instead. The request is signed with key unless
+// it is empty, and the reply's signatures are then verified.
+func (s *secondaryManager) transfer(zone, key, addr string, local *dns.SOA) (*dns.SOA, error) {
+	m := new(dns.Msg)
+	if local != nil {
+		m.SetIxfr(dns.Fqdn(zone), local.Serial, local.Ns, local.Mbox)
+	} else {
+		m.SetAxfr(dns.Fqdn(zone))
+	}
+	if err := s.tsigKeys.sign(m, key); err != nil {
+		return nil, err
+	}
+
+	tr := &dns.Transfer{
+		DialTimeout:  secondaryTimeout,
+		ReadTimeout:  secondaryTimeout,
+		WriteTimeout: secondaryTimeout,
+		TsigProvider: s.tsigKeys,
+	}
+	ch, err := tr.In(m, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var rrs []dns.RR
+	for envelope := range ch {
+		if envelope.Error != nil {
+			return nil, envelope.Error
+		}
+		rrs = append(rrs, envelope.RR...)
+	}
+
+	if len(rrs) == 0 {
+		return nil, fmt.Errorf("empty transfer")
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return nil, fmt.Errorf("transfer does not start with a SOA record")
+	}
+
+	// An incremental reply has the client's old SOA as its second record
+	if local != nil && len(rrs) > 1 {
+		if old, ok := rrs[1].(*dns.SOA); ok && old.Serial == local.Serial {
+			if err := s.applyIncremental(zone, local.Serial, rrs); err != nil {
+				return nil, err
+			}
+			s.zoneUpdated(zone, soa.Serial)
+			s.logger.Infof("IXFR of %s from %s: serial %d -> %d", zone, addr, local.Serial, soa.Serial)
+			return soa, nil
+		}
+	}
+
+	// A reply holding only the SOA means the zone is unchanged
+	if len(rrs) == 1 {
+		return soa, nil
+	}
+
+	if err := s.applyFull(zone, rrs); err != nil {
+		return nil, err
+	}
+	s.zoneUpdated(zone, soa.Serial)
+	s.logger.Infof("AXFR of %s from %s: serial %d (%d records)", zone, addr, soa.Serial, len(rrs)-1)
+	return soa, nil
+}
+
+// applyFull replaces the zone with the contents of an AXFR style transfer
+func (s *secondaryManager) applyFull(zone string, rrs []dns.RR) error {
+	// The closing SOA repeats the opening one
+	if _, ok := rrs[len(rrs)-1].(*dns.SOA); !ok {
+		return fmt.Errorf("transfer does not end with a SOA record")
+	}
+
+	records := s.toRecords(zone, rrs[:len(rrs)-1])
+	return s.mariadbClient.ReplaceZoneRecords(zone, records)
+}
+
+// applyIncremental applies the difference sequences of an IXFR reply
+// (RFC 1995 section 4) to our copy of a zone at serial. The whole reply is
+// checked before anything is stored, and all sequences are then applied in
+// one transaction, so a malformed reply leaves the zone as it was.
+func (s *secondaryManager) applyIncremental(zone string, serial uint32, rrs []dns.RR) error {
+	changes, err := s.incrementalChanges(zone, serial, rrs)
+	if err != nil {
+		return err
+	}
+	soa, err := rrToRecord(rrs[0], zone)
+	if err != nil {
+		return err
+	}
+	return s.mariadbClient.ApplyZoneChanges(zone, soa, changes, s.cfg.DNS.Transfer.JournalSize)
+}
+
+// incrementalChanges splits an IXFR reply into its difference sequences,
+// checking that they lead from serial to the serial the reply starts with
+// without gaps
+func (s *secondaryManager) incrementalChanges(zone string, serial uint32, rrs []dns.RR) ([]models.JournalEntry, error) {
+	final := rrs[0].(*dns.SOA)
+	rrs = rrs[1:]
+
+	var changes []models.JournalEntry
+	for len(rrs) > 0 {
+		from, ok := rrs[0].(*dns.SOA)
+		if !ok {
+			return nil, fmt.Errorf("malformed IXFR reply")
+		}
+		if len(rrs) == 1 {
+			// Closing SOA
+			if from.Serial != final.Serial || serial != final.Serial {
+				return nil, fmt.Errorf("IXFR reply ends at serial %d, want %d", serial, final.Serial)
+			}
+			return changes, nil
+		}
+		if from.Serial != serial {
+			return nil, fmt.Errorf("IXFR reply skips from serial %d to %d", serial, from.Serial)
+		}
+
+		// Records up to the next SOA are deleted, then records up to the
+		// SOA after that are added
+		i := 1
+		for i < len(rrs) && rrs[i].Header().Rrtype != dns.TypeSOA {
+			i++
+		}
+		if i == len(rrs) {
+			return nil, fmt.Errorf("truncated IXFR reply")
+		}
+		to := rrs[i].(*dns.SOA)
+		j := i + 1
+		for j < len(rrs) && rrs[j].Header().Rrtype != dns.TypeSOA {
+			j++
+		}
+
+		changes = append(changes, models.JournalEntry{
+			Zone:       zone,
+			SerialFrom: from.Serial,
+			SerialTo:   to.Serial,
+			Removed:    s.toRecords(zone, rrs[1:i]),
+			Added:      s.toRecords(zone, rrs[i+1:j]),
+		})
+		serial = to.Serial
+		rrs = rrs[j:]
+	}
+
+	return nil, fmt.Errorf("IXFR reply does not end with a SOA record")
+}
+
+// toRecords converts transferred resource records to records, skipping
+// types that cannot be stored
+func (s *secondaryManager) toRecords(zone string, rrs []dns.RR) []models.Record {
+	var records []models.Record
+	for _, rr := range rrs {
+		record, err := rrToRecord(rr, zone)
+		if err != nil {
+			s.logger.Warnf("Skipping record in transfer of %s: %v", zone, err)
+			continue
+		}
+		records = append(records, *record)
+	}
+	return records
+}
+
+// zoneUpdated drops the cached records of a zone after a transfer and
+// announces the new serial, which in turn notifies our own secondaries
+func (s *secondaryManager) zoneUpdated(zone string, serial uint32) {
+	ctx := context.Background()
+	if err := s.redisClient.InvalidateZone(ctx, zone); err != nil {
+		s.logger.Warnf("Failed to invalidate cache of zone %s: %v", zone, err)
+	}
+
+	update := &models.ZoneUpdate{Zone: zone, Serial: serial}
+	if err := s.redisClient.PublishZoneUpdate(ctx, update); err != nil {
+		s.logger.Warnf("Failed to publish update of zone %s: %v", zone, err)
+	}
+}
+
+// serveNotify answers a NOTIFY (RFC 1996) from the primary of a secondary
+// zone and schedules an immediate refresh of the zone
+func (h *DNSHandler) serveNotify(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		m.Authoritative = false
+		m.Rcode = dns.RcodeFormatError
+		h.writeMsg(w, m, nil)
+		return
+	}
+	q := r.Question[0]
+
+	zone, err := h.mariadbClient.GetZone(normalizeName(q.Name))
+	if err != nil {
+		h.logger.Errorf("Error looking up zone for NOTIFY: %v", err)
+		m.Rcode = dns.RcodeServerFailure
+		h.writeMsg(w, m, nil)
+		return
+	}
+	if zone == nil || zone.Kind != models.ZoneSecondary {
+		m.Authoritative = false
+		m.Rcode = dns.RcodeNotAuth
+		h.writeMsg(w, m, nil)
+		return
+	}
+
+	// Only the zone's primaries may trigger a refresh, signing the NOTIFY if
+	// the zone's TSIG policy asks for it
+	source := util.AddrIP(w.RemoteAddr())
+	fromPrimary := false
+	for _, primary := range zone.Primaries {
+		if ip := util.TargetIP(primary); ip != nil && ip.Equal(source) {
+			fromPrimary = true
+			break
+		}
+	}
+	if !fromPrimary || !tsigAllows(zone, models.TSIGNotify, r) {
+		h.logger.Warnf("Refused NOTIFY for %s from %s", zone.Name, w.RemoteAddr())
+		atomic.AddInt64(&h.stats.Refused, 1)
+		m.Authoritative = false
+		m.Rcode = dns.RcodeRefused
+		h.writeMsg(w, m, nil)
+		return
+	}
+
+	h.logger.Infof("Received NOTIFY for %s from %s", zone.Name, w.RemoteAddr())
+	if !h.secondaries.notify(zone.Name) {
+		// The zone was added after the last resync, it is picked up then
+		h.logger.Debugf("Secondary zone %s is not being refreshed yet", zone.Name)
+	}
+	h.writeMsg(w, m, nil)
+}
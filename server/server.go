@@ -2,8 +2,14 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/PooriaJ/RediDNS/config"
@@ -19,17 +25,56 @@ type DNSServer struct {
 	redisClient   *db.RedisClient
 	mariadbClient *db.MariaDBClient
 	logger        *logrus.Logger
-	server        *dns.Server
+	listeners     []*listener
 	handler       *DNSHandler
+	tsigKeys      *tsigKeyring
+	certs         *certReloader // Nil without DNS over TLS or HTTPS listeners
+	doh           *http.Server  // Nil without a DNS over HTTPS listener
+	notifier      *notifier
+	secondaries   *secondaryManager
+	rollover      *rolloverScheduler
+	errs          chan error
 	ctx           context.Context
 	cancel        context.CancelFunc
 }
 
+// listener is a single configured address/protocol pair and the
+// dns.Server serving it
+type listener struct {
+	cfg    config.ListenerConfig
+	addr   string
+	server *dns.Server
+}
+
+// String returns a human readable name for the listener, used in logs and errors
+func (l *listener) String() string {
+	return fmt.Sprintf("%s/%s", l.addr, l.cfg.Protocol)
+}
+
+// ListenerError reports a failure of a single DNS listener
+type ListenerError struct {
+	Listener string
+	Err      error
+}
+
+// Error implements the error interface
+func (e *ListenerError) Error() string {
+	return fmt.Sprintf("dns listener %s: %v", e.Listener, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ListenerError) Unwrap() error {
+	return e.Err
+}
+
 // NewDNSServer creates a new DNS server
 func NewDNSServer(cfg *config.Config, redisClient *db.RedisClient, mariadbClient *db.MariaDBClient, logger *logrus.Logger) (*DNSServer, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	handler := NewDNSHandler(redisClient, mariadbClient, logger)
+	handler := NewDNSHandler(cfg, redisClient, mariadbClient, logger)
+	tsigKeys := &tsigKeyring{}
+	secondaries := newSecondaryManager(cfg, redisClient, mariadbClient, tsigKeys, logger)
+	handler.secondaries = secondaries
 
 	return &DNSServer{
 		cfg:           cfg,
@@ -37,35 +82,258 @@ func NewDNSServer(cfg *config.Config, redisClient *db.RedisClient, mariadbClient
 		mariadbClient: mariadbClient,
 		logger:        logger,
 		handler:       handler,
+		tsigKeys:      tsigKeys,
+		notifier:      newNotifier(cfg, redisClient, mariadbClient, tsigKeys, logger),
+		secondaries:   secondaries,
+		rollover:      newRolloverScheduler(cfg, redisClient, mariadbClient, logger),
+		errs:          make(chan error, len(cfg.DNS.Listeners)+1),
 		ctx:           ctx,
 		cancel:        cancel,
 	}, nil
 }
 
-// Start starts the DNS server
+// Start binds all configured listeners and serves them in the background.
+// If any listener fails to bind, the ones already bound are closed again and
+// a *ListenerError is returned. Errors from listeners that stop after a
+// successful start are delivered on Errors.
 func (s *DNSServer) Start() error {
-	// Create DNS server
-	addr := fmt.Sprintf("%s:%d", s.cfg.DNS.Address, s.cfg.DNS.Port)
-	s.server = &dns.Server{
-		Addr:    addr,
-		Net:     s.cfg.DNS.Protocol,
-		Handler: s.handler,
+	if err := s.loadTSIGKeys(); err != nil {
+		return fmt.Errorf("failed to load TSIG keys: %w", err)
+	}
+
+	// Bind every listener first so that configuration errors are reported
+	// before anything starts answering queries
+	if err := s.bindListeners(); err != nil {
+		return err
+	}
+	var dohListener net.Listener
+	if s.cfg.DNS.DoH.Enabled && s.cfg.DNS.DoH.Port != 0 {
+		ln, err := s.bindDoH()
+		if err != nil {
+			s.closeListeners()
+			return err
+		}
+		dohListener = ln
 	}
 
 	// Start listening for record updates from Redis
 	go s.listenForRecordUpdates()
 
-	// Start DNS server
-	s.logger.Infof("Starting DNS server on %s (%s)", addr, s.cfg.DNS.Protocol)
-	return s.server.ListenAndServe()
+	// Start reloading TSIG keys as they are changed through the API
+	go s.listenForTSIGKeyUpdates()
+	go s.listenForDNSSECKeyUpdates()
+
+	// Start picking up renewed TLS certificates
+	if s.certs != nil {
+		go s.certs.run(s.ctx, time.Duration(s.cfg.DNS.TLS.ReloadInterval)*time.Second)
+	}
+
+	// Start notifying secondaries of zone changes
+	go s.notifier.run(s.ctx)
+
+	// Start keeping secondary zones in sync with their primaries
+	go s.secondaries.run(s.ctx)
+
+	// Start rolling DNSSEC keys over as they reach their lifetime
+	go s.rollover.run(s.ctx)
+
+	// Serve all listeners
+	for _, l := range s.listeners {
+		s.logger.Infof("Starting DNS server on %s", l)
+		go s.serve(l)
+	}
+	if dohListener != nil {
+		s.logger.Infof("Starting DNS over HTTPS server on %s", dohListener.Addr())
+		go s.serveDoH(dohListener)
+	}
+
+	return nil
 }
 
-// Stop stops the DNS server
+// Errors returns a channel that receives an error for each listener that
+// stops unexpectedly
+func (s *DNSServer) Errors() <-chan error {
+	return s.errs
+}
+
+// Stop stops all DNS listeners
 func (s *DNSServer) Stop() {
 	s.cancel()
-	if s.server != nil {
+	if len(s.listeners) > 0 {
 		s.logger.Info("Shutting down DNS server")
-		s.server.Shutdown()
+		for _, l := range s.listeners {
+			if err := l.server.Shutdown(); err != nil {
+				s.logger.Warnf("Failed to shut down DNS listener %s: %v", l, err)
+			}
+		}
+	}
+	if s.doh != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.doh.Shutdown(ctx); err != nil {
+			s.logger.Warnf("Failed to shut down DNS over HTTPS server: %v", err)
+		}
+	}
+}
+
+// bindListeners binds all configured DNS listeners. If one fails, the ones
+// already bound are closed again and its *ListenerError is returned.
+func (s *DNSServer) bindListeners() error {
+	for _, lc := range s.cfg.DNS.Listeners {
+		l, err := s.bind(lc)
+		if err != nil {
+			s.closeListeners()
+			return err
+		}
+		s.listeners = append(s.listeners, l)
+	}
+	return nil
+}
+
+// bind opens the socket for a configured listener
+func (s *DNSServer) bind(lc config.ListenerConfig) (*listener, error) {
+	l := &listener{
+		cfg:  lc,
+		addr: net.JoinHostPort(lc.Address, strconv.Itoa(lc.Port)),
+	}
+	opts := listenerOptions{
+		refuseUnhosted: lc.Unhosted != "nxdomain",
+	}
+	l.server = &dns.Server{
+		Addr:         l.addr,
+		Net:          lc.Protocol,
+		Handler:      s.handler.forListener(opts),
+		TsigProvider: s.tsigKeys,
+	}
+
+	network := listenerNetwork(lc)
+	switch lc.Protocol {
+	case "udp":
+		conn, err := net.ListenPacket(network, l.addr)
+		if err != nil {
+			return nil, &ListenerError{Listener: l.String(), Err: err}
+		}
+		l.server.PacketConn = conn
+	case "tcp":
+		ln, err := net.Listen(network, l.addr)
+		if err != nil {
+			return nil, &ListenerError{Listener: l.String(), Err: err}
+		}
+		l.server.Listener = ln
+	case "tcp-tls":
+		if err := s.loadCerts(); err != nil {
+			return nil, &ListenerError{Listener: l.String(), Err: err}
+		}
+		ln, err := net.Listen(network, l.addr)
+		if err != nil {
+			return nil, &ListenerError{Listener: l.String(), Err: err}
+		}
+		l.server.Listener = tls.NewListener(ln, s.certs.tlsConfig("dot"))
+	default:
+		return nil, &ListenerError{Listener: l.String(), Err: fmt.Errorf("unsupported protocol %q", lc.Protocol)}
+	}
+
+	return l, nil
+}
+
+// loadCerts loads the certificate of the TLS listeners unless it is loaded
+func (s *DNSServer) loadCerts() error {
+	if s.certs != nil {
+		return nil
+	}
+	certs, err := newCertReloader(s.cfg.DNS.TLS.CertFile, s.cfg.DNS.TLS.KeyFile, s.logger)
+	if err != nil {
+		return err
+	}
+	s.certs = certs
+	return nil
+}
+
+// DoHHandler returns the http.Handler answering DNS over HTTPS queries at
+// DoHPath, for serving them on the API server
+func (s *DNSServer) DoHHandler() http.Handler {
+	return &dohHandler{handler: s.handler, tsigKeys: s.tsigKeys, opts: defaultListenerOptions}
+}
+
+// bindDoH opens the socket of the DNS over HTTPS listener
+func (s *DNSServer) bindDoH() (net.Listener, error) {
+	addr := net.JoinHostPort(s.cfg.DNS.DoH.Address, strconv.Itoa(s.cfg.DNS.DoH.Port))
+	name := addr + "/https"
+	if err := s.loadCerts(); err != nil {
+		return nil, &ListenerError{Listener: name, Err: err}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, &ListenerError{Listener: name, Err: err}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(DoHPath, s.DoHHandler())
+	s.doh = &http.Server{
+		Handler:      mux,
+		TLSConfig:    s.certs.tlsConfig(),
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+	return ln, nil
+}
+
+// serveDoH serves DNS over HTTPS on a bound listener until it is shut down
+func (s *DNSServer) serveDoH(ln net.Listener) {
+	err := s.doh.ServeTLS(ln, "", "")
+	if s.ctx.Err() != nil || errors.Is(err, http.ErrServerClosed) {
+		return
+	}
+
+	s.logger.Errorf("DNS over HTTPS listener %s failed: %v", ln.Addr(), err)
+	s.errs <- &ListenerError{Listener: ln.Addr().String() + "/https", Err: err}
+}
+
+// serve runs a bound listener until it is shut down
+func (s *DNSServer) serve(l *listener) {
+	err := l.server.ActivateAndServe()
+
+	// Errors after Stop are expected and not reported
+	if s.ctx.Err() != nil {
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("listener stopped unexpectedly")
+	}
+
+	s.logger.Errorf("DNS listener %s failed: %v", l, err)
+	s.errs <- &ListenerError{Listener: l.String(), Err: err}
+}
+
+// closeListeners closes the sockets of listeners that were bound but never served
+func (s *DNSServer) closeListeners() {
+	for _, l := range s.listeners {
+		if l.server.PacketConn != nil {
+			l.server.PacketConn.Close()
+		}
+		if l.server.Listener != nil {
+			l.server.Listener.Close()
+		}
+	}
+	s.listeners = nil
+}
+
+// listenerNetwork returns the network to bind for a listener. Literal IPv4 and
+// IPv6 addresses are bound to their own address family so that 0.0.0.0 and ::
+// can be configured side by side.
+func listenerNetwork(lc config.ListenerConfig) string {
+	// DNS over TLS runs on TCP
+	network := strings.TrimSuffix(lc.Protocol, "-tls")
+
+	ip := net.ParseIP(lc.Address)
+	switch {
+	case ip == nil:
+		return network
+	case ip.To4() != nil:
+		return network + "4"
+	default:
+		return network + "6"
 	}
 }
 
@@ -104,6 +372,65 @@ func (s *DNSServer) listenForRecordUpdates() {
 			if err := s.redisClient.Del(ctx, multiCacheKey); err != nil {
 				s.logger.Warnf("Failed to invalidate multiple records cache: %v", err)
 			}
+
+			// Invalidate signatures of the records
+			sigCacheKey := fmt.Sprintf("dns:rrsig:%s:%s:%s", record.Zone, record.Name, record.Type)
+			if err := s.redisClient.Del(ctx, sigCacheKey); err != nil {
+				s.logger.Warnf("Failed to invalidate signature cache: %v", err)
+			}
+
+			// Invalidate wildcard answers, which the record may now shadow
+			if err := s.redisClient.InvalidateWildcards(ctx, record.Zone); err != nil {
+				s.logger.Warnf("Failed to invalidate wildcard cache: %v", err)
+			}
+		}
+	}
+}
+
+// loadTSIGKeys loads the TSIG keys signed requests are verified with
+func (s *DNSServer) loadTSIGKeys() error {
+	keys, err := s.mariadbClient.GetTSIGKeys()
+	if err != nil {
+		return err
+	}
+	s.tsigKeys.set(keys)
+	return nil
+}
+
+// listenForTSIGKeyUpdates reloads the TSIG keys whenever they change
+func (s *DNSServer) listenForTSIGKeyUpdates() {
+	pubsub := s.redisClient.SubscribeToTSIGKeysUpdates(s.ctx)
+	defer pubsub.Close()
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ch:
+			if err := s.loadTSIGKeys(); err != nil {
+				s.logger.Errorf("Failed to reload TSIG keys: %v", err)
+				continue
+			}
+			s.logger.Info("Reloaded TSIG keys")
+		}
+	}
+}
+
+// listenForDNSSECKeyUpdates drops the cached DNSSEC keys of a zone whenever
+// they are enabled, disabled or rolled over
+func (s *DNSServer) listenForDNSSECKeyUpdates() {
+	pubsub := s.redisClient.SubscribeToDNSSECKeysUpdates(s.ctx)
+	defer pubsub.Close()
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case msg := <-ch:
+			s.logger.Debugf("DNSSEC keys of zone %s changed", msg.Payload)
+			s.handler.invalidateKeys(msg.Payload)
 		}
 	}
 }
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// certReloader serves the certificate of the DNS over TLS and HTTPS
+// listeners and reloads it when its files change, so renewed certificates
+// are picked up by new connections without restarting the listeners
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   *logrus.Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // Latest modification time of the files loaded
+}
+
+// newCertReloader loads the certificate and key from their PEM files
+func newCertReloader(certFile, keyFile string, logger *logrus.Logger) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// tlsConfig returns the TLS configuration of a listener offering the given
+// ALPN protocols, "dot" for DNS over TLS (RFC 7858). HTTP servers add their
+// own.
+func (r *certReloader) tlsConfig(protos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     protos,
+		GetCertificate: r.getCertificate,
+	}
+}
+
+// getCertificate implements tls.Config.GetCertificate
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// reload loads the certificate again if either file changed since it was
+// last loaded, and reports whether it did
+func (r *certReloader) reload() (bool, error) {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	unchanged := r.cert != nil && modTime.Equal(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return true, nil
+}
+
+// filesModTime returns the latest modification time of the certificate
+// and key files
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to read TLS certificate: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// run checks the files for changes every interval until ctx is done. A
+// certificate that fails to load leaves the current one in use.
+func (r *certReloader) run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.reload()
+			if err != nil {
+				r.logger.Errorf("Failed to reload TLS certificate, keeping the current one: %v", err)
+				continue
+			}
+			if reloaded {
+				r.logger.Infof("Reloaded TLS certificate from %s", r.certFile)
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PooriaJ/RediDNS/models"
+	"github.com/PooriaJ/RediDNS/util"
+	"github.com/miekg/dns"
+)
+
+// tsigKeyring holds the TSIG keys requests are verified and responses
+// signed with (RFC 8945). It is the dns.TsigProvider of every listener, so
+// keys added through the API are used without restarting them.
+type tsigKeyring struct {
+	mu   sync.RWMutex
+	keys map[string]models.TSIGKey // By canonical key name
+}
+
+// set replaces the keys of the keyring
+func (k *tsigKeyring) set(keys []models.TSIGKey) {
+	byName := make(map[string]models.TSIGKey, len(keys))
+	for _, key := range keys {
+		byName[dns.CanonicalName(key.Name)] = key
+	}
+
+	k.mu.Lock()
+	k.keys = byName
+	k.mu.Unlock()
+}
+
+// sign adds a TSIG record for the named key to an outgoing message, which a
+// dns.Client or dns.Transfer with the keyring as its TsigProvider then signs
+// on the wire. An empty name leaves the message unsigned.
+func (k *tsigKeyring) sign(m *dns.Msg, name string) error {
+	if name == "" {
+		return nil
+	}
+
+	k.mu.RLock()
+	key, ok := k.keys[dns.CanonicalName(name)]
+	k.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown TSIG key %s", name)
+	}
+
+	m.SetTsig(dns.CanonicalName(key.Name), dns.Fqdn(key.Algorithm), 300, time.Now().Unix())
+	return nil
+}
+
+// Generate implements dns.TsigProvider
+func (k *tsigKeyring) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	k.mu.RLock()
+	key, ok := k.keys[dns.CanonicalName(t.Hdr.Name)]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, dns.ErrSecret
+	}
+
+	// A key is only valid with its own algorithm
+	if dns.CanonicalName(t.Algorithm) != dns.Fqdn(key.Algorithm) {
+		return nil, dns.ErrKeyAlg
+	}
+	var newHash func() hash.Hash
+	switch key.Algorithm {
+	case models.TSIGHmacSHA256:
+		newHash = sha256.New
+	case models.TSIGHmacSHA512:
+		newHash = sha512.New
+	default:
+		return nil, dns.ErrKeyAlg
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(key.Secret)
+	if err != nil {
+		return nil, dns.ErrSecret
+	}
+
+	mac := hmac.New(newHash, secret)
+	mac.Write(msg)
+	return mac.Sum(nil), nil
+}
+
+// Verify implements dns.TsigProvider
+func (k *tsigKeyring) Verify(msg []byte, t *dns.TSIG) error {
+	expected, err := k.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil || !hmac.Equal(mac, expected) {
+		return dns.ErrSig
+	}
+	return nil
+}
+
+// tsigWriter signs the responses to a request signed with a valid key
+// using the same key, as RFC 8945 section 5.3 requires
+type tsigWriter struct {
+	dns.ResponseWriter
+	tsig *dns.TSIG // TSIG record of the request
+}
+
+// WriteMsg implements dns.ResponseWriter. Responses that carry a TSIG
+// record already, such as those of zone transfers, are written as they are.
+func (w *tsigWriter) WriteMsg(m *dns.Msg) error {
+	if m.IsTsig() == nil {
+		m.SetTsig(w.tsig.Hdr.Name, w.tsig.Algorithm, w.tsig.Fudge, time.Now().Unix())
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// rejectTSIG answers a request whose TSIG record failed verification with
+// NOTAUTH and the TSIG error (RFC 8945 section 5.2). Only BADTIME responses
+// are signed: for the others the key is unknown or the client's MAC wrong.
+func (h *DNSHandler) rejectTSIG(w dns.ResponseWriter, m *dns.Msg, t *dns.TSIG, err error) {
+	h.logger.Warnf("TSIG verification of request from %s with key %s failed: %v", w.RemoteAddr(), t.Hdr.Name, err)
+	atomic.AddInt64(&h.stats.Refused, 1)
+
+	m.Authoritative = false
+	m.Rcode = dns.RcodeNotAuth
+	m.SetTsig(t.Hdr.Name, t.Algorithm, t.Fudge, int64(t.TimeSigned))
+	rr := m.Extra[len(m.Extra)-1].(*dns.TSIG)
+	switch {
+	case errors.Is(err, dns.ErrSecret), errors.Is(err, dns.ErrKeyAlg):
+		rr.Error = dns.RcodeBadKey
+	case errors.Is(err, dns.ErrTime):
+		// The client learns our time from the other data
+		rr.Error = dns.RcodeBadTime
+		now := uint64(time.Now().Unix())
+		rr.OtherLen = 6
+		rr.OtherData = hex.EncodeToString([]byte{
+			byte(now >> 40), byte(now >> 32), byte(now >> 24), byte(now >> 16), byte(now >> 8), byte(now),
+		})
+	default:
+		rr.Error = dns.RcodeBadSig
+	}
+
+	if err := w.WriteMsg(m); err != nil {
+		h.logger.Errorf("Error writing DNS response: %v", err)
+	}
+}
+
+// tsigAllows reports whether the TSIG policy of a zone lets a request for
+// op through: when the policy grants op to any keys, the request must be
+// signed with one of them. Requests reaching the handler with a TSIG record
+// have been verified by the listener.
+func tsigAllows(zone *models.Zone, op models.TSIGOperation, r *dns.Msg) bool {
+	keys := grantedKeys(zone, op)
+	if len(keys) == 0 {
+		return true
+	}
+	t := r.IsTsig()
+	return t != nil && slices.Contains(keys, normalizeName(t.Hdr.Name))
+}
+
+// requestAllowed reports whether a request for op from the client of w may
+// be served for a zone, acl being the addresses allowed to make it. Both the
+// address list and the TSIG policy must let the request through, and at
+// least one of them must be set up for op.
+func requestAllowed(zone *models.Zone, op models.TSIGOperation, acl []string, w dns.ResponseWriter, r *dns.Msg) bool {
+	if len(acl) == 0 {
+		return len(grantedKeys(zone, op)) > 0 && tsigAllows(zone, op, r)
+	}
+	return util.ACLAllows(acl, util.AddrIP(w.RemoteAddr())) && tsigAllows(zone, op, r)
+}
+
+// grantedKeys returns the names of the keys the TSIG policy of a zone
+// grants op to
+func grantedKeys(zone *models.Zone, op models.TSIGOperation) []string {
+	var keys []string
+	for _, grant := range zone.TSIGPolicy {
+		if slices.Contains(grant.Operations, op) {
+			keys = append(keys, normalizeName(grant.Key))
+		}
+	}
+	return keys
+}
@@ -0,0 +1,418 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync/atomic"
+
+	"github.com/PooriaJ/RediDNS/models"
+	"github.com/PooriaJ/RediDNS/util"
+	"github.com/miekg/dns"
+)
+
+// updateError aborts a dynamic update with a response code
+type updateError int
+
+func (e updateError) Error() string {
+	return dns.RcodeToString[int(e)]
+}
+
+// serveUpdate applies a dynamic update (RFC 2136) to a primary zone. The
+// prerequisites are checked and the update section applied in a single
+// transaction, after which the zone's serial is incremented and the change
+// published so caches are invalidated and secondaries notified.
+func (h *DNSHandler) serveUpdate(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	// The zone section holds exactly one SOA "question" (section 3.1.1)
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		m.Authoritative = false
+		m.Rcode = dns.RcodeFormatError
+		h.writeMsg(w, m, nil)
+		return
+	}
+	m.Authoritative = false
+
+	zone, err := h.mariadbClient.GetZone(normalizeName(r.Question[0].Name))
+	if err != nil {
+		h.logger.Errorf("Error looking up zone for UPDATE: %v", err)
+		m.Rcode = dns.RcodeServerFailure
+		h.writeMsg(w, m, nil)
+		return
+	}
+	if zone == nil || zone.Kind == models.ZoneSecondary {
+		// Updates are not forwarded to the primaries of secondary zones
+		m.Rcode = dns.RcodeNotAuth
+		h.writeMsg(w, m, nil)
+		return
+	}
+
+	if !requestAllowed(zone, models.TSIGUpdate, zone.AllowUpdate, w, r) {
+		h.logger.Warnf("Refused UPDATE of %s from %s", zone.Name, w.RemoteAddr())
+		atomic.AddInt64(&h.stats.Refused, 1)
+		m.Rcode = dns.RcodeRefused
+		h.writeMsg(w, m, nil)
+		return
+	}
+
+	if rcode := checkUpdate(zone.Name, r); rcode != dns.RcodeSuccess {
+		m.Rcode = rcode
+		h.writeMsg(w, m, nil)
+		return
+	}
+
+	var removed, added []models.Record
+	soa, err := h.mariadbClient.UpdateZoneRecords(zone.Name, h.cfg.DNS.Transfer.JournalSize, func(records []models.Record) ([]models.Record, []models.Record, error) {
+		var err error
+		removed, added, err = applyUpdate(zone.Name, records, r)
+		return removed, added, err
+	})
+	if err != nil {
+		var rcode updateError
+		if errors.As(err, &rcode) {
+			m.Rcode = int(rcode)
+		} else {
+			h.logger.Errorf("Error applying UPDATE to %s: %v", zone.Name, err)
+			m.Rcode = dns.RcodeServerFailure
+		}
+		h.writeMsg(w, m, nil)
+		return
+	}
+
+	if soa != nil {
+		h.logger.Infof("Applied UPDATE to %s from %s (%d removed, %d added)", zone.Name, w.RemoteAddr(), len(removed), len(added))
+		h.publishUpdate(soa, append(removed, added...))
+	}
+	h.writeMsg(w, m, nil)
+}
+
+// publishUpdate announces the records changed by an update and the zone's
+// new serial, so every server invalidates its caches and secondaries are
+// notified
+func (h *DNSHandler) publishUpdate(soa *models.Record, changed []models.Record) {
+	ctx := context.Background()
+	for _, record := range append(changed, *soa) {
+		if err := h.redisClient.PublishRecordUpdate(ctx, &record); err != nil {
+			h.logger.Warnf("Failed to publish record update: %v", err)
+		}
+	}
+
+	var soaData models.SOARecord
+	if err := json.Unmarshal([]byte(soa.Content), &soaData); err != nil {
+		h.logger.Warnf("Failed to parse SOA record of %s: %v", soa.Zone, err)
+		return
+	}
+	if err := h.redisClient.PublishZoneUpdate(ctx, &models.ZoneUpdate{Zone: soa.Zone, Serial: soaData.Serial}); err != nil {
+		h.logger.Warnf("Failed to publish zone update: %v", err)
+	}
+}
+
+// checkUpdate checks the form of the prerequisite and update sections of an
+// update to zone (sections 3.2 and 3.4.1), so that nothing is applied from
+// a malformed update. It returns the response code for the update.
+func checkUpdate(zone string, r *dns.Msg) int {
+	for _, rr := range r.Answer {
+		hdr := rr.Header()
+		if !inZone(zone, hdr.Name) {
+			return dns.RcodeNotZone
+		}
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		switch hdr.Class {
+		case dns.ClassANY, dns.ClassNONE:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassINET:
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for _, rr := range r.Ns {
+		hdr := rr.Header()
+		if !inZone(zone, hdr.Name) {
+			return dns.RcodeNotZone
+		}
+		if isMetaType(hdr.Rrtype) && !(hdr.Class == dns.ClassANY && hdr.Rrtype == dns.TypeANY) {
+			return dns.RcodeFormatError
+		}
+		switch hdr.Class {
+		case dns.ClassINET:
+			if hdr.Rdlength == 0 {
+				return dns.RcodeFormatError
+			}
+			if _, err := rrToRecord(rr, zone); err != nil {
+				// A type we can't store, such as DNSSEC records
+				return dns.RcodeRefused
+			}
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// applyUpdate checks the prerequisites of an update against the records of
+// zone and applies its update section (sections 3.2 and 3.4.2). It returns
+// the records removed from and added to the zone, or an updateError.
+func applyUpdate(zone string, records []models.Record, r *dns.Msg) ([]models.Record, []models.Record, error) {
+	if rcode := checkPrerequisites(records, r.Answer); rcode != dns.RcodeSuccess {
+		return nil, nil, updateError(rcode)
+	}
+
+	// Apply the update to a copy of the zone, in which added records have
+	// no ID yet
+	current := append([]models.Record(nil), records...)
+	for _, rr := range r.Ns {
+		current = applyUpdateRR(zone, current, rr)
+	}
+
+	kept := make(map[int64]bool)
+	var added []models.Record
+	for _, record := range current {
+		if record.ID == 0 {
+			added = append(added, record)
+		} else {
+			kept[record.ID] = true
+		}
+	}
+	var removed []models.Record
+	for _, record := range records {
+		if !kept[record.ID] {
+			removed = append(removed, record)
+		}
+	}
+	return removed, added, nil
+}
+
+// checkPrerequisites evaluates the prerequisite section of an update
+// against the records of a zone and returns the response code for it
+func checkPrerequisites(records []models.Record, prereqs []dns.RR) int {
+	// Value dependent prerequisites are compared per RRset
+	rrsets := make(map[string][]dns.RR)
+	var keys []string
+
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		name := normalizeName(hdr.Name)
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Rrtype == dns.TypeANY {
+				if len(recordsAt(records, name, 0)) == 0 {
+					return dns.RcodeNameError
+				}
+			} else if len(recordsAt(records, name, hdr.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if hdr.Rrtype == dns.TypeANY {
+				if len(recordsAt(records, name, 0)) != 0 {
+					return dns.RcodeYXDomain
+				}
+			} else if len(recordsAt(records, name, hdr.Rrtype)) != 0 {
+				return dns.RcodeYXRrset
+			}
+		default:
+			key := rrsetKey(hdr.Name, hdr.Rrtype)
+			if _, ok := rrsets[key]; !ok {
+				keys = append(keys, key)
+			}
+			rrsets[key] = append(rrsets[key], rr)
+		}
+	}
+
+	for _, key := range keys {
+		rrset := rrsets[key]
+		hdr := rrset[0].Header()
+		zoneRRs := recordRRs(recordsAt(records, normalizeName(hdr.Name), hdr.Rrtype))
+		if !sameRRs(rrset, zoneRRs) || !sameRRs(zoneRRs, rrset) {
+			return dns.RcodeNXRrset
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// applyUpdateRR applies a single RR of the update section to the records of
+// a zone and returns the resulting records. Changes the zone can't take,
+// such as removing its SOA record, are ignored as RFC 2136 requires.
+func applyUpdateRR(zone string, records []models.Record, rr dns.RR) []models.Record {
+	hdr := rr.Header()
+	name := normalizeName(hdr.Name)
+	apex := name == zone
+
+	switch hdr.Class {
+	case dns.ClassINET:
+		// Serials are maintained by the server
+		if hdr.Rrtype == dns.TypeSOA {
+			return records
+		}
+
+		record, err := rrToRecord(rr, zone)
+		if err != nil {
+			return records // Rejected by checkUpdate
+		}
+
+		// A CNAME can't coexist with other data at a name
+		for _, existing := range recordsAt(records, name, 0) {
+			isCNAME := existing.Type == models.TypeCNAME
+			if isCNAME != (hdr.Rrtype == dns.TypeCNAME) {
+				return records
+			}
+		}
+
+		// An RR with the same RDATA is replaced, which updates its TTL.
+		// Another CNAME replaces the one at the name.
+		for _, existing := range recordsAt(records, name, hdr.Rrtype) {
+			existingRR, err := recordToRR(&existing, dns.Fqdn(name))
+			if err != nil || !dns.IsDuplicate(existingRR, withClass(rr, dns.ClassINET)) {
+				continue
+			}
+			if existing.TTL == record.TTL {
+				return records
+			}
+			records = removeRecords(records, name, hdr.Rrtype, existingRR)
+			break
+		}
+		if hdr.Rrtype == dns.TypeCNAME {
+			records = removeRecords(records, name, dns.TypeCNAME, nil)
+		}
+		return append(records, *record)
+
+	case dns.ClassANY:
+		if hdr.Rrtype != dns.TypeANY {
+			if apex && (hdr.Rrtype == dns.TypeSOA || hdr.Rrtype == dns.TypeNS) {
+				return records
+			}
+			return removeRecords(records, name, hdr.Rrtype, nil)
+		}
+
+		// Deleting all RRsets at the apex leaves its SOA and NS records
+		var kept []models.Record
+		for _, record := range records {
+			if normalizeName(record.Name) != name || (apex && (record.Type == models.TypeSOA || record.Type == models.TypeNS)) {
+				kept = append(kept, record)
+			}
+		}
+		return kept
+
+	case dns.ClassNONE:
+		if hdr.Rrtype == dns.TypeSOA {
+			return records
+		}
+		target := withClass(rr, dns.ClassINET)
+		if apex && hdr.Rrtype == dns.TypeNS {
+			// The last NS record of the zone is kept
+			nsRRs := recordRRs(recordsAt(records, name, dns.TypeNS))
+			if len(nsRRs) == 1 && dns.IsDuplicate(nsRRs[0], target) {
+				return records
+			}
+		}
+		return removeRecords(records, name, hdr.Rrtype, target)
+	}
+
+	return records
+}
+
+// recordsAt returns the records owned by name, of type rrtype unless it is 0
+func recordsAt(records []models.Record, name string, rrtype uint16) []models.Record {
+	var matched []models.Record
+	for _, record := range records {
+		if normalizeName(record.Name) == name && (rrtype == 0 || recordType(&record) == rrtype) {
+			matched = append(matched, record)
+		}
+	}
+	return matched
+}
+
+// removeRecords removes the records of a type owned by name, only the one
+// matching rr if it is given
+func removeRecords(records []models.Record, name string, rrtype uint16, rr dns.RR) []models.Record {
+	var kept []models.Record
+	for _, record := range records {
+		if normalizeName(record.Name) != name || recordType(&record) != rrtype {
+			kept = append(kept, record)
+			continue
+		}
+		if rr != nil {
+			existing, err := recordToRR(&record, dns.Fqdn(name))
+			if err != nil || !dns.IsDuplicate(existing, rr) {
+				kept = append(kept, record)
+			}
+		}
+	}
+	return kept
+}
+
+// recordType returns the type code of a record, 0 for ALIAS records and
+// other types that don't exist in DNS
+func recordType(record *models.Record) uint16 {
+	rrtype, _ := util.RecordTypeCode(string(record.Type))
+	return rrtype
+}
+
+// recordRRs converts records to RRs, leaving out those that fail to convert
+func recordRRs(records []models.Record) []dns.RR {
+	var rrs []dns.RR
+	for _, record := range records {
+		if rr, err := recordToRR(&record, dns.Fqdn(record.Name)); err == nil {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// sameRRs reports whether every RR of a has the same RDATA as one of b
+func sameRRs(a, b []dns.RR) bool {
+	for _, rr := range a {
+		found := false
+		for _, other := range b {
+			if dns.IsDuplicate(withClass(rr, dns.ClassINET), withClass(other, dns.ClassINET)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// withClass returns a copy of rr in class, as update RRs use the classes
+// ANY and NONE to mark deletions and prerequisites
+func withClass(rr dns.RR, class uint16) dns.RR {
+	if rr.Header().Class == class {
+		return rr
+	}
+	rr = dns.Copy(rr)
+	rr.Header().Class = class
+	return rr
+}
+
+// inZone reports whether name is at or below the apex of zone
+func inZone(zone, name string) bool {
+	name = normalizeName(name)
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// isMetaType reports whether rrtype is a query type or meta type, which
+// can't be added to or deleted from a zone
+func isMetaType(rrtype uint16) bool {
+	switch rrtype {
+	case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB, dns.TypeOPT, dns.TypeTSIG, dns.TypeTKEY:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/PooriaJ/RediDNS/models"
+	"github.com/miekg/dns"
+)
+
+// xfrMessageSize is the uncompressed size budget of a single zone transfer
+// message. dns.Transfer does not compress, so this stays well below 64k.
+const xfrMessageSize = 16 * 1024
+
+// serveAXFR answers an AXFR request with the full contents of the zone
+func (h *DNSHandler) serveAXFR(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+
+	// Transfers are TCP only (RFC 5936 section 4.2)
+	if isUDP(w) {
+		h.refuseTransfer(w, r, "AXFR over UDP")
+		return
+	}
+
+	zone, err := h.mariadbClient.GetZone(normalizeName(q.Name))
+	if err != nil {
+		h.logger.Errorf("Error looking up zone for AXFR: %v", err)
+		h.failTransfer(w, r, dns.RcodeServerFailure)
+		return
+	}
+	if zone == nil {
+		// Not the apex of a hosted zone
+		h.failTransfer(w, r, dns.RcodeNotAuth)
+		return
+	}
+
+	if !requestAllowed(zone, models.TSIGAXFR, zone.AllowTransfer, w, r) {
+		h.refuseTransfer(w, r, fmt.Sprintf("AXFR of %s from %s", zone.Name, w.RemoteAddr()))
+		return
+	}
+
+	if h.secondaries.isExpired(zone.Name) {
+		h.failTransfer(w, r, dns.RcodeServerFailure)
+		return
+	}
+
+	rrs, err := h.zoneRRs(zone.Name)
+	if err != nil {
+		h.logger.Errorf("Error loading zone %s for AXFR: %v", zone.Name, err)
+		h.failTransfer(w, r, dns.RcodeServerFailure)
+		return
+	}
+
+	h.logger.Infof("AXFR of %s to %s (%d records)", zone.Name, w.RemoteAddr(), len(rrs))
+	h.transferOut(w, r, rrs)
+}
+
+// serveIXFR answers an IXFR request (RFC 1995) from the zone journal. When
+// the journal no longer reaches back to the client's serial the full zone is
+// sent instead, in AXFR form.
+func (h *DNSHandler) serveIXFR(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+
+	// The client's current SOA is in the authority section
+	var clientSOA *dns.SOA
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			clientSOA = soa
+			break
+		}
+	}
+	if clientSOA == nil {
+		h.failTransfer(w, r, dns.RcodeFormatError)
+		return
+	}
+
+	zone, err := h.mariadbClient.GetZone(normalizeName(q.Name))
+	if err != nil {
+		h.logger.Errorf("Error looking up zone for IXFR: %v", err)
+		h.failTransfer(w, r, dns.RcodeServerFailure)
+		return
+	}
+	if zone == nil {
+		h.failTransfer(w, r, dns.RcodeNotAuth)
+		return
+	}
+
+	if !requestAllowed(zone, models.TSIGIXFR, zone.AllowTransfer, w, r) {
+		h.refuseTransfer(w, r, fmt.Sprintf("IXFR of %s from %s", zone.Name, w.RemoteAddr()))
+		return
+	}
+
+	if h.secondaries.isExpired(zone.Name) {
+		h.failTransfer(w, r, dns.RcodeServerFailure)
+		return
+	}
+
+	soa, err := h.zoneSOA(zone.Name)
+	if err == nil && soa == nil {
+		err = fmt.Errorf("zone %s has no SOA record", zone.Name)
+	}
+	if err != nil {
+		h.logger.Errorf("Error loading SOA of %s for IXFR: %v", zone.Name, err)
+		h.failTransfer(w, r, dns.RcodeServerFailure)
+		return
+	}
+
+	// An up to date client, or any client over UDP, gets our SOA only; the
+	// latter will retry over TCP (RFC 1995 section 2)
+	if !serialLess(clientSOA.Serial, soa.Serial) || isUDP(w) {
+		h.transferOut(w, r, []dns.RR{soa})
+		return
+	}
+
+	rrs, err := h.journalRRs(zone.Name, clientSOA.Serial, soa)
+	if err != nil {
+		h.logger.Errorf("Error loading journal of %s for IXFR: %v", zone.Name, err)
+		h.failTransfer(w, r, dns.RcodeServerFailure)
+		return
+	}
+
+	if rrs == nil {
+		h.logger.Infof("Journal of %s does not cover serial %d, falling back to AXFR", zone.Name, clientSOA.Serial)
+		rrs, err = h.zoneRRs(zone.Name)
+		if err != nil {
+			h.logger.Errorf("Error loading zone %s for IXFR: %v", zone.Name, err)
+			h.failTransfer(w, r, dns.RcodeServerFailure)
+			return
+		}
+	}
+
+	h.logger.Infof("IXFR of %s from serial %d to %s (%d records)", zone.Name, clientSOA.Serial, w.RemoteAddr(), len(rrs))
+	h.transferOut(w, r, rrs)
+}
+
+// journalRRs builds the incremental transfer from serial to the current SOA.
+// It returns nil if the journal has no unbroken chain of changes from serial.
+func (h *DNSHandler) journalRRs(zone string, serial uint32, soa *dns.SOA) ([]dns.RR, error) {
+	entries, err := h.mariadbClient.GetZoneJournal(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the entry starting at the client's serial
+	start := -1
+	for i, entry := range entries {
+		if entry.SerialFrom == serial {
+			start = i
+		}
+	}
+	if start < 0 {
+		return nil, nil
+	}
+
+	rrs := []dns.RR{soa}
+	for _, entry := range entries[start:] {
+		if entry.SerialFrom != serial {
+			// Gap in the journal, e.g. the SOA was edited by hand
+			return nil, nil
+		}
+
+		rrs = append(rrs, soaWithSerial(soa, entry.SerialFrom))
+		for _, record := range entry.Removed {
+			if rr, err := recordToRR(&record, dns.Fqdn(record.Name)); err == nil {
+				rrs = append(rrs, rr)
+			}
+		}
+		rrs = append(rrs, soaWithSerial(soa, entry.SerialTo))
+		for _, record := range entry.Added {
+			if rr, err := recordToRR(&record, dns.Fqdn(record.Name)); err == nil {
+				rrs = append(rrs, rr)
+			}
+		}
+
+		serial = entry.SerialTo
+		if serial == soa.Serial {
+			return append(rrs, soa), nil
+		}
+	}
+
+	// The journal ends before the current serial
+	return nil, nil
+}
+
+// zoneSOA returns the SOA record at the apex of a zone, or nil if it has none
+func (h *DNSHandler) zoneSOA(zone string) (*dns.SOA, error) {
+	records, err := h.lookupRecords(zone, zone, models.TypeSOA)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	rr, err := recordToRR(&records[0], dns.Fqdn(zone))
+	if err != nil {
+		return nil, err
+	}
+	return rr.(*dns.SOA), nil
+}
+
+// soaWithSerial returns a copy of soa with a different serial
+func soaWithSerial(soa *dns.SOA, serial uint32) *dns.SOA {
+	rr := dns.Copy(soa).(*dns.SOA)
+	rr.Serial = serial
+	return rr
+}
+
+// serialLess reports whether serial a is older than b using RFC 1982 serial
+// number arithmetic
+func serialLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// zoneRRs returns all records of a zone framed by its SOA, as sent in an AXFR
+func (h *DNSHandler) zoneRRs(zone string) ([]dns.RR, error) {
+	records, err := h.mariadbClient.GetRecordsByZone(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	var soa dns.RR
+	var rrs []dns.RR
+	for _, record := range records {
+		rr, err := recordToRR(&record, dns.Fqdn(record.Name))
+		if err != nil {
+			h.logger.Warnf("Skipping record %d in transfer of %s: %v", record.ID, zone, err)
+			continue
+		}
+
+		if record.Type == models.TypeSOA {
+			if record.Name == zone && soa == nil {
+				soa = rr
+			}
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+
+	if soa == nil {
+		return nil, fmt.Errorf("zone %s has no SOA record", zone)
+	}
+
+	return append(append([]dns.RR{soa}, rrs...), soa), nil
+}
+
+// transferOut sends rrs to the client, split over as many messages as needed
+func (h *DNSHandler) transferOut(w dns.ResponseWriter, r *dns.Msg, rrs []dns.RR) {
+	var envelopes []*dns.Envelope
+	var current []dns.RR
+	size := 0
+	for _, rr := range rrs {
+		l := dns.Len(rr)
+		if len(current) > 0 && size+l > xfrMessageSize {
+			envelopes = append(envelopes, &dns.Envelope{RR: current})
+			current, size = nil, 0
+		}
+		current = append(current, rr)
+		size += l
+	}
+	if len(current) > 0 {
+		envelopes = append(envelopes, &dns.Envelope{RR: current})
+	}
+
+	ch := make(chan *dns.Envelope, len(envelopes))
+	for _, envelope := range envelopes {
+		ch <- envelope
+	}
+	close(ch)
+
+	tr := new(dns.Transfer)
+	if err := tr.Out(w, r, ch); err != nil {
+		h.logger.Errorf("Error sending zone transfer to %s: %v", w.RemoteAddr(), err)
+	}
+}
+
+// refuseTransfer answers a transfer request that is not allowed
+func (h *DNSHandler) refuseTransfer(w dns.ResponseWriter, r *dns.Msg, what string) {
+	h.logger.Warnf("Refused %s", what)
+	atomic.AddInt64(&h.stats.Refused, 1)
+	h.failTransfer(w, r, dns.RcodeRefused)
+}
+
+// failTransfer answers a transfer request with an error response code
+func (h *DNSHandler) failTransfer(w dns.ResponseWriter, r *dns.Msg, rcode int) {
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	if err := w.WriteMsg(m); err != nil {
+		h.logger.Errorf("Error writing DNS response: %v", err)
+	}
+}
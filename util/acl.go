@@ -0,0 +1,44 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ValidateACL checks that every entry of an access list is an IP address or a CIDR
+func ValidateACL(acl []string) error {
+	for _, entry := range acl {
+		if strings.Contains(entry, "/") {
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				return fmt.Errorf("invalid CIDR %q", entry)
+			}
+			continue
+		}
+		if net.ParseIP(entry) == nil {
+			return fmt.Errorf("invalid IP address %q", entry)
+		}
+	}
+	return nil
+}
+
+// ACLAllows reports whether ip matches any IP address or CIDR in the access list
+func ACLAllows(acl []string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, entry := range acl {
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+			if err == nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package util
+
+import (
+	"crypto"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/PooriaJ/RediDNS/models"
+	"github.com/miekg/dns"
+)
+
+// GenerateDNSSECKey creates a new ECDSA P-256 signing key for a zone
+func GenerateDNSSECKey(zone string, role models.KeyRole) (*models.DNSSECKey, error) {
+	dnskey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: dns.Fqdn(zone), Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET},
+		Flags:     dns.ZONE,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	if role == models.KeyRoleKSK {
+		dnskey.Flags |= dns.SEP
+	}
+
+	priv, err := dnskey.Generate(256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	return &models.DNSSECKey{
+		Zone:       zone,
+		Role:       role,
+		Algorithm:  dnskey.Algorithm,
+		Flags:      dnskey.Flags,
+		KeyTag:     dnskey.KeyTag(),
+		PublicKey:  dnskey.PublicKey,
+		PrivateKey: dnskey.PrivateKeyString(priv),
+	}, nil
+}
+
+// DNSKEY returns the DNSKEY record of a signing key
+func DNSKEY(key *models.DNSSECKey) *dns.DNSKEY {
+	return &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: dns.Fqdn(key.Zone), Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET},
+		Flags:     key.Flags,
+		Protocol:  3,
+		Algorithm: key.Algorithm,
+		PublicKey: key.PublicKey,
+	}
+}
+
+// DNSSECSigner parses the private part of a signing key
+func DNSSECSigner(key *models.DNSSECKey) (crypto.Signer, error) {
+	priv, err := DNSKEY(key).ReadPrivateKey(strings.NewReader(key.PrivateKey), key.Zone)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key %d of zone %s: %w", key.KeyTag, key.Zone, err)
+	}
+
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key %d of zone %s cannot sign", key.KeyTag, key.Zone)
+	}
+	return signer, nil
+}
+
+// DSRecord returns the SHA-256 DS record of a key signing key
+func DSRecord(key *models.DNSSECKey) *models.DSRecord {
+	ds := DNSKEY(key).ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+	return &models.DSRecord{
+		KeyTag:     ds.KeyTag,
+		Algorithm:  ds.Algorithm,
+		DigestType: ds.DigestType,
+		Digest:     ds.Digest,
+		Record:     ds.String(),
+	}
+}
+
+// CurrentKey returns the index of the newest active key of a role that is
+// not scheduled for retirement, or -1 if there is none
+func CurrentKey(keys []models.DNSSECKey, role models.KeyRole) int {
+	current := -1
+	for i := range keys {
+		if keys[i].Role == role && keys[i].State == models.KeyActive && keys[i].RetireAt == nil {
+			current = i
+		}
+	}
+	return current
+}
+
+// AwaitingDS reports whether a KSK rollover waits for the parent to publish
+// the DS of the new KSK. Until it does, the KSKs being replaced must stay in
+// the zone or validators following the old DS would find the zone bogus.
+func AwaitingDS(keys []models.DNSSECKey) bool {
+	current := CurrentKey(keys, models.KeyRoleKSK)
+	if current < 0 || keys[current].DSSeenAt != nil {
+		return false
+	}
+	for i := range keys {
+		key := &keys[i]
+		if key.Role == models.KeyRoleKSK && key.State != models.KeyRemoved && key.RetireAt != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfirmDS records that the parent publishes the DS of the current KSK
+// since now. KSKs being replaced by it are kept for at least delay more, for
+// cached copies of the old DS RRset to expire. It returns the keys that
+// changed, nil if the zone has no current KSK.
+func ConfirmDS(keys []models.DNSSECKey, now time.Time, delay time.Duration) []models.DNSSECKey {
+	current := CurrentKey(keys, models.KeyRoleKSK)
+	if current < 0 {
+		return nil
+	}
+
+	keys[current].DSSeenAt = &now
+	changed := []models.DNSSECKey{keys[current]}
+
+	keepUntil := now.Add(delay)
+	for i := range keys {
+		key := &keys[i]
+		if key.Role != models.KeyRoleKSK || key.State == models.KeyRemoved || key.RetireAt == nil {
+			continue
+		}
+		if key.RetireAt.Before(keepUntil) {
+			key.RetireAt = &keepUntil
+		}
+		if key.RemoveAt == nil || key.RemoveAt.Before(keepUntil) {
+			key.RemoveAt = &keepUntil
+		}
+		changed = append(changed, *key)
+	}
+	return changed
+}
+
+// dsLookupTimeout is how long a resolver is given to answer for the DS
+// records of a zone
+const dsLookupTimeout = 5 * time.Second
+
+// LookupDS asks resolvers in turn for the DS RRset of a zone, as published by
+// its parent, and returns the answer of the first one that responds. An
+// empty result means the zone is insecurely delegated.
+func LookupDS(resolvers []string, zone string) ([]*dns.DS, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(zone), dns.TypeDS)
+
+	lastErr := fmt.Errorf("no resolvers configured")
+	for _, resolver := range resolvers {
+		addr := HostPort(resolver, 53)
+		resp, _, err := (&dns.Client{Net: "udp", Timeout: dsLookupTimeout}).Exchange(req, addr)
+		if err == nil && resp.Truncated {
+			resp, _, err = (&dns.Client{Net: "tcp", Timeout: dsLookupTimeout}).Exchange(req, addr)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			lastErr = fmt.Errorf("%s answered %s", resolver, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+
+		var records []*dns.DS
+		for _, rr := range resp.Answer {
+			if ds, ok := rr.(*dns.DS); ok {
+				records = append(records, ds)
+			}
+		}
+		return records, nil
+	}
+
+	return nil, lastErr
+}
+
+// MatchesDS reports whether a DS record references a key signing key
+func MatchesDS(ds *dns.DS, key *models.DNSSECKey) bool {
+	dnskey := DNSKEY(key)
+	if ds.KeyTag != dnskey.KeyTag() || ds.Algorithm != dnskey.Algorithm {
+		return false
+	}
+	want := dnskey.ToDS(ds.DigestType)
+	return want != nil && strings.EqualFold(want.Digest, ds.Digest)
+}
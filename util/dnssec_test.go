@@ -0,0 +1,40 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/PooriaJ/RediDNS/models"
+	"github.com/miekg/dns"
+)
+
+func TestMatchesDS(t *testing.T) {
+	ksk, err := GenerateDNSSECKey("example.com", models.KeyRoleKSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateDNSSECKey("example.com", models.KeyRoleKSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sha256DS := DNSKEY(ksk).ToDS(dns.SHA256)
+	sha384DS := DNSKEY(ksk).ToDS(dns.SHA384)
+	wrongDigest := *sha256DS
+	wrongDigest.Digest = DNSKEY(other).ToDS(dns.SHA256).Digest
+
+	tests := []struct {
+		name string
+		ds   *dns.DS
+		want bool
+	}{
+		{"SHA-256", sha256DS, true},
+		{"SHA-384", sha384DS, true},
+		{"other key", DNSKEY(other).ToDS(dns.SHA256), false},
+		{"wrong digest", &wrongDigest, false},
+	}
+	for _, tt := range tests {
+		if got := MatchesDS(tt.ds, ksk); got != tt.want {
+			t.Errorf("%s: MatchesDS = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,29 +1,51 @@
 package util
 
 import (
+	"fmt"
 	"strings"
 )
 
 // FormatRecordName formats a record name based on the zone name
 // If the record name is '@', it returns the zone name
+// If the record name ends with a dot, it is fully qualified and the dot is dropped
 // If the record name already ends with the zone name, it returns it as is
-// Otherwise, it appends the zone name to the record name
+// Otherwise, it is relative to the zone and the zone name is appended
 func FormatRecordName(recordName, zoneName string) string {
 	// Handle '@' symbol for root domain
 	if recordName == "@" {
 		return zoneName
 	}
 
-	// If the record name already ends with the zone name, return it as is
-	if strings.HasSuffix(recordName, zoneName) {
-		return recordName
+	// A trailing dot marks a fully qualified domain name
+	if strings.HasSuffix(recordName, ".") {
+		return strings.TrimSuffix(recordName, ".")
 	}
 
-	// If the record name already contains dots, assume it's a fully qualified domain name
-	if strings.Contains(recordName, ".") {
+	// If the record name already ends with the zone name, return it as is
+	if recordName == zoneName || strings.HasSuffix(recordName, "."+zoneName) {
 		return recordName
 	}
 
 	// Otherwise, append the zone name to the record name
 	return recordName + "." + zoneName
 }
+
+// ValidateRecordName checks that a formatted record name belongs to the zone
+// and that a '*' label, which makes the record a wildcard, is only used as
+// the leftmost label (RFC 4592)
+func ValidateRecordName(recordName, zoneName string) error {
+	if recordName != zoneName && !strings.HasSuffix(recordName, "."+zoneName) {
+		return fmt.Errorf("record name %s is not in zone %s", recordName, zoneName)
+	}
+
+	for i, label := range strings.Split(recordName, ".") {
+		if label == "" {
+			return fmt.Errorf("record name %s has an empty label", recordName)
+		}
+		if strings.Contains(label, "*") && (i > 0 || label != "*") {
+			return fmt.Errorf("record name %s may only use '*' as its leftmost label", recordName)
+		}
+	}
+
+	return nil
+}
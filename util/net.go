@@ -0,0 +1,61 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// AddrIP returns the IP address of a UDP or TCP network address
+func AddrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// HostPort returns target as host:port, adding defaultPort when target is a
+// bare IP address
+func HostPort(target string, defaultPort int) string {
+	if ip := net.ParseIP(target); ip != nil {
+		return net.JoinHostPort(ip.String(), strconv.Itoa(defaultPort))
+	}
+	return target
+}
+
+// ValidateTargets checks that every entry is an IP address, optionally with a port
+func ValidateTargets(targets []string) error {
+	for _, target := range targets {
+		if net.ParseIP(target) != nil {
+			continue
+		}
+		host, port, err := net.SplitHostPort(target)
+		if err != nil || net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid address %q", target)
+		}
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+			return fmt.Errorf("invalid port in %q", target)
+		}
+	}
+	return nil
+}
+
+// TargetIP returns the IP address of a target accepted by ValidateTargets
+func TargetIP(target string) net.IP {
+	if ip := net.ParseIP(target); ip != nil {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
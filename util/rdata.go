@@ -0,0 +1,87 @@
+package util
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// unstorableTypes can't be stored as records: DNSSEC records, CDS and
+// CDNSKEY are generated from the keys of a zone, and the others are not zone
+// data at all
+var unstorableTypes = map[uint16]bool{
+	dns.TypeRRSIG:      true,
+	dns.TypeNSEC:       true,
+	dns.TypeNSEC3:      true,
+	dns.TypeNSEC3PARAM: true,
+	dns.TypeDNSKEY:     true,
+	dns.TypeCDS:        true,
+	dns.TypeCDNSKEY:    true,
+	dns.TypeOPT:        true,
+	dns.TypeTSIG:       true,
+	dns.TypeTKEY:       true,
+	dns.TypeIXFR:       true,
+	dns.TypeAXFR:       true,
+	dns.TypeMAILA:      true,
+	dns.TypeMAILB:      true,
+	dns.TypeANY:        true,
+}
+
+// RecordTypeCode returns the code of a record type given by its mnemonic
+// or in the generic form TYPEnnn (RFC 3597 section 5)
+func RecordTypeCode(recordType string) (uint16, bool) {
+	if rrtype, ok := dns.StringToType[recordType]; ok {
+		return rrtype, true
+	}
+	if !strings.HasPrefix(recordType, "TYPE") {
+		return 0, false
+	}
+	rrtype, err := strconv.ParseUint(recordType[len("TYPE"):], 10, 16)
+	if err != nil || rrtype == 0 {
+		return 0, false
+	}
+	return uint16(rrtype), true
+}
+
+// ParseRData parses a record of a type without a content model of its own
+// from its RDATA, either in presentation format or in the generic form
+// `\# <length> <hex>` (RFC 3597 section 5), which also serves the types
+// the parser knows no format for. Names in the RDATA are fully qualified.
+func ParseRData(owner string, ttl uint32, recordType, rdata string) (dns.RR, error) {
+	rrtype, ok := RecordTypeCode(recordType)
+	if !ok {
+		return nil, fmt.Errorf("unknown record type %s", recordType)
+	}
+	if unstorableTypes[rrtype] {
+		return nil, fmt.Errorf("%s records cannot be stored", recordType)
+	}
+	if strings.TrimSpace(rdata) == "" || strings.ContainsAny(rdata, "\r\n") {
+		return nil, fmt.Errorf("%s content must be a single line of RDATA", recordType)
+	}
+
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(owner), ttl, recordType, rdata))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s content: %w", recordType, err)
+	}
+	if rr == nil || rr.Header().Rrtype != rrtype {
+		return nil, fmt.Errorf("invalid %s content", recordType)
+	}
+	// The parser keeps the data of unknown types as given, hex or not
+	if generic, ok := rr.(*dns.RFC3597); ok {
+		if _, err := hex.DecodeString(generic.Rdata); err != nil {
+			return nil, fmt.Errorf("invalid %s content: RDATA must be hex encoded", recordType)
+		}
+	}
+	return rr, nil
+}
+
+// RData returns the RDATA of a record in presentation format
+func RData(rr dns.RR) string {
+	if generic, ok := rr.(*dns.RFC3597); ok {
+		return strings.TrimSpace(fmt.Sprintf(`\# %d %s`, len(generic.Rdata)/2, generic.Rdata))
+	}
+	return strings.TrimSpace(strings.TrimPrefix(rr.String(), rr.Header().String()))
+}
@@ -0,0 +1,91 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecordTypeCode(t *testing.T) {
+	tests := []struct {
+		recordType string
+		want       uint16
+		ok         bool
+	}{
+		{"A", dns.TypeA, true},
+		{"HINFO", dns.TypeHINFO, true},
+		{"TYPE1", dns.TypeA, true},
+		{"TYPE65280", 65280, true},
+		{"TYPE0", 0, false},
+		{"TYPE65536", 0, false},
+		{"TYPE", 0, false},
+		{"TYPEX", 0, false},
+		{"type99", 0, false},
+		{"FOO", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := RecordTypeCode(tt.recordType)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("RecordTypeCode(%q) = %d, %t, want %d, %t", tt.recordType, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseRData(t *testing.T) {
+	tests := []struct {
+		name       string
+		recordType string
+		rdata      string
+		want       string // RDATA served, "" if the content is invalid
+	}{
+		{"unknown type", "TYPE65280", `\# 4 0a000001`, `\# 4 0a000001`},
+		{"unknown type without data", "TYPE65280", `\# 0`, `\# 0`},
+		{"known type in generic form", "A", `\# 4 c0000201`, "192.0.2.1"},
+		{"known type by number", "TYPE13", `"PC" "Linux"`, `"PC" "Linux"`},
+		{"presentation format", "HINFO", `"PC" "Linux"`, `"PC" "Linux"`},
+		{"names are qualified", "RP", "admin.example.com info.example.com", "admin.example.com. info.example.com."},
+		{"unknown mnemonic", "FOO", `\# 0`, ""},
+		{"generated by the server", "DNSKEY", `\# 4 01000308`, ""},
+		{"CDS generated by the server", "CDS", `\# 4 01000308`, ""},
+		{"not zone data", "OPT", `\# 0`, ""},
+		{"empty", "HINFO", " ", ""},
+		{"several lines", "HINFO", "\"PC\"\n\"Linux\"", ""},
+		{"length mismatch", "TYPE65280", `\# 4 0a00`, ""},
+		{"not hex", "TYPE65280", `\# 2 zzzz`, ""},
+		{"unknown type in presentation format", "TYPE65280", "hello", ""},
+		{"invalid presentation format", "A", "not-an-address", ""},
+	}
+
+	for _, tt := range tests {
+		rr, err := ParseRData("www.example.com", 300, tt.recordType, tt.rdata)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: ParseRData(%s, %q) = %v, want an error", tt.name, tt.recordType, tt.rdata, rr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ParseRData(%s, %q): %v", tt.name, tt.recordType, tt.rdata, err)
+			continue
+		}
+
+		got := RData(rr)
+		if got != tt.want {
+			t.Errorf("%s: RData = %q, want %q", tt.name, got, tt.want)
+		}
+		if rr.Header().Name != "www.example.com." || rr.Header().Ttl != 300 {
+			t.Errorf("%s: header = %v", tt.name, rr.Header())
+		}
+
+		// What is served parses back to the same record
+		again, err := ParseRData("www.example.com", 300, dns.Type(rr.Header().Rrtype).String(), got)
+		if err != nil {
+			t.Errorf("%s: parsing %q again: %v", tt.name, got, err)
+			continue
+		}
+		if !dns.IsDuplicate(rr, again) {
+			t.Errorf("%s: round trip gave %v, want %v", tt.name, again, rr)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// svcbKeyPattern matches the presentation format of SvcParamKeys
+var svcbKeyPattern = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// SVCBParams parses the service parameters of an SVCB or HTTPS record from
+// their presentation format by key (RFC 9460 section 2.1). Keys without a
+// value, such as no-default-alpn, are given an empty one.
+func SVCBParams(params map[string]string) ([]dns.SVCBKeyValue, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		if !svcbKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid service parameter key %q", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Let the zone file parser handle the value formats of every key
+	var text strings.Builder
+	text.WriteString(". 0 IN SVCB 1 .")
+	for _, key := range keys {
+		text.WriteString(" " + key)
+		if value := params[key]; value != "" {
+			value = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+			text.WriteString(`="` + value + `"`)
+		}
+	}
+
+	rr, err := dns.NewRR(text.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid service parameters: %w", err)
+	}
+	return rr.(*dns.SVCB).Value, nil
+}
@@ -0,0 +1,61 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSVCBParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    string // Parameters in presentation format, "" if they are invalid
+		wantErr bool
+	}{
+		{"none", nil, "", false},
+		{"alpn and port", map[string]string{"alpn": "h2,h3", "port": "443"}, `alpn="h2,h3" port="443"`, false},
+		{"key without value", map[string]string{"alpn": "h2", "no-default-alpn": ""}, `alpn="h2" no-default-alpn=""`, false},
+		{"address hints", map[string]string{"ipv4hint": "192.0.2.1,192.0.2.2", "ipv6hint": "2001:db8::1"}, `ipv4hint="192.0.2.1,192.0.2.2" ipv6hint="2001:db8::1"`, false},
+		{"mandatory keys", map[string]string{"mandatory": "alpn", "alpn": "h2"}, `alpn="h2" mandatory="alpn"`, false},
+		{"generic key", map[string]string{"key65000": "abc"}, `key65000="abc"`, false},
+		{"upper case key", map[string]string{"ALPN": "h2"}, "", true},
+		{"key with spaces", map[string]string{"alpn port": "h2"}, "", true},
+		{"unknown key", map[string]string{"bogus": "x"}, "", true},
+		{"port not a number", map[string]string{"port": "https"}, "", true},
+		{"port out of range", map[string]string{"port": "70000"}, "", true},
+		{"IPv6 address as ipv4hint", map[string]string{"ipv4hint": "2001:db8::1"}, "", true},
+		{"IPv4 address as ipv6hint", map[string]string{"ipv6hint": "192.0.2.1"}, "", true},
+		{"ech not base64", map[string]string{"ech": "!!!"}, "", true},
+		{"value with no-default-alpn", map[string]string{"no-default-alpn": "h2"}, "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := SVCBParams(tt.params)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: SVCBParams = %v, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: SVCBParams: %v", tt.name, err)
+			continue
+		}
+
+		rr := &dns.SVCB{Priority: 1, Target: ".", Value: got}
+		if rdata := svcbParamsText(rr); rdata != tt.want {
+			t.Errorf("%s: SVCBParams gave %q, want %q", tt.name, rdata, tt.want)
+		}
+	}
+}
+
+// svcbParamsText returns the service parameters of an SVCB record in
+// presentation format
+func svcbParamsText(rr *dns.SVCB) string {
+	rdata := RData(rr)
+	if len(rdata) <= len("1 .") {
+		return ""
+	}
+	return rdata[len("1 . "):]
+}
@@ -0,0 +1,118 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxTXTString is the length limit of a character-string (RFC 1035 section 3.3)
+const maxTXTString = 255
+
+// TXTStrings returns the character-strings of TXT record content, escaped
+// the way the Txt field of dns.TXT holds them. Content is either a JSON
+// array of strings, a list of quoted strings in zone file format or a
+// plain value. Strings longer than 255 bytes are split.
+func TXTStrings(content string) ([]string, error) {
+	var values []string
+	switch {
+	case strings.HasPrefix(content, "["):
+		if err := json.Unmarshal([]byte(content), &values); err != nil {
+			return nil, fmt.Errorf("TXT content is not a JSON array of strings: %w", err)
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("TXT content has no strings")
+		}
+	case strings.HasPrefix(content, `"`):
+		rr, err := ParseRData(".", 0, "TXT", content)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range rr.(*dns.TXT).Txt {
+			values = append(values, unescapeTXT(s))
+		}
+	default:
+		values = []string{content}
+	}
+
+	var txt []string
+	for _, value := range values {
+		for _, chunk := range splitTXT(value) {
+			txt = append(txt, escapeTXT(chunk))
+		}
+	}
+	return txt, nil
+}
+
+// TXTContent returns the content a TXT record with the given Txt field is
+// stored as: its plain value if splitting that gives the same strings, and
+// a JSON array of the strings otherwise
+func TXTContent(txt []string) string {
+	values := make([]string, len(txt))
+	for i, s := range txt {
+		values[i] = unescapeTXT(s)
+	}
+
+	joined := strings.Join(values, "")
+	if !strings.HasPrefix(joined, "[") && !strings.HasPrefix(joined, `"`) && slices.Equal(splitTXT(joined), values) {
+		return joined
+	}
+
+	content, _ := json.Marshal(values)
+	return string(content)
+}
+
+// splitTXT splits a value into character-strings of at most 255 bytes
+func splitTXT(value string) []string {
+	chunks := []string{}
+	for len(value) > maxTXTString {
+		chunks = append(chunks, value[:maxTXTString])
+		value = value[maxTXTString:]
+	}
+	return append(chunks, value)
+}
+
+// escapeTXT escapes a character-string for the Txt field of dns.TXT, which
+// holds them in zone file format
+func escapeTXT(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unescapeTXT reverses escapeTXT, decoding \X and \DDD escapes
+func unescapeTXT(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i+2 < len(s) && isDigit(s[i]) && isDigit(s[i+1]) && isDigit(s[i+2]) {
+			b.WriteByte((s[i]-'0')*100 + (s[i+1]-'0')*10 + (s[i+2] - '0'))
+			i += 2
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// isDigit reports whether c is a decimal digit
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,98 @@
+package util
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTXTStrings(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		wantErr bool
+	}{
+		{"plain value", "v=spf1 -all", []string{"v=spf1 -all"}, false},
+		{"exactly 255 bytes", strings.Repeat("a", 255), []string{strings.Repeat("a", 255)}, false},
+		{"split at 255 bytes", strings.Repeat("a", 300), []string{strings.Repeat("a", 255), strings.Repeat("a", 45)}, false},
+		{"split into three", strings.Repeat("b", 600), []string{strings.Repeat("b", 255), strings.Repeat("b", 255), strings.Repeat("b", 90)}, false},
+		{"quotes and backslashes", `say "hi" \ ok`, []string{`say \"hi\" \\ ok`}, false},
+		{"control characters", "tab\there", []string{`tab\009here`}, false},
+		{"UTF-8", "café", []string{`caf\195\169`}, false},
+		// The split counts raw bytes, escapes don't push a string past 255
+		{"escape at the split", strings.Repeat("a", 254) + `"b`, []string{strings.Repeat("a", 254) + `\"`, "b"}, false},
+		{"JSON array", `["one", "two"]`, []string{"one", "two"}, false},
+		{"JSON array with a long string", `["` + strings.Repeat("c", 256) + `", "d"]`, []string{strings.Repeat("c", 255), "c", "d"}, false},
+		{"JSON array with escapes", `["a \"quoted\" word", "back\\slash"]`, []string{`a \"quoted\" word`, `back\\slash`}, false},
+		{"empty JSON array", `[]`, nil, true},
+		{"JSON array of numbers", `[1, 2]`, nil, true},
+		{"malformed JSON array", `["one"`, nil, true},
+		{"quoted strings", `"one" "two"`, []string{"one", "two"}, false},
+		{"quoted string with escapes", `"a\"b" "caf\195\169"`, []string{`a\"b`, `caf\195\169`}, false},
+		{"quoted string with spaces", `"hello world"`, []string{"hello world"}, false},
+	}
+
+	for _, tt := range tests {
+		got, err := TXTStrings(tt.content)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: TXTStrings = %q, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: TXTStrings: %v", tt.name, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: TXTStrings = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTXTContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string // Content stored after a round trip through the wire format
+	}{
+		{"plain value", "v=spf1 -all", "v=spf1 -all"},
+		{"long value", strings.Repeat("a", 600), strings.Repeat("a", 600)},
+		{"quotes and backslashes", `say "hi" \ ok`, `say "hi" \ ok`},
+		{"UTF-8", "café", "café"},
+		{"strings split elsewhere", `["one", "two"]`, `["one","two"]`},
+		{"quoted strings", `"one" "two"`, `["one","two"]`},
+		{"single quoted string", `"hello world"`, "hello world"},
+		{"value that looks like JSON", `["[x"]`, `["[x"]`},
+		{"value that looks quoted", `["\"x\""]`, `["\"x\""]`},
+	}
+
+	for _, tt := range tests {
+		txt, err := TXTStrings(tt.content)
+		if err != nil {
+			t.Errorf("%s: TXTStrings: %v", tt.name, err)
+			continue
+		}
+
+		// Pack and unpack the record to check the strings are valid on the wire
+		rr := &dns.TXT{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300}, Txt: txt}
+		buf := make([]byte, 4096)
+		n, err := dns.PackRR(rr, buf, 0, nil, false)
+		if err != nil {
+			t.Errorf("%s: packing %q: %v", tt.name, txt, err)
+			continue
+		}
+		unpacked, _, err := dns.UnpackRR(buf[:n], 0)
+		if err != nil {
+			t.Errorf("%s: unpacking: %v", tt.name, err)
+			continue
+		}
+
+		if got := TXTContent(unpacked.(*dns.TXT).Txt); got != tt.want {
+			t.Errorf("%s: TXTContent = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}